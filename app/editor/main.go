@@ -0,0 +1,56 @@
+// Command editor runs a whole site in one process: the window, the controler
+// and the network are goroutines linked by pipes in memory, in place of the
+// sockets of site.sh. The flags after -- are given to the network, e.g.
+//
+//	editor -f "Team notes" -- -port 9001 -targets 192.168.1.10:9000
+//	editor -invite "dte://192.168.1.10:9000/Team%20notes" -- -port 9001
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"app/gui"
+	"app/site"
+)
+
+var (
+	id        *string = flag.String("id", strconv.FormatInt(time.Now().UnixNano(), 10), "unique id of site (default: the current time, like site.sh)")
+	outputDir *string = flag.String("o", "./output", "output directory")
+	document  *string = flag.String("f", "", "name of the document (default: given by -invite, or New document - ID)")
+	invite    *string = flag.String("invite", "", "invitation link dte://host:port/<document>?token=<passphrase> of the document to join")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: editor [-id ID] [-o DIR] [-f DOCUMENT] [-invite LINK] [-- NETWORK FLAGS]")
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "The network flags are listed by: editor -- -h")
+	}
+	flag.Parse()
+	if *document == "" && *invite == "" {
+		*document = "New document - " + *id
+	}
+	if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	appArgs := []string{"-id", *id, "-o", *outputDir}
+	controlerArgs := []string{"-id", *id, "-o", *outputDir}
+	// the flags given after -- come last, to override these ones
+	networkArgs := []string{"-id", *id, "-topology", filepath.Join(*outputDir, *id+"_topology.json")}
+	if *document != "" {
+		appArgs = append(appArgs, "-f", *document)
+		networkArgs = append(networkArgs, "-document", *document)
+	}
+	if *invite != "" { // gives the name of the document when -f is not set
+		appArgs = append(appArgs, "-invite", *invite)
+		networkArgs = append(networkArgs, "-invite", *invite)
+	}
+	networkArgs = append(networkArgs, flag.Args()...)
+	site.Run(gui.Run, appArgs, controlerArgs, networkArgs)
+}
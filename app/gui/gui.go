@@ -0,0 +1,478 @@
+package gui
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"app/utils"
+	"protocol"
+	"wire"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// flags of the application, parsed by Run
+var flags = flag.NewFlagSet("app", flag.ExitOnError)
+
+var outputDir *string = flags.String("o", "./output", "output directory")
+
+// Interval in seconds between autosaves
+const autoSaveInterval = 500 * time.Millisecond
+
+// const autoSaveInterval = 2 * time.Second
+
+var filename *string = flags.String("f", "New document", "name of the file to edit")
+var id *string = flags.String("id", "0", "id of site")
+var framing *string = flags.String("framing", "line", "framing of the messages exchanged with the controller (line or len)")
+var inviteLink *string = flags.String("invite", "", "invitation link of the document joined, giving its name when -f is not set")
+var socketDir *string = flags.String("socket", "", "directory of the Unix sockets of the site: wait for the controller on the socket of the application instead of using stdin and stdout")
+
+var mutex = &sync.Mutex{}
+
+var (
+	localSaveFilePath string //path to the local save of the shared file in a log format
+	// localCutFilePath  string = fmt.Sprintf("%s/cut.json", *outputDir) //path to the cuts file TODO SUPRIMER
+)
+
+var (
+	lastText               string         //contains the last local text sync with the shared version
+	sectionAccess          bool   = false // true if the app have access to critical section
+	sectionAccessRequested bool   = false // true if app has request to access the critical section
+)
+
+var status *widget.Label // state of the network, shown next to the buttons
+
+var invite string // link to join the document through this site, given with the initial text
+
+var (
+	cut  bool = false //true if the cut button has been pressed
+	// Channel to signal goroutines to stop
+	stopChan = make(chan struct{})
+)
+
+// Run opens the window of a site with the flags in args: it reads the
+// messages of the controller on in, and writes its messages to out (or on the
+// link opened by the controller with -socket). The process exits when the
+// window is closed
+func Run(args []string, in io.Reader, out io.Writer) {
+	// Parse command line arguments
+	flags.Parse(args)
+	display_d("Starting app with id: " + *id)
+	if *inviteLink != "" && !flagSet("f") {
+		link, err := protocol.ParseInvite(*inviteLink)
+		if err != nil {
+			display_e(err.Error())
+			os.Exit(1)
+		}
+		*filename = link.Document
+	}
+	pipeFraming, err := wire.ParseFraming(*framing)
+	if err != nil {
+		display_e(err.Error())
+		os.Exit(1)
+	}
+	if *socketDir != "" {
+		conn, err := wire.AcceptSocket(wire.SocketPath(*socketDir, *id, wire.AppSocket))
+		if err != nil {
+			display_e("Cannot open the socket of the application: " + err.Error())
+			os.Exit(1)
+		}
+		in, out = conn, conn
+	}
+	stdin, stdout = wire.NewReader(in), wire.NewWriter(out)
+	stdin.SetFraming(pipeFraming)
+	stdout.SetFraming(pipeFraming)
+	// Sanitize filename by replacing spaces and special characters with "_"
+	reg := regexp.MustCompile("[^a-zA-Z0-9_-]+")
+	sanitizedFilename := reg.ReplaceAllString(*filename, "_")
+	// However, for simplicity with current dependencies, we'll stick to ReplaceAll for now.
+	// If more complex sanitization is needed, the regexp approach is recommended.
+
+	localSaveFilePath = fmt.Sprintf("%s/%s.log", *outputDir, sanitizedFilename)
+
+	// Initialize the UI and get window and text area
+	myWindow, textArea := initUI()
+	lastText = textArea.Text
+
+	// Launch the initialization process to be sure each site has the same initial local save
+	unifyVersions(textArea)
+
+	// Start send/receive routines
+	go send(textArea)
+	go receive(textArea)
+
+	// Display the windownewSiteKnown
+	myWindow.ShowAndRun()
+}
+
+// This function starts a cycle that gathers the most up-to-date version of the common text and propagates it to each site
+func unifyVersions(textArea *widget.Entry) {
+	for {
+		display_d("Waiting for initial message from controller...")
+		rcvmsg, err := readMessage()
+		if err != nil {
+			// display_e("Error reading message : " + err.Error())
+			continue
+		}
+		if initial, ok := rcvmsg.(*protocol.InitialText); ok { // Receive a new text message : corresponds to the initial text sent by the controller
+
+			text := initial.Text
+			invite = initial.Invite
+			if initial.SiteID == *id { // If the text is not empty, we are a secondary site so we need to update the local save file
+				// with the text received from the controller
+				display_d("Received initial message from controller, updating local save file as we are a secondary site")
+				// Erase the local save with the one received
+				err := os.WriteFile(localSaveFilePath, []byte(text), 0o644)
+				if err != nil {
+					display_e("Error while writing into log file: " + err.Error())
+				}
+
+				// Get the new content and replace the loacal save var + refresh UI
+				content, err := utils.GetUpdatedTextFromFile(0, "", localSaveFilePath)
+				if err != nil {
+					display_e("Error while reading log file: " + err.Error())
+				}
+				fyne.Do(func() {
+					textArea.SetText(content)
+					textArea.Refresh()
+					lastText = content
+				})
+			} else { // If the text is empty, we are the first site so we can keep the current text area content
+				display_d("Received initial message from controller, no need to update local save file as we are the first site")
+			}
+			return // Exit the loop after receiving the initial text to go to the main loop and display the UI
+		}
+	}
+}
+
+// A goroutine to manage local text saving and and to send modifications to other sites via the controller
+func send(textArea *widget.Entry) {
+	var sndmsg protocol.Message
+
+	for {
+		time.Sleep(autoSaveInterval) // Wait for the next autosave interval
+
+		sndmsg = nil
+
+		mutex.Lock()
+		cur := textArea.Text // current text displayed on the Fyne UI
+
+		if cut {
+			// if the cut button has been pressed we process it and communicate with controller
+			cut = false
+			var currentText string = getCurrentTextContentFormated()
+			sndmsg = &protocol.AppCut{Text: currentText}
+
+		} else if sectionAccess {
+			// if the controller has granted access to the critical section
+
+			// local save can be updated with user modifications
+			newTextDiffs := utils.ComputeDiffs(lastText, cur)
+			newText := utils.ApplyDiffs(lastText, newTextDiffs)
+			utils.SaveModifs(lastText, newText, localSaveFilePath)
+			lastText = newText
+
+			// app can release critical section access with its modifications
+			sndmsgBytes, err := json.Marshal(newTextDiffs)
+			if err != nil {
+				display_e("Error serializing diffs")
+				continue
+			}
+
+			// share the new text content with the controller in case of new site to be inserted
+			formattedText := getCurrentTextContentFormated()
+			writeMessage(&protocol.CurrentText{
+				Text:   formattedText,
+				SiteID: "-1", // -1 means that the demand is not cibled to a specific site and can engender multiple new connections
+			})
+
+			// send the critical section release message
+			sndmsg = &protocol.AppRelease{Text: string(sndmsgBytes)}
+
+			//booleans reseted to false
+			sectionAccess = false
+			sectionAccessRequested = false
+			display_d("Critical section released")
+
+		} else if (cur != lastText) && (!sectionAccessRequested) {
+			// Request access to the critical section if the text has changed
+			sectionAccessRequested = true
+			sndmsg = &protocol.AppRequest{}
+		}
+
+		if sndmsg != nil {
+			writeMessage(sndmsg)
+		}
+		mutex.Unlock()
+	}
+}
+
+// A goroutine to process received messages
+func receive(textArea *widget.Entry) {
+	var rcvuptdiffs []utils.Diff
+
+	for {
+
+		rcvmsg, err := readMessage()
+		if err != nil {
+			// display_e("Error reading message : " + err.Error())
+			continue
+		}
+
+		mutex.Lock()
+
+		cur := textArea.Text // current text displayed on the Fyne UI
+
+		switch rcvmsg := rcvmsg.(type) {
+
+		case *protocol.AppDied:
+			close(stopChan) // Signal to stop the application
+
+		case *protocol.CurrentText: // Demand to return the current text content
+			formatted := getCurrentTextContentFormated()
+			writeMessage(&protocol.CurrentText{
+				Text:   formatted,
+				SiteID: rcvmsg.SiteID,
+			}) // send the content
+			display_d("Returning current shared local text content to controller")
+
+		case *protocol.AppStartSc: // Receive start critical section message
+
+			sectionAccess = true
+			display_d("Critical section access granted")
+
+		case *protocol.AppUpdate: // Receive update from remote version
+
+			err := json.Unmarshal([]byte(rcvmsg.Text), &rcvuptdiffs)
+			if err != nil {
+				display_e("Error deserializing diffs")
+				break
+			}
+
+			// Apply the modifs on the local copy of the shared file without considering local unsaved user modifications
+			oldTextUpdated := utils.ApplyDiffs(lastText, rcvuptdiffs) // Apply the diffs to the last remote text
+			utils.SaveModifs(lastText, oldTextUpdated, localSaveFilePath)
+			// Apply the modifs receive on the UI considering the local unsaved user modifications
+			newText := utils.ApplyDiffs(cur, rcvuptdiffs) // Apply the diffs to the current text
+			// Update the shared file copy without unsaved local user modifs
+			lastText = oldTextUpdated
+
+			// Refresh UI
+			fyne.Do(func() {
+				textArea.SetText(newText)
+				textArea.Refresh()
+			})
+
+			display_d("Critical section updated")
+
+		case *protocol.Partition: // Sites out of reach : the document is edited without them until the partitions merge
+			setStatus(fmt.Sprintf("Network split: %d sites out of reach, their changes will be merged when they are back", len(rcvmsg.Unreachable)))
+
+		case *protocol.MergeLogs: // Merge the log of another partition with the local one, the log of the lowest site id first
+			local := getCurrentTextContentFormated()
+			first, second := local, rcvmsg.Text
+			if rcvmsg.SiteID < *id {
+				first, second = second, first
+			}
+			mergedLog, conflicts, err := utils.MergeLogs(first, second)
+			if err != nil {
+				display_e("Error merging the log of the partition of " + rcvmsg.SiteID + ": " + err.Error())
+				break
+			}
+			writeMessage(&protocol.MergedLog{Text: mergedLog, Conflicts: conflicts})
+
+		case *protocol.MergedLog: // Replace the local save with the log merged from two partitions
+			err := os.WriteFile(localSaveFilePath, []byte(rcvmsg.Text), 0o644)
+			if err != nil {
+				display_e("Error while writing into log file: " + err.Error())
+				break
+			}
+			content, err := utils.GetUpdatedTextFromFile(0, "", localSaveFilePath)
+			if err != nil {
+				display_e("Error while reading log file: " + err.Error())
+			}
+			// the local unsaved user modifications are merged too
+			newText, _ := utils.MergeTexts(lastText, content, cur)
+			lastText = content
+
+			fyne.Do(func() {
+				textArea.SetText(newText)
+				textArea.Refresh()
+			})
+			if rcvmsg.Conflicts > 0 {
+				setStatus(fmt.Sprintf("Network merged: %d conflicting changes, both versions were kept", rcvmsg.Conflicts))
+			} else {
+				setStatus("Network merged: the changes of both sides were kept")
+			}
+
+		case *protocol.CutContentRequest:
+			// send the local text content to the controleur for cut
+			var currentText string = getCurrentTextContentFormated()
+
+			writeMessage(&protocol.CutContentResponse{
+				CutInitiator: rcvmsg.CutInitiator,
+				Text:         currentText,
+			}) // send the content to controleur
+		}
+		mutex.Unlock()
+	}
+}
+
+// setStatus shows the state of the network to the user
+func setStatus(text string) {
+	display_w(text)
+	fyne.Do(func() {
+		status.SetText(text)
+	})
+}
+
+// A function to initialize the UI
+func initUI() (fyne.Window, *widget.Entry) {
+	var content fyne.CanvasObject
+
+	// Create the app with forced light theme
+	myApp := app.New()
+	myApp.Settings().SetTheme(&CustomTheme{})
+
+	// Create the window
+	myWindow := myApp.NewWindow(*filename)
+	myWindow.Resize(fyne.NewSize(800, 600))
+
+	// Create the text area
+	textArea := widget.NewMultiLineEntry()
+	textArea.SetPlaceHolder("Write something...")
+	textArea.Wrapping = fyne.TextWrapWord
+
+	// Create a white background behind the text area
+	whiteBackground := canvas.NewRectangle(color.White)
+	whiteBackground.Resize(fyne.NewSize(800, 600)) // ensure it covers
+
+	// Stack the white background and the text area
+	textContainer := container.NewStack(whiteBackground, textArea)
+
+	// Load the saved text
+	text, err := utils.GetUpdatedTextFromFile(0, "", localSaveFilePath)
+	if err != nil {
+		s_err := fmt.Sprintf("Error loading text from file: %v", err)
+		display_e(s_err)
+	}
+	textArea.SetText(text)
+
+	// Scrollable area
+	scrollable := container.NewScroll(textContainer)
+	scrollable.SetMinSize(fyne.NewSize(600, 400))
+
+	// "Cut" button
+	cutBtn := widget.NewButton("Cut", func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cut = true
+	})
+
+	// "Share" button
+	shareBtn := widget.NewButton("Share", func() {
+		showInvite(myWindow)
+	})
+
+	status = widget.NewLabel("")
+
+	// Bottom of window depending
+	bottomButtons := container.NewHBox(cutBtn, shareBtn, status)
+	content = container.NewBorder(nil, bottomButtons, nil, nil, scrollable)
+
+
+	// Set the content
+	myWindow.SetContent(content)
+	// Capture window close
+	myWindow.SetCloseIntercept(func() {
+		// Change the content of the main window to show closing message
+		message := widget.NewLabel("Application closing...\nPlease wait.")
+		message.Alignment = fyne.TextAlignCenter
+
+		// Center the message in the main window
+		closingContent := container.NewCenter(message)
+		myWindow.SetContent(closingContent)
+
+		// Send message to controller and clean shutdown
+		go func() {
+			display_w("Application closed by user, sending message to controller")
+			writeMessage(&protocol.AppDied{})
+
+			// wait to receive the confirmation from the controller to close the window
+			<-stopChan
+
+			// Close the window properly
+			fyne.Do(func() {
+				myWindow.Close()
+			})
+			os.Exit(0) // Exit the application
+		}()
+	})
+
+	return myWindow, textArea
+}
+
+// showInvite shows the link to join the document through this site, and
+// copies it to the clipboard
+func showInvite(window fyne.Window) {
+	if invite == "" {
+		dialog.ShowInformation("Share", "No invitation link: the network of this site has no document name", window)
+		return
+	}
+	fyne.CurrentApp().Clipboard().SetContent(invite)
+	link := widget.NewEntry()
+	link.SetText(invite)
+	dialog.ShowCustom("Share", "Close", container.NewVBox(widget.NewLabel("Invitation link, copied to the clipboard:"), link), window)
+}
+
+// flagSet reports whether the flag name was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+type CustomTheme struct{}
+
+func (m *CustomTheme) Color(name fyne.ThemeColorName, variant fyne.ThemeVariant) color.Color {
+	switch name {
+	case theme.ColorNameBackground, theme.ColorNameInputBackground:
+		return color.White
+	case theme.ColorNameButton, theme.ColorNameDisabledButton:
+		return color.White
+	case theme.ColorNameForeground, theme.ColorNamePrimary:
+		return color.Black
+	default:
+		return theme.DefaultTheme().Color(name, variant)
+	}
+}
+
+func (m *CustomTheme) Font(style fyne.TextStyle) fyne.Resource {
+	return theme.DefaultTheme().Font(style)
+}
+
+func (m *CustomTheme) Icon(name fyne.ThemeIconName) fyne.Resource {
+	return theme.DefaultTheme().Icon(name)
+}
+
+func (m *CustomTheme) Size(name fyne.ThemeSizeName) float32 {
+	switch name {
+	case theme.SizeNameText:
+		return 24 // Bigger font size
+	default:
+		return theme.DefaultTheme().Size(name)
+	}
+}
@@ -0,0 +1,54 @@
+package gui
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"protocol"
+	"wire"
+)
+
+var (
+	stdin  *wire.Reader // messages from the controller
+	stdout *wire.Writer // messages to the controller
+)
+
+// writeMessage sends a message to the controller
+func writeMessage(m protocol.Message) {
+	if err := stdout.WriteFrame(protocol.Marshal(m)); err != nil {
+		display_e("Error sending message : " + err.Error())
+	}
+}
+
+// readMessage returns the next message sent by the controller
+func readMessage() (protocol.Message, error) {
+	line, err := stdin.ReadFrame()
+	if errors.Is(err, wire.ErrFrameTooLarge) {
+		display_e("Dropped message from controller : " + err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(line)
+}
+
+// decodeMessage parses a line sent by the controller, messages meant for the
+// network are silently dropped and invalid ones are logged
+func decodeMessage(line string) (protocol.Message, error) {
+	m, err := protocol.Decode(line, protocol.ControlerToApp)
+	if err != nil && !errors.Is(err, protocol.ErrNotAddressed) {
+		display_e("Rejected message " + line + " : " + err.Error())
+	}
+	return m, err
+}
+
+func getCurrentTextContentFormated() string {
+	content, err := os.ReadFile(localSaveFilePath)
+	if err != nil {
+		display_e(fmt.Sprintf("Failed to read file %s: %v", localSaveFilePath, err))
+		return ""
+	}
+	// line breaks are escaped by the wire format when the content is sent
+	return string(content)
+}
@@ -8,7 +8,7 @@ import (
 var (
 	cyan   string = "\033[1;36m"
 	raz    string = "\033[0;00m"
-	rouge  string = "\033[1;31m"
+	red    string = "\033[1;31m"
 	orange string = "\033[1;33m"
 )
 
@@ -18,13 +18,13 @@ var (
 )
 
 func display_d(what string) {
-	stderr.Printf("%s + [%s %d net] %s%s", cyan, *id, pid, what, raz)
+	stderr.Printf("%s + [%s %d rly] %s%s", cyan, *id, pid, what, raz)
 }
 
 func display_w(what string) {
-	stderr.Printf("%s * [%s %d net] %s%s", orange, *id, pid, what, raz)
+	stderr.Printf("%s * [%s %d rly] %s%s", orange, *id, pid, what, raz)
 }
 
 func display_e(what string) {
-	stderr.Printf("%s ! [%s %d net] %s%s", rouge, *id, pid, what, raz)
+	stderr.Printf("%s ! [%s %d rly] %s%s", red, *id, pid, what, raz)
 }
@@ -0,0 +1,129 @@
+// Command relay is a site without window: it stands for the application next
+// to a network and a controler, keeps the document in its save file and
+// serves it to the sites which join, so the document stays available when
+// every user has closed their window.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+
+	"protocol"
+	"wire"
+)
+
+var outputDir *string = flag.String("o", "./output", "output directory")
+var filename *string = flag.String("f", "New document", "name of the document kept by the relay")
+var id *string = flag.String("id", "0", "id of site")
+var framing *string = flag.String("framing", "line", "framing of the messages exchanged with the controller (line or len)")
+var inviteLink *string = flag.String("invite", "", "invitation link of the document joined, giving its name when -f is not set")
+var socketDir *string = flag.String("socket", "", "directory of the Unix sockets of the site: wait for the controller on the socket of the application instead of using stdin and stdout")
+
+var (
+	stdin  = wire.NewReader(os.Stdin)  // messages from the controller
+	stdout = wire.NewWriter(os.Stdout) // messages to the controller
+)
+
+func main() {
+	flag.Parse()
+	display_d("Starting relay with id: " + *id)
+	if *inviteLink != "" && !flagSet("f") {
+		link, err := protocol.ParseInvite(*inviteLink)
+		if err != nil {
+			display_e(err.Error())
+			os.Exit(1)
+		}
+		*filename = link.Document
+	}
+	pipeFraming, err := wire.ParseFraming(*framing)
+	if err != nil {
+		display_e(err.Error())
+		os.Exit(1)
+	}
+	if *socketDir != "" {
+		conn, err := wire.AcceptSocket(wire.SocketPath(*socketDir, *id, wire.AppSocket))
+		if err != nil {
+			display_e("Cannot open the socket of the relay: " + err.Error())
+			os.Exit(1)
+		}
+		stdin, stdout = wire.NewReader(conn), wire.NewWriter(conn)
+	}
+	stdin.SetFraming(pipeFraming)
+	stdout.SetFraming(pipeFraming)
+	// same save file as the application for the same document
+	reg := regexp.MustCompile("[^a-zA-Z0-9_-]+")
+	r, err := openRelay(fmt.Sprintf("%s/%s.log", *outputDir, reg.ReplaceAllString(*filename, "_")))
+	if err != nil {
+		display_e("Cannot open the document: " + err.Error())
+		os.Exit(1)
+	}
+	display_d(fmt.Sprintf("Keeping the document in %s (%d characters)", r.path, len([]rune(r.text))))
+
+	messages := make(chan protocol.Message)
+	go readMessages(messages)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				display_w("Controller closed, exiting")
+				return
+			}
+			replies, done := r.handle(msg)
+			for _, reply := range replies {
+				writeMessage(reply)
+			}
+			if done {
+				return
+			}
+		case sig := <-sigs:
+			// the site leaves the network like an application closed by its user
+			display_w(fmt.Sprintf("Received signal: %s, leaving the network", sig))
+			writeMessage(&protocol.AppDied{})
+		}
+	}
+}
+
+// writeMessage sends a message to the controller
+func writeMessage(m protocol.Message) {
+	if err := stdout.WriteFrame(protocol.Marshal(m)); err != nil {
+		display_e("Error sending message : " + err.Error())
+	}
+}
+
+// readMessages passes the messages of the controller to messages, until it
+// closes its output
+func readMessages(messages chan<- protocol.Message) {
+	defer close(messages)
+	for {
+		line, err := stdin.ReadFrame()
+		if errors.Is(err, wire.ErrFrameTooLarge) {
+			display_e("Dropped message from controller : " + err.Error())
+			continue
+		} else if err != nil {
+			return
+		}
+		m, err := protocol.Decode(line, protocol.ControlerToApp)
+		if err != nil {
+			if !errors.Is(err, protocol.ErrNotAddressed) {
+				display_e("Rejected message " + line + " : " + err.Error())
+			}
+			continue
+		}
+		messages <- m
+	}
+}
+
+// flagSet reports whether the flag name was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
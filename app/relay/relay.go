@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"app/utils"
+	"protocol"
+)
+
+// relay is the document store of the site: the save file of the document, in
+// the log format of the application, and the text it gives
+type relay struct {
+	path        string
+	text        string
+	initialized bool // the initial text of the controller has been received
+}
+
+// openRelay loads the document saved in path, if any: a relay starting alone
+// serves it again
+func openRelay(path string) (*relay, error) {
+	text, err := utils.GetUpdatedTextFromFile(0, "", path)
+	if err != nil {
+		return nil, err
+	}
+	return &relay{path: path, text: text}, nil
+}
+
+// log returns the content of the save file, as sent to the other sites
+func (r *relay) log() string {
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		display_e(fmt.Sprintf("Failed to read file %s: %v", r.path, err))
+		return ""
+	}
+	return string(content)
+}
+
+// replaceLog replaces the save file with log, and the text with its text
+func (r *relay) replaceLog(log string) {
+	if err := os.MkdirAll(filepath.Dir(r.path), os.ModePerm); err != nil {
+		display_e("Error while creating the output directory: " + err.Error())
+	}
+	if err := os.WriteFile(r.path, []byte(log), 0o644); err != nil {
+		display_e("Error while writing into log file: " + err.Error())
+		return
+	}
+	text, err := utils.GetUpdatedTextFromFile(0, "", r.path)
+	if err != nil {
+		display_e("Error while reading log file: " + err.Error())
+	}
+	r.text = text
+}
+
+// handle applies a message of the controller to the document, and returns the
+// answers to send back. done is true when the relay must exit
+func (r *relay) handle(msg protocol.Message) (replies []protocol.Message, done bool) {
+	if initial, ok := msg.(*protocol.InitialText); ok && !r.initialized {
+		r.initialized = true
+		if invite, err := protocol.ParseInvite(initial.Invite); err == nil {
+			display_d("Invitation link of the document: " + invite.Redacted())
+		}
+		if initial.SiteID == *id { // secondary site: the document of the network replaces the local one
+			display_d("Received initial message from controller, updating local save file as we are a secondary site")
+			r.replaceLog(initial.Text)
+		} else {
+			display_d("Received initial message from controller, serving the local save file as we are the first site")
+		}
+		return nil, false
+	}
+	if !r.initialized {
+		return nil, false // the application only reads the initial text first
+	}
+
+	switch msg := msg.(type) {
+	case *protocol.AppDied:
+		display_w("The network has been told that the relay leaves, exiting")
+		return nil, true
+
+	case *protocol.CurrentText: // Demand to return the current text content
+		display_d("Returning the document to controller")
+		return []protocol.Message{&protocol.CurrentText{Text: r.log(), SiteID: msg.SiteID}}, false
+
+	case *protocol.AppStartSc:
+		// the relay never edits: the controller only asks for the critical
+		// section to add a site or to leave, the document is shared and the
+		// section released right away
+		display_d("Critical section access granted, releasing it without changes")
+		return []protocol.Message{
+			&protocol.CurrentText{Text: r.log(), SiteID: "-1"},
+			&protocol.AppRelease{Text: "[]"},
+		}, false
+
+	case *protocol.AppUpdate: // Receive update from remote version
+		var diffs []utils.Diff
+		if err := json.Unmarshal([]byte(msg.Text), &diffs); err != nil {
+			display_e("Error deserializing diffs")
+			return nil, false
+		}
+		newText := utils.ApplyDiffs(r.text, diffs)
+		if err := utils.SaveModifs(r.text, newText, r.path); err != nil {
+			display_e("Error while writing into log file: " + err.Error())
+		}
+		r.text = newText
+		display_d("Document updated")
+
+	case *protocol.MergeLogs: // Merge the log of another partition with the local one, the log of the lowest site id first
+		first, second := r.log(), msg.Text
+		if msg.SiteID < *id {
+			first, second = second, first
+		}
+		mergedLog, conflicts, err := utils.MergeLogs(first, second)
+		if err != nil {
+			display_e("Error merging the log of the partition of " + msg.SiteID + ": " + err.Error())
+			return nil, false
+		}
+		return []protocol.Message{&protocol.MergedLog{Text: mergedLog, Conflicts: conflicts}}, false
+
+	case *protocol.MergedLog: // Replace the local save with the log merged from two partitions
+		r.replaceLog(msg.Text)
+		display_d(fmt.Sprintf("Document merged with another partition (%d conflicts)", msg.Conflicts))
+
+	case *protocol.Partition:
+		display_w(fmt.Sprintf("Network split: %d sites out of reach", len(msg.Unreachable)))
+
+	case *protocol.CutContentRequest:
+		return []protocol.Message{&protocol.CutContentResponse{CutInitiator: msg.CutInitiator, Text: r.log()}}, false
+	}
+	return nil, false
+}
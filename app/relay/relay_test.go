@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"app/utils"
+	"protocol"
+)
+
+func diffLog(diffs ...utils.Diff) string {
+	var log strings.Builder
+	for _, d := range diffs {
+		log.WriteString(d.String() + "\n")
+	}
+	return log.String()
+}
+
+func TestRelayKeepsDocument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.log")
+	r, err := openRelay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// joins a network whose document is "hello"
+	if replies, _ := r.handle(&protocol.InitialText{SiteID: *id, Text: diffLog(utils.Diff{Pos: 0, NewText: "hello"})}); replies != nil {
+		t.Errorf("initial text answered with %v", replies)
+	}
+	r.handle(&protocol.AppUpdate{Text: `[{"Pos":5,"NbDeleted":0,"NewText":" world"}]`})
+	if r.text != "hello world" {
+		t.Errorf("text %q after the update, want %q", r.text, "hello world")
+	}
+
+	// a site joins through the relay
+	replies, _ := r.handle(&protocol.CurrentText{SiteID: "joiner"})
+	if len(replies) != 1 {
+		t.Fatalf("%d answers to the demand of the text, want 1", len(replies))
+	}
+	shared := replies[0].(*protocol.CurrentText)
+	if shared.SiteID != "joiner" || shared.Text != r.log() {
+		t.Errorf("shared %+v, want the log for joiner", shared)
+	}
+	replies, _ = r.handle(&protocol.AppStartSc{})
+	if len(replies) != 2 || replies[1].Type() != protocol.MsgAppRelease {
+		t.Fatalf("critical section answered with %v, want the text and a release", replies)
+	}
+	if release := replies[1].(*protocol.AppRelease); release.Text != "[]" {
+		t.Errorf("release with the diffs %s, want none", release.Text)
+	}
+
+	// the document is served again after a restart
+	r, err = openRelay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.text != "hello world" {
+		t.Errorf("text %q after a restart, want %q", r.text, "hello world")
+	}
+	r.handle(&protocol.InitialText{}) // first site of the network
+	replies, _ = r.handle(&protocol.CurrentText{SiteID: "-1"})
+	if text := replayLog(t, replies[0].(*protocol.CurrentText).Text); text != "hello world" {
+		t.Errorf("served %q after a restart, want %q", text, "hello world")
+	}
+
+	if _, done := r.handle(&protocol.AppDied{}); !done {
+		t.Error("relay still running once its leave is known")
+	}
+}
+
+// replayLog returns the text of a log
+func replayLog(t *testing.T, log string) string {
+	other := &relay{path: filepath.Join(t.TempDir(), "replay.log")}
+	other.replaceLog(log)
+	return other.text
+}
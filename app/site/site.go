@@ -0,0 +1,33 @@
+// Package site runs the three layers of a site in one process: the
+// application, the controler and the network are goroutines which exchange
+// the same messages as through the sockets of site.sh, over pipes in memory.
+package site
+
+import (
+	"io"
+
+	"controler/control"
+	"network/node"
+	"wire"
+)
+
+// Layer runs a layer of a site with the flags in args: it reads its messages
+// on in and writes its own to out. The application is given as a Layer, so
+// that the window or a stand-in can be run
+type Layer func(args []string, in io.Reader, out io.Writer)
+
+// messages held by a pipe, like the buffer of a FIFO
+const pipeSize = 1024
+
+// Run runs the controler and the network of a site in the background, and the
+// application app until it returns. Each layer gets its own flags
+func Run(app Layer, appArgs, controlerArgs, networkArgs []string) {
+	fromNetwork := wire.NewPipe(pipeSize)
+	fromApp := wire.NewPipe(pipeSize)
+	toApp := wire.NewPipe(pipeSize)
+	toNetwork := wire.NewPipe(pipeSize)
+	go node.Run(networkArgs, toNetwork, fromNetwork)
+	// the controler writes to each layer only the messages registered for it
+	go control.Run(controlerArgs, fromNetwork, fromApp, toNetwork, toApp)
+	app(appArgs, toApp, fromApp)
+}
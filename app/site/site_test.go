@@ -0,0 +1,59 @@
+package site
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// TestSiteInProcess runs a site alone with an application which asks twice
+// for the critical section: its requests and releases go through the
+// controler and the network and come back, and it gets no message of the
+// network
+func TestSiteInProcess(t *testing.T) {
+	received := make(chan protocol.Message, 16)
+	app := func(args []string, in io.Reader, out io.Writer) {
+		go func() {
+			r := wire.NewReader(in)
+			for {
+				frame, err := r.ReadFrame()
+				if err != nil {
+					return
+				}
+				if msg, err := protocol.Unmarshal(frame); err == nil {
+					received <- msg
+				}
+			}
+		}()
+		w := wire.NewWriter(out)
+		send := func(msg protocol.Message) { w.WriteFrame(protocol.Marshal(msg)) }
+		expect := func(typ string) {
+			t.Helper()
+			timeout := time.After(10 * time.Second)
+			for {
+				select {
+				case msg := <-received:
+					if !protocol.Registered(msg.Type(), protocol.ControlerToApp) {
+						t.Fatalf("the application got %s, a message of the network", msg.Type())
+					}
+					if msg.Type() == typ {
+						return
+					}
+				case <-timeout:
+					t.Fatalf("the application never got %s", typ)
+				}
+			}
+		}
+		expect(protocol.MsgReturnInitialText)
+		for range 2 {
+			send(&protocol.AppRequest{})
+			expect(protocol.MsgAppStartSc)
+			send(&protocol.AppRelease{Text: "[]"})
+		}
+	}
+	dir := t.TempDir()
+	Run(app, nil, []string{"-id", "1", "-o", dir}, []string{"-id", "1", "-listen", "127.0.0.1:0"})
+}
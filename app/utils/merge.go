@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MergeTexts merges the changes made to base in a and in b. The changes of a
+// and b which touch the same part of base are conflicts: both versions of the
+// part are kept, the one of a first
+func MergeTexts(base, a, b string) (string, int) {
+	changesA, changesB := ComputeDiffs(base, a), ComputeDiffs(base, b)
+	rBase := []rune(base)
+	var merged []Diff
+	conflicts := 0
+
+	i, j := 0, 0
+	for i < len(changesA) || j < len(changesB) {
+		// the changes overlapping the first one left form a group
+		var groupA, groupB []Diff
+		var first Diff
+		if j >= len(changesB) || i < len(changesA) && changesA[i].Pos <= changesB[j].Pos {
+			first = changesA[i]
+			groupA = append(groupA, first)
+			i++
+		} else {
+			first = changesB[j]
+			groupB = append(groupB, first)
+			j++
+		}
+		start, end := first.Pos, first.Pos+first.NbDeleted
+		overlaps := func(d Diff) bool { return d.Pos < end || d.Pos == start }
+		for {
+			if i < len(changesA) && overlaps(changesA[i]) {
+				groupA = append(groupA, changesA[i])
+				end = max(end, changesA[i].Pos+changesA[i].NbDeleted)
+				i++
+			} else if j < len(changesB) && overlaps(changesB[j]) {
+				groupB = append(groupB, changesB[j])
+				end = max(end, changesB[j].Pos+changesB[j].NbDeleted)
+				j++
+			} else {
+				break
+			}
+		}
+
+		if len(groupB) == 0 {
+			merged = append(merged, groupA...)
+			continue
+		}
+		if len(groupA) == 0 {
+			merged = append(merged, groupB...)
+			continue
+		}
+		part := string(rBase[start:end])
+		versionA, versionB := applyAt(part, groupA, start), applyAt(part, groupB, start)
+		if versionA != versionB {
+			conflicts++
+			versionA += versionB
+		}
+		merged = append(merged, Diff{Pos: start, NbDeleted: end - start, NewText: versionA})
+	}
+	return ApplyDiffs(base, merged), conflicts
+}
+
+// applyAt applies to part of a text the diffs computed on the whole text,
+// part starting at start
+func applyAt(part string, diffs []Diff, start int) string {
+	shifted := make([]Diff, len(diffs))
+	for k, d := range diffs {
+		shifted[k] = Diff{Pos: d.Pos - start, NbDeleted: d.NbDeleted, NewText: d.NewText}
+	}
+	return ApplyDiffs(part, shifted)
+}
+
+// MergeLogs merges two logs of the same document which diverged, one diff per
+// line as in the save file. The lines they share are kept, followed by the
+// lines of first and by the diffs turning the text of first into the merged
+// text. The result only depends on the order of the logs, and it returns the
+// number of conflicts
+func MergeLogs(first, second string) (string, int, error) {
+	linesA, linesB := logLines(first), logLines(second)
+	shared := 0
+	for shared < len(linesA) && shared < len(linesB) && linesA[shared] == linesB[shared] {
+		shared++
+	}
+	base, err := replay(linesA[:shared])
+	if err != nil {
+		return "", 0, err
+	}
+	textA, err := replay(linesA)
+	if err != nil {
+		return "", 0, err
+	}
+	textB, err := replay(linesB)
+	if err != nil {
+		return "", 0, err
+	}
+	merged, conflicts := MergeTexts(base, textA, textB)
+
+	var log strings.Builder
+	for _, line := range linesA {
+		log.WriteString(line + "\n")
+	}
+	// the save file is replayed diff after diff: the last change is written
+	// first so that the positions of the others stay valid
+	diffs := ComputeDiffs(textA, merged)
+	for k := len(diffs) - 1; k >= 0; k-- {
+		log.WriteString(diffs[k].String() + "\n")
+	}
+	return log.String(), conflicts, nil
+}
+
+func logLines(log string) []string {
+	var lines []string
+	for _, line := range strings.Split(log, "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// replay returns the text of a log
+func replay(lines []string) (string, error) {
+	diffs := make([]Diff, len(lines))
+	for k, line := range lines {
+		if err := json.Unmarshal([]byte(line), &diffs[k]); err != nil {
+			return "", fmt.Errorf("ligne %d: %w", k, err)
+		}
+	}
+	return ApplyDiffsSequential("", diffs), nil
+}
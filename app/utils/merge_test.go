@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeTexts(t *testing.T) {
+	tests := []struct {
+		base, a, b string
+		want       string
+		conflicts  int
+	}{
+		{"hello world", "hello world", "hello world", "hello world", 0},
+		{"hello world", "hello big world", "hello world!", "hello big world!", 0},
+		{"hello world", "Hello world", "hello World", "Hello World", 0},
+		{"hello world", "hello there", "hello there", "hello there", 0},
+		{"hello world", "", "hello world", "", 0},
+		{"hello world", "hello you", "hello them", "hello youthem", 1},
+		{"abc", "abXc", "abYc", "abXYc", 1},
+		{"abcdef", "af", "abcXdef", "afbcXdef", 1}, // the deletion of a ends with the f it inserts again
+		{"", "first", "second", "firstsecond", 1},
+	}
+	for _, tt := range tests {
+		got, conflicts := MergeTexts(tt.base, tt.a, tt.b)
+		if got != tt.want || conflicts != tt.conflicts {
+			t.Errorf("MergeTexts(%q, %q, %q) = %q, %d conflicts, want %q, %d", tt.base, tt.a, tt.b, got, conflicts, tt.want, tt.conflicts)
+		}
+	}
+}
+
+// writeLog returns the log of the edits applied one after the other, as the
+// application saves them
+func writeLog(t *testing.T, log string, edits ...string) string {
+	t.Helper()
+	text, err := replay(logLines(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, next := range edits {
+		for _, d := range ComputeDiffs(text, next) {
+			log += d.String() + "\n"
+		}
+		text = next
+	}
+	return log
+}
+
+func TestMergeLogs(t *testing.T) {
+	shared := writeLog(t, "", "the text", "the shared text")
+	a := writeLog(t, shared, "the shared text, edited", "The shared text, edited")
+	b := writeLog(t, shared, "the shared text and more")
+
+	merged, conflicts, err := MergeLogs(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(merged, a) {
+		t.Errorf("the merged log does not start with the first log")
+	}
+	text, err := replay(logLines(merged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "The shared text, edited and more"; text != want || conflicts != 1 {
+		t.Errorf("merged log gives %q with %d conflicts, want %q with 1", text, conflicts, want)
+	}
+
+	// the site at each end of the link merges the same logs
+	again, _, _ := MergeLogs(a, b)
+	if again != merged {
+		t.Errorf("merging the same logs twice gave different logs")
+	}
+	if same, conflicts, _ := MergeLogs(a, a); same != a || conflicts != 0 {
+		t.Errorf("merging a log with itself gave %q, %d conflicts", same, conflicts)
+	}
+	if _, _, err := MergeLogs(a, "not a diff\n"); err == nil {
+		t.Errorf("merging an invalid log did not fail")
+	}
+}
@@ -0,0 +1,108 @@
+package control
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+
+	"protocol"
+)
+
+// When the link between two partitions is up again, the sites at its ends
+// merge their documents: each one holds the critical section of its partition,
+// sends its log to the other, and gets it merged by its application with the
+// log received. Both applications give the same log, which each site releases
+// in its partition with the sites of both
+
+const mergeTextID = "merge" // id of the text asked to the application for a merge
+
+type mergeState struct {
+	peer      string // site at the other end of the link
+	own       bool   // the critical section is asked for the merge
+	inSection bool   // the critical section is held for the merge
+	sent      bool   // the log of this site was sent to the peer
+	requested bool   // the critical section was also asked for the application or a joining site
+}
+
+var (
+	merge      *mergeState                             // merge in progress, if any
+	nextMerges []string                                // peers of the other links between partitions, merged after it
+	peerStates = make(map[string]*protocol.MergeState) // logs received from the other partitions
+	merged     = make(map[string]bool)                 // merges whose log has been applied
+)
+
+// startMerge starts the merge with the partition of peer, or queues it after
+// the merge in progress, and returns the request to send if any
+func startMerge(peer string, tab StateMap, vectorialClock map[string]int) *protocol.RequestSc {
+	if merge != nil {
+		if peer != merge.peer && !slices.Contains(nextMerges, peer) {
+			nextMerges = append(nextMerges, peer)
+		}
+		return nil
+	}
+	merge = &mergeState{peer: peer}
+	if tab[*id].Type == protocol.MsgRequestSc {
+		return nil // asked for the application, the merge asks again after its release
+	}
+	merge.own = true
+	return requestSc(tab, vectorialClock)
+}
+
+// nextMerge starts the next merge queued with a site still in another partition
+func nextMerge(tab StateMap, vectorialClock map[string]int) *protocol.RequestSc {
+	for len(nextMerges) > 0 {
+		peer := nextMerges[0]
+		nextMerges = nextMerges[1:]
+		if _, known := tab[peer]; !known {
+			return startMerge(peer, tab, vectorialClock)
+		}
+	}
+	return nil
+}
+
+// mergeLogs returns the message asking the application to merge the logs,
+// once the log of this site was sent and the one of the peer received
+func mergeLogs() *protocol.MergeLogs {
+	state := peerStates[merge.peer]
+	if !merge.sent || state == nil {
+		return nil
+	}
+	return &protocol.MergeLogs{SiteID: merge.peer, Text: state.Text}
+}
+
+// mergeID identifies a merge by its sites and its log, so that the releases
+// of the merged log from both partitions are applied once
+func mergeID(a, b, log string) string {
+	if b < a {
+		a, b = b, a
+	}
+	h := fnv.New64a()
+	h.Write([]byte(log))
+	return fmt.Sprintf("%s|%s:%x", a, b, h.Sum64())
+}
+
+// rejoin adds the sites of another partition to the state map again
+func rejoin(tab StateMap, failedSites map[string]bool, sites []string) {
+	for _, site := range sites {
+		if site != *id {
+			AddSiteToStateMap(&tab, site)
+			delete(failedSites, site)
+		}
+	}
+}
+
+// raiseClock raises the clock of each site to the one in other
+func raiseClock(clock map[string]int, other map[string]int) {
+	for siteID, value := range other {
+		clock[siteID] = max(clock[siteID], value)
+	}
+}
+
+func siteList(tab StateMap) []string {
+	sites := make([]string, 0, len(tab))
+	for siteID := range tab {
+		sites = append(sites, siteID)
+	}
+	slices.Sort(sites)
+	return sites
+}
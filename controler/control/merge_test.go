@@ -0,0 +1,245 @@
+package control
+
+import (
+	"slices"
+	"testing"
+
+	"protocol"
+)
+
+// logs of the application, one diff per line
+const (
+	logA      = `{"NbDeleted":0,"NewText":"a"}`
+	logC      = `{"NbDeleted":0,"NewText":"c"}`
+	mergedLog = logA + "\n" + logC
+)
+
+// enterMergeSection gives the controler a link to peer of another partition,
+// and the receipts of the sites of its partition: it holds the critical
+// section for the merge and sends its log to peer
+func enterMergeSection(t *testing.T, c *testControler, peer string, sites []string, receipts ...string) {
+	t.Helper()
+	c.fromNetwork(&protocol.Merge{SiteID: peer})
+	if request := next[*protocol.RequestSc](t, c.toNetwork); request.SiteID != c.id {
+		t.Fatalf("request of %q for the merge", request.SiteID)
+	}
+	for _, siteID := range receipts {
+		c.fromNetwork(c.receipt(siteID))
+	}
+	if ask := next[*protocol.CurrentText](t, c.toApp); ask.SiteID != mergeTextID {
+		t.Fatalf("text asked for %q, want the log for the merge", ask.SiteID)
+	}
+	c.expectLog(t, "Entering critical section to merge the document with the partition of "+peer)
+	c.fromApp(&protocol.CurrentText{SiteID: mergeTextID, Text: logA})
+	state := next[*protocol.MergeState](t, c.toNetwork)
+	if state.SiteID != c.id || state.DestID != peer || state.Text != logA || !slices.Equal(state.KnownSites, sites) {
+		t.Fatalf("log of the partition sent as %+v", state)
+	}
+}
+
+// TestMergeAfterPartition merges the document with the one of a partition
+// whose link is up again: both logs are merged by the application, released
+// in the partition, and the sites of the other partition are known again
+func TestMergeAfterPartition(t *testing.T) {
+	c := startControler(t, "a", "b", "c")
+	c.fromNetwork(&protocol.Partition{SiteID: "b", Unreachable: []string{"c"}})
+	next[*protocol.Partition](t, c.toApp)
+	c.expectLog(t, "Network split, 1 sites out of reach (detected by b) : going on with 2 sites")
+	c.fromNetwork(&protocol.RequestSc{Clock: c.clock(map[string]int{"c": 1}), SiteID: "c"})
+	c.expectLog(t, "Ignoring message from failed site c")
+
+	enterMergeSection(t, c, "c", []string{"a", "b"}, "b")
+	c.fromNetwork(&protocol.MergeState{SiteID: "c", DestID: "a", Text: logC, KnownSites: []string{"c", "d"}, Released: map[string]int{"c": 2}})
+	if logs := next[*protocol.MergeLogs](t, c.toApp); logs.SiteID != "c" || logs.Text != logC {
+		t.Fatalf("logs to merge %+v", logs)
+	}
+	c.fromApp(&protocol.MergedLog{Text: mergedLog, Conflicts: 1})
+	release := next[*protocol.ReleaseSc](t, c.toNetwork)
+	if release.Text != mergedLog || release.Merge != mergeID("a", "c", mergedLog) || release.Conflicts != 1 {
+		t.Errorf("merged release %+v", release)
+	}
+	if !slices.Equal(release.Rejoined, []string{"a", "b", "c", "d"}) || release.Released["c"] != 2 || release.Released["a"] != release.VectorialClock["a"] {
+		t.Errorf("release rejoins %v with the releases %v", release.Rejoined, release.Released)
+	}
+	if replaced := next[*protocol.MergedLog](t, c.toApp); replaced.Text != mergedLog {
+		t.Errorf("log of the application replaced with %q", replaced.Text)
+	}
+	c.expectLog(t, "Document merged with the partition of c (1 conflicts), releasing critical section")
+
+	expectSection(t, c, "b", "c", "d")
+}
+
+// TestMergeInterruptedByPartition splits the partition again while a merge
+// waits for the critical section: the merge goes on with the sites left, and
+// the merge with the new partition is started after it
+func TestMergeInterruptedByPartition(t *testing.T) {
+	c := startControler(t, "a", "b", "c", "d")
+	c.fromNetwork(&protocol.Partition{SiteID: "a", Unreachable: []string{"c", "d"}})
+	next[*protocol.Partition](t, c.toApp)
+
+	c.fromNetwork(&protocol.Merge{SiteID: "c"})
+	next[*protocol.RequestSc](t, c.toNetwork)
+	quiet(t, c.toApp) // b holds the section up
+	c.fromNetwork(&protocol.Partition{SiteID: "a", Unreachable: []string{"b"}})
+	if ask := next[*protocol.CurrentText](t, c.toApp); ask.SiteID != mergeTextID {
+		t.Fatalf("text asked for %q, want the log for the merge", ask.SiteID)
+	}
+	next[*protocol.Partition](t, c.toApp)
+	c.expectLog(t, "Network split, 1 sites out of reach (detected by a) : going on with 1 sites")
+	c.fromApp(&protocol.CurrentText{SiteID: mergeTextID, Text: logA})
+	if state := next[*protocol.MergeState](t, c.toNetwork); !slices.Equal(state.KnownSites, []string{"a"}) {
+		t.Fatalf("partition sent as %v, b is out of reach", state.KnownSites)
+	}
+
+	// the link to b is up while the merge with c goes on: it is merged next
+	c.fromNetwork(&protocol.Merge{SiteID: "b"})
+	c.expectLog(t, "Link to b of another partition, merging the documents")
+	quiet(t, c.toNetwork)
+	c.fromNetwork(&protocol.MergeState{SiteID: "c", DestID: "a", Text: logC, KnownSites: []string{"c", "d"}})
+	next[*protocol.MergeLogs](t, c.toApp)
+	c.fromApp(&protocol.MergedLog{Text: mergedLog})
+	if release := next[*protocol.ReleaseSc](t, c.toNetwork); !slices.Equal(release.Rejoined, []string{"a", "c", "d"}) {
+		t.Errorf("release rejoins %v", release.Rejoined)
+	}
+	next[*protocol.MergedLog](t, c.toApp)
+	if request := next[*protocol.RequestSc](t, c.toNetwork); request.SiteID != "a" {
+		t.Errorf("request of %q for the next merge", request.SiteID)
+	}
+	c.fromNetwork(&protocol.RequestSc{Clock: c.clock(map[string]int{"b": 1}), SiteID: "b"})
+	c.expectLog(t, "Ignoring message from failed site b")
+
+	// the second merge waits for the sites rejoined
+	c.fromNetwork(c.receipt("c"))
+	quiet(t, c.toApp)
+	c.fromNetwork(c.receipt("d"))
+	if ask := next[*protocol.CurrentText](t, c.toApp); ask.SiteID != mergeTextID {
+		t.Fatalf("text asked for %q, want the log for the merge with b", ask.SiteID)
+	}
+	c.expectLog(t, "Entering critical section to merge the document with the partition of b")
+}
+
+// TestMergeThroughAnotherLink gives up a merge when the partition of the peer
+// has been merged by other sites in the meantime
+func TestMergeThroughAnotherLink(t *testing.T) {
+	c := startControler(t, "a", "b", "c")
+	c.fromNetwork(&protocol.Partition{SiteID: "a", Unreachable: []string{"c"}})
+	next[*protocol.Partition](t, c.toApp)
+	enterMergeSection(t, c, "c", []string{"a", "b"}, "b")
+
+	c.fromNetwork(&protocol.ReleaseSc{
+		Clock:    c.clock(map[string]int{"b": 1}),
+		SiteID:   "b",
+		Text:     mergedLog,
+		Merge:    mergeID("b", "c", mergedLog),
+		Rejoined: []string{"a", "b", "c"},
+	})
+	if replaced := next[*protocol.MergedLog](t, c.toApp); replaced.Text != mergedLog {
+		t.Errorf("log of the application replaced with %q", replaced.Text)
+	}
+	if release := next[*protocol.ReleaseSc](t, c.toNetwork); release.SiteID != "a" || release.Merge != "" || release.Text != "[]" {
+		t.Errorf("section of the merge released with %+v", release)
+	}
+	c.expectLog(t, "Partition of c merged through another link, giving up the merge")
+	// the merged release is only applied once
+	c.fromNetwork(&protocol.ReleaseSc{Clock: c.clock(map[string]int{"b": 1}), SiteID: "b", Text: mergedLog, Merge: mergeID("b", "c", mergedLog), Rejoined: []string{"a", "b", "c"}})
+	c.expectLog(t, "Ignoring release of b already applied")
+	quiet(t, c.toApp)
+
+	expectSection(t, c, "b", "c")
+}
+
+// TestMergeStateForAnotherSite passes over the log of a partition sent to
+// another site: like a receipt for another site, it leaves the clock of the
+// controler as it is
+func TestMergeStateForAnotherSite(t *testing.T) {
+	c := startControler(t, "a", "b")
+	c.fromApp(&protocol.AppRequest{})
+	request := next[*protocol.RequestSc](t, c.toNetwork)
+	c.fromNetwork(
+		&protocol.MergeState{SiteID: "c", DestID: "b", Text: logC, KnownSites: []string{"c"}},
+		&protocol.ReceiptSc{Clock: protocol.Clock{Stamp: request.Stamp, VectorialClock: map[string]int{}}, SiteID: "b", DestID: "a"},
+	)
+	next[*protocol.AppStartSc](t, c.toApp)
+	c.fromApp(&protocol.AppRelease{Text: "[]"})
+	// one tick for the receipt, one for the release
+	if release := next[*protocol.ReleaseSc](t, c.toNetwork); release.Stamp != request.Stamp+2 {
+		t.Errorf("release stamped %d after the request stamped %d, want %d", release.Stamp, request.Stamp, request.Stamp+2)
+	}
+}
+
+// resetMerges starts the test as site a, with no merge in progress
+func resetMerges(t *testing.T) StateMap {
+	saved := *id
+	*id = "a"
+	merge, nextMerges = nil, nil
+	peerStates = make(map[string]*protocol.MergeState)
+	t.Cleanup(func() {
+		*id = saved
+		merge, nextMerges = nil, nil
+		peerStates = make(map[string]*protocol.MergeState)
+	})
+	tab := CreateDefaultStateMap("a")
+	AddSiteToStateMap(&tab, "b")
+	return tab
+}
+
+func TestMergeID(t *testing.T) {
+	if mergeID("a", "c", "log") != mergeID("c", "a", "log") {
+		t.Error("both ends of the link do not give the same merge id")
+	}
+	if mergeID("a", "c", "log") == mergeID("a", "c", "other log") {
+		t.Error("merges of different logs share an id")
+	}
+}
+
+// TestMergeQueue starts a merge per link between partitions: a merge asked
+// during another one waits for it, and is dropped when the partition of its
+// peer was merged meanwhile
+func TestMergeQueue(t *testing.T) {
+	tab := resetMerges(t)
+	clock := map[string]int{"a": 1, "b": 0}
+
+	if request := startMerge("c", tab, clock); request == nil || merge.peer != "c" || !merge.own {
+		t.Fatalf("merge with c started as %+v", merge)
+	}
+	for _, peer := range []string{"c", "d", "e", "d"} {
+		if startMerge(peer, tab, clock) != nil {
+			t.Errorf("merge with %s started during the merge with c", peer)
+		}
+	}
+	if !slices.Equal(nextMerges, []string{"d", "e"}) {
+		t.Errorf("merges queued %v, want [d e]", nextMerges)
+	}
+
+	// the merge with c released the critical section, and the partition of d
+	// was merged with the one of c
+	merge = nil
+	tab["a"].Type = protocol.MsgReleaseSc
+	rejoin(tab, map[string]bool{"d": true}, []string{"a", "c", "d"})
+	if request := nextMerge(tab, clock); request == nil || merge.peer != "e" {
+		t.Errorf("next merge with %+v, want e", merge)
+	}
+	if len(nextMerges) != 0 {
+		t.Errorf("merges %v still queued", nextMerges)
+	}
+}
+
+// TestMergeDuringRequest starts a merge while the critical section is asked
+// for the application: no other request is sent
+func TestMergeDuringRequest(t *testing.T) {
+	tab := resetMerges(t)
+	clock := map[string]int{"a": 1, "b": 0}
+	requestSc(tab, clock)
+
+	if startMerge("c", tab, clock) != nil || merge.own {
+		t.Error("second request sent for the merge")
+	}
+	if mergeLogs() != nil {
+		t.Error("logs merged before the log of this site was sent")
+	}
+	merge.sent = true
+	peerStates["c"] = &protocol.MergeState{SiteID: "c", Text: "log of c"}
+	if logs := mergeLogs(); logs == nil || logs.SiteID != "c" || logs.Text != "log of c" {
+		t.Errorf("logs to merge %+v", logs)
+	}
+}
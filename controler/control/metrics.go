@@ -0,0 +1,82 @@
+package control
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"metrics"
+)
+
+// metrics of the site, served on -metrics
+var (
+	registry = metrics.NewRegistry()
+
+	messagesSent     = registry.NewCounter("dte_controler_messages_sent_total", "Messages sent by the controler to the application and the network, by type.", "type")
+	messagesReceived = registry.NewCounter("dte_controler_messages_received_total", "Messages received by the controler from the application and the network, by type.", "type")
+	sectionWait      = registry.NewHistogram("dte_controler_critical_section_wait_seconds", "Time from the request of the critical section to the entry in it.", nil)
+	stateMapSize     = registry.NewGauge("dte_controler_state_map_size", "Sites in the state map of the mutual exclusion, this site included.")
+	documentSize     = registry.NewGauge("dte_controler_document_length", "Length of the shared document in characters, as of the last release applied.")
+)
+
+var (
+	requestedAt    time.Time // request of the critical section waiting for the entry, zero when there is none
+	documentLength int       // characters of the document, counted from the diffs of the releases
+)
+
+// serveMetrics answers the scrapes on addr
+func serveMetrics(addr string) {
+	display_d("Serving the metrics on http://" + addr + "/metrics")
+	if err := registry.Serve(addr); err != nil {
+		display_e("Cannot serve the metrics: " + err.Error())
+	}
+}
+
+// sectionEntered records the wait for the critical section
+func sectionEntered() {
+	if !requestedAt.IsZero() {
+		sectionWait.Observe(time.Since(requestedAt).Seconds())
+		requestedAt = time.Time{}
+	}
+}
+
+// diff is the part of a change of the application which changes the length of the document
+type diff struct {
+	NbDeleted int
+	NewText   string
+}
+
+func (d diff) length() int {
+	return utf8.RuneCountInString(d.NewText) - d.NbDeleted
+}
+
+// releaseApplied updates the length of the document with the diffs of a release
+func releaseApplied(diffs string) {
+	var changes []diff
+	if err := json.Unmarshal([]byte(diffs), &changes); err != nil {
+		return // not a list of diffs: the length is left as it is
+	}
+	for _, d := range changes {
+		documentLength += d.length()
+	}
+	documentLength = max(documentLength, 0)
+}
+
+// logApplied sets the length of the document to the one of a whole log, one diff per line
+func logApplied(log string) {
+	documentLength = 0
+	for _, line := range strings.Split(log, "\n") {
+		var d diff
+		if json.Unmarshal([]byte(line), &d) == nil {
+			documentLength += d.length()
+		}
+	}
+	documentLength = max(documentLength, 0)
+}
+
+// updateGauges sets the gauges after each message
+func updateGauges(tab StateMap) {
+	stateMapSize.Set(float64(len(tab)))
+	documentSize.Set(float64(documentLength))
+}
@@ -0,0 +1,591 @@
+package control
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// flags of the controler, parsed by Run
+var flags = flag.NewFlagSet("controler", flag.ExitOnError)
+
+var (
+	// id *int = flag.Int("id", 0, "id of site")
+	id *string = flags.String("id", "0", "unique id of site (timestamp)") // get the timestamp id from site.sh
+	s  int     = 0
+)
+
+// var text string = ""
+
+var (
+	outputDir        *string = flags.String("o", "./output", "output directory")
+	localCutFilePath string
+)
+
+var (
+	framing   *string      = flags.String("framing", "line", "framing of the messages exchanged with the application and the network (line or len)")
+	appInput  *string      = flags.String("app-in", "", "read the messages of the application from this file instead of stdin")
+	socketDir *string      = flags.String("socket", "", "directory of the Unix sockets of the site: connect to those of the application and the network instead of using stdin and stdout")
+	stdout    *wire.Writer // messages to the network, and to the application when toApp is nil
+	toApp     *wire.Writer // messages to the application, when it has its own link
+)
+
+// how long the controler waits for the application and the network to create their sockets
+const socketWait = 10 * time.Second
+
+var metricsAddr *string = flags.String("metrics", "", "address of the HTTP endpoint serving the metrics of the site in the Prometheus text format, e.g. 127.0.0.1:9101 (disabled when empty)")
+
+type CutJsonValue struct {
+	VectorialClock map[string]int `json:"vectorialClock"`
+	TextContent    string         `json:"textContent"`
+}
+
+// var nextCutJsonContent map[string]map[string]string
+var nextCutJsonContent = make(map[string]map[string]string)
+var nbcut string
+
+// resetState clears the state kept between the messages, before a controler
+// runs
+func resetState() {
+	s = 0
+	merge, nextMerges = nil, nil
+	peerStates = make(map[string]*protocol.MergeState)
+	merged = make(map[string]bool)
+	nextCutJsonContent = make(map[string]map[string]string)
+	requestedAt = time.Time{}
+}
+
+// Run runs the controler of a site with the flags in args: it reads the
+// messages of the network on in, those of the application on app (on in too
+// when app is nil, unless -app-in is given), and writes the messages of the
+// network to out and those of the application to appOut (to out too when
+// appOut is nil, read by both). With -socket, the links to the application
+// and the network are opened on their sockets instead. Run returns when the
+// network closes its link, the process exits with the site
+func Run(args []string, in, app io.Reader, out, appOut io.Writer) {
+	flags.Parse(args)
+	resetState()
+	pipeFraming, err := wire.ParseFraming(*framing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *socketDir != "" {
+		network, err := wire.DialSocket(wire.SocketPath(*socketDir, *id, wire.NetworkSocket), socketWait)
+		if err != nil {
+			log.Fatal(err)
+		}
+		application, err := wire.DialSocket(wire.SocketPath(*socketDir, *id, wire.AppSocket), socketWait)
+		if err != nil {
+			log.Fatal(err)
+		}
+		in, out, app, appOut = network, network, application, application
+	}
+	stdin := wire.NewReader(in) // messages from the network (and the application without -app-in)
+	stdin.SetFraming(pipeFraming)
+	stdout = wire.NewWriter(out)
+	stdout.SetFraming(pipeFraming)
+	if appOut != nil {
+		toApp = wire.NewWriter(appOut)
+		toApp.SetFraming(pipeFraming)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	localCutFilePath = fmt.Sprintf("%s/%s_cut.json", *outputDir, *id)
+	var sndmsg protocol.Message                              // message to be sent
+	var rcvmsg string                                        // received message
+	var stamprcv int                                         // received stamp
+	var vectorialClock map[string]int = make(map[string]int) // vectorial clock initialized to 0
+	vectorialClock[*id] = 0
+	var currentAction int = 0              // action counter
+	var idToAddNetworkNextRelease []string // id of the site to add to the next release message
+	var applicationClosed bool = false     // flag to indicate if the application is closed
+
+	var failedSites = make(map[string]bool) // sites removed from the network after a failure
+	var released = make(map[string]int)     // clock of the last release applied from each site
+	var releaseLog []*protocol.ReleaseSc    // last releases of this site, sent again to the sites which missed them
+
+	tab := CreateDefaultStateMap(*id) //not a table but a StateMap : make(map[string]*StateObject)
+	// tabinit := CreateTabInit()
+	// every input has its own writer, so that frames of the application and
+	// of the network cannot be interleaved
+	inputs := make(chan string)
+	networkClosed := make(chan struct{})
+	go func() {
+		readInput("stdin", stdin, inputs)
+		close(networkClosed)
+	}()
+	if app != nil {
+		appReader := wire.NewReader(app)
+		appReader.SetFraming(pipeFraming)
+		go readInput("application", appReader, inputs)
+	} else if *appInput != "" {
+		go func() {
+			f, err := os.Open(*appInput) // blocks until the application opens its output
+			if err != nil {
+				log.Fatal(err)
+			}
+			appReader := wire.NewReader(f)
+			appReader.SetFraming(pipeFraming)
+			readInput(*appInput, appReader, inputs)
+		}()
+	}
+
+	for {
+		updateGauges(tab)
+
+		select {
+		case rcvmsg = <-inputs:
+		case <-networkClosed:
+			display_w("The network closed its link, exiting")
+			return
+		}
+
+		msg, err := protocol.Decode(rcvmsg, protocol.AppToControler, protocol.NetworkToControler)
+		if err != nil {
+			display_e("Rejected message " + rcvmsg + " : " + err.Error())
+			continue
+		}
+		messagesReceived.Inc(msg.Type())
+
+		// messages still in flight from a failed site are dropped
+		if sender := senderOf(msg); failedSites[sender] {
+			display_w("Ignoring message from failed site " + sender)
+			continue
+		}
+
+		// releases sent again after a resync are only applied by the sites which missed them
+		if release, ok := msg.(*protocol.ReleaseSc); ok && release.SiteID != *id {
+			if release.VectorialClock[release.SiteID] <= released[release.SiteID] {
+				display_d("Ignoring release of " + release.SiteID + " already applied")
+				continue
+			}
+			released[release.SiteID] = release.VectorialClock[release.SiteID]
+		}
+
+		// if there is no "stp" in the message, stamprcv is 0 so new s will be stamp+1
+		// if there is "stp" in the message, s will be max(s, stamprcv) + 1
+		clockrcv, _ := protocol.ClockOf(msg)
+		stamprcv = clockrcv.Stamp
+
+		s_destid := ""
+		if addressed, ok := msg.(protocol.Addressed); ok {
+			s_destid = addressed.Destination()
+		}
+
+		// if the message is a Receipt and is not for this site, ignore it
+		if s_destid == "" || s_destid == *id { //TODO Les messages qui ne sont pas destiné incrémente pas l'horloge
+
+			// update the stamp of the site
+			s = resetStamp(s, stamprcv)
+
+			// update the vectorial clock if the message is not from the application
+			if clockrcv.VectorialClock != nil {
+				vectorialClock = updateVectorialClock(vectorialClock, clockrcv.VectorialClock, *id)
+				for site := range failedSites {
+					delete(vectorialClock, site)
+				}
+			}
+		}
+
+		sndmsg = nil
+
+		// each message type will be processed differently
+		switch rcvmsg := msg.(type) {
+		case *protocol.KnownSites:
+			for _, site := range rcvmsg.KnownSites {
+				AddSiteToStateMap(&tab, site)
+			}
+			display_d(fmt.Sprintf("Known sites updated, %d sites in the state map", len(tab)))
+
+		case *protocol.SiteFailed:
+			// This message is sent by the network when a site stopped answering
+			if _, exists := tab[rcvmsg.FailedID]; exists && rcvmsg.FailedID != *id {
+				display_w("Site " + rcvmsg.FailedID + " has failed (detected by " + rcvmsg.SiteID + "), removing it from the state map")
+				failedSites[rcvmsg.FailedID] = true
+				delete(tab, rcvmsg.FailedID)
+				delete(vectorialClock, rcvmsg.FailedID)
+				verifyScApproval(tab, *id) // the failed site may have been the one we were waiting for
+			}
+
+		case *protocol.Partition:
+			// This message is sent by the network when sites are out of reach : the
+			// sites of this partition go on editing the document without them
+			for _, site := range rcvmsg.Unreachable {
+				if _, exists := tab[site]; exists && site != *id {
+					failedSites[site] = true
+					delete(tab, site)
+					delete(vectorialClock, site)
+				}
+			}
+			display_w(fmt.Sprintf("Network split, %d sites out of reach (detected by %s) : going on with %d sites", len(rcvmsg.Unreachable), rcvmsg.SiteID, len(tab)))
+			verifyScApproval(tab, *id)
+			sndmsg = rcvmsg // the application tells the user
+
+		case *protocol.Merge:
+			// This message is sent by the network when a link to a site of another partition is up
+			display_w("Link to " + rcvmsg.SiteID + " of another partition, merging the documents")
+			if request := startMerge(rcvmsg.SiteID, tab, vectorialClock); request != nil {
+				sndmsg = request
+			}
+
+		case *protocol.MergeState:
+			if rcvmsg.DestID == *id {
+				display_d("Log of the partition of " + rcvmsg.SiteID + " received")
+				peerStates[rcvmsg.SiteID] = rcvmsg
+				if merge != nil && merge.peer == rcvmsg.SiteID {
+					if logs := mergeLogs(); logs != nil {
+						sndmsg = logs
+					}
+				}
+			}
+
+		case *protocol.MergedLog:
+			// This message is sent by the application with the logs of both partitions merged
+			if merge == nil || !merge.inSection || peerStates[merge.peer] == nil {
+				display_e("Merged log received while no merge is in progress")
+				break
+			}
+			state := peerStates[merge.peer]
+			delete(peerStates, merge.peer)
+			rejoined := siteList(tab)
+			for _, site := range state.KnownSites {
+				if !slices.Contains(rejoined, site) {
+					rejoined = append(rejoined, site)
+				}
+			}
+			rejoin(tab, failedSites, state.KnownSites)
+			raiseClock(released, state.Released)
+			logApplied(rcvmsg.Text)
+
+			tab[*id].Type = protocol.MsgReleaseSc
+			tab[*id].Clock = s
+			vectorialClock[*id]++
+			released[*id] = vectorialClock[*id]
+			release := &protocol.ReleaseSc{
+				Clock:     currentClock(vectorialClock),
+				Text:      rcvmsg.Text,
+				SiteID:    *id,
+				Merge:     mergeID(*id, merge.peer, rcvmsg.Text),
+				Conflicts: rcvmsg.Conflicts,
+				Rejoined:  rejoined,
+				Released:  copyClock(released),
+			}
+			merged[release.Merge] = true
+			releaseLog = logRelease(releaseLog, release)
+			writeMessage(release)
+			writeMessage(&protocol.MergedLog{Text: rcvmsg.Text, Conflicts: rcvmsg.Conflicts}) // the application replaces its log
+			display_w(fmt.Sprintf("Document merged with the partition of %s (%d conflicts), releasing critical section", merge.peer, rcvmsg.Conflicts))
+
+			requested := merge.requested || len(idToAddNetworkNextRelease) > 0 || applicationClosed
+			merge = nil
+			if requested {
+				sndmsg = requestSc(tab, vectorialClock)
+			}
+			if request := nextMerge(tab, vectorialClock); request != nil {
+				sndmsg = request
+			}
+
+		case *protocol.LinkRestored:
+			// This message is sent by the network when a lost link is back: messages may have been missed
+			display_w("Link to " + rcvmsg.SiteID + " restored, asking for the releases missed in between")
+			sndmsg = &protocol.Resync{SiteID: *id, Released: copyClock(released)}
+
+		case *protocol.Resync:
+			if rcvmsg.SiteID != *id {
+				missed := missedReleases(releaseLog, rcvmsg.Released)
+				for _, release := range missed {
+					writeMessage(release)
+				}
+				display_d(fmt.Sprintf("Resync asked by %s, sending %d releases again", rcvmsg.SiteID, len(missed)))
+				if tab[*id].Type == protocol.MsgRequestSc { // the request may have been lost too
+					sndmsg = pendingRequest(tab, vectorialClock)
+				}
+			}
+
+		case *protocol.SharedText:
+			sndmsg = &protocol.CurrentText{SiteID: rcvmsg.SiteID}
+
+			display_d("Getting text from application")
+
+		case *protocol.CurrentText:
+			// This message is received from the application
+			if rcvmsg.SiteID == mergeTextID { // log of this partition, for the site at the other end of the link
+				if merge != nil && merge.inSection {
+					display_d("Sending the log of the partition to " + merge.peer)
+					writeMessage(&protocol.MergeState{
+						SiteID:     *id,
+						DestID:     merge.peer,
+						Text:       rcvmsg.Text,
+						Released:   copyClock(released),
+						KnownSites: siteList(tab),
+					})
+					merge.sent = true
+					if logs := mergeLogs(); logs != nil {
+						sndmsg = logs
+					}
+				}
+			} else if rcvmsg.SiteID == "-1" { // if idrcv is -1, it means that we need to share the return text to multiple sites : it is due to release of critical section
+				if len(idToAddNetworkNextRelease) > 0 { // if there are sites to add to the next release message
+					display_d("Returning text to network for one or more sites due to access to critical section")
+					sndmsg = &protocol.SharedText{
+						SitesToAdd: append([]string(nil), idToAddNetworkNextRelease...),
+						Text:       rcvmsg.Text,
+						Released:   copyClock(released),
+					}
+				}
+			} else { // if idrcv is not -1, it means that the site wanting to join network is already known
+				display_d("Returning text to network for a single site")
+				sndmsg = &protocol.SharedText{
+					SitesToAdd: []string{rcvmsg.SiteID},
+					Text:       rcvmsg.Text,
+					Released:   copyClock(released),
+				}
+			}
+
+		case *protocol.AddSite:
+			display_d("Add site to critical section message received : site will be added to the next release message")
+			idToAddNetworkNextRelease = append(idToAddNetworkNextRelease, rcvmsg.SiteID)
+			if tab[*id].Type != protocol.MsgRequestSc {
+				sndmsg = requestSc(tab, vectorialClock)
+				display_d("Requesting critical section (to at least add site to network)")
+			} else if merge != nil && merge.own {
+				merge.requested = true // asked again after the merge
+			}
+
+		// This message is sent by the site to request access to the critical section
+		// so that other sites cannot access it
+		case *protocol.AppRequest:
+			display_d("Request message received from application")
+			if tab[*id].Type != protocol.MsgRequestSc {
+				sndmsg = requestSc(tab, vectorialClock)
+				display_d("Requesting critical section (to at least send modification in shared text)")
+			} else if merge != nil && merge.own {
+				merge.requested = true // asked again after the merge
+			}
+
+		// This message is sent by the site to ask the release of the critical section
+		// so that other sites can access it again
+		case *protocol.AppRelease:
+			tab[*id].Type = protocol.MsgReleaseSc
+			tab[*id].Clock = s
+			display_d("Release message received from application")
+
+			vectorialClock[*id]++ // every release has its own clock, to be recognized when it is sent again
+			release := &protocol.ReleaseSc{
+				Clock:      currentClock(vectorialClock),
+				Text:       rcvmsg.Text,
+				SiteID:     *id,
+				SitesToAdd: append([]string(nil), idToAddNetworkNextRelease...),
+				Close:      applicationClosed,
+			}
+			released[*id] = vectorialClock[*id]
+			releaseApplied(rcvmsg.Text)
+			if !release.Close {
+				releaseLog = logRelease(releaseLog, release)
+			}
+			sndmsg = release
+
+			display_d("Releasing critical section")
+			idToAddNetworkNextRelease = idToAddNetworkNextRelease[:0] // reset the list after use
+			if merge != nil && !merge.own {                           // the merge waited for this release
+				writeMessage(sndmsg)
+				merge.own = true
+				sndmsg = requestSc(tab, vectorialClock)
+			}
+
+		// This message is sent by another controller to announce that the critical section is temporarily locked
+		case *protocol.RequestSc:
+
+			if rcvmsg.SiteID != *id {
+				tab[rcvmsg.SiteID].Type = protocol.MsgRequestSc
+				tab[rcvmsg.SiteID].Clock = stamprcv
+				display_d("Request message received")
+
+				// send receipt to the sender by the successor (ring topology)
+				sndmsg = &protocol.ReceiptSc{
+					Clock:  currentClock(vectorialClock),
+					SiteID: *id,
+					DestID: rcvmsg.SiteID,
+				}
+				display_d("Sending receipt")
+
+			}
+			verifyScApproval(tab, *id) // outside the if to work when the site is alone in the network
+
+		// This message is sent by another controller to announce that the critical section has been released
+		case *protocol.ReleaseSc:
+
+			if rcvmsg.SiteID != *id {
+				tab[rcvmsg.SiteID].Type = protocol.MsgReleaseSc
+				tab[rcvmsg.SiteID].Clock = stamprcv
+				display_d("Release message received")
+
+				if rcvmsg.Close {
+					display_d("Application with id " + rcvmsg.SiteID + " has been closed, need to remove it from the state map")
+					delete(tab, rcvmsg.SiteID) // remove the site from the state map
+				}
+
+				if rcvmsg.Merge != "" { // the log merged from two partitions
+					rejoin(tab, failedSites, rcvmsg.Rejoined)
+					raiseClock(released, rcvmsg.Released)
+					if !merged[rcvmsg.Merge] {
+						merged[rcvmsg.Merge] = true
+						logApplied(rcvmsg.Text)
+						display_w(fmt.Sprintf("Document merged by %s with another partition (%d conflicts)", rcvmsg.SiteID, rcvmsg.Conflicts))
+						sndmsg = &protocol.MergedLog{Text: rcvmsg.Text, Conflicts: rcvmsg.Conflicts}
+					}
+					if merge != nil && slices.Contains(rcvmsg.Rejoined, merge.peer) {
+						display_w("Partition of " + merge.peer + " merged through another link, giving up the merge")
+						if merge.inSection {
+							tab[*id].Type = protocol.MsgReleaseSc
+							tab[*id].Clock = s
+							vectorialClock[*id]++
+							released[*id] = vectorialClock[*id]
+							writeMessage(&protocol.ReleaseSc{Clock: currentClock(vectorialClock), Text: "[]", SiteID: *id})
+						}
+						merge = nil
+					}
+					if tab[*id].Type == protocol.MsgRequestSc && (merge == nil || !merge.inSection) {
+						writeMessage(pendingRequest(tab, vectorialClock)) // the sites of the other partition never got it
+					}
+				} else {
+					// send the updated message to the application
+					sndmsg = &protocol.AppUpdate{Text: rcvmsg.Text}
+					releaseApplied(rcvmsg.Text)
+					display_d("Sending update message to application")
+				}
+
+				verifyScApproval(tab, *id)
+			} else if applicationClosed { // if the app is closed and the message is from itself
+				// it means that the application has been closed and all sites have been notified
+				// so we can exit the application
+				if rcvmsg.Close {
+					display_w("Application has been closed and all sites have been notified, informing app and exiting")
+					writeMessage(&protocol.AppDied{})
+					time.Sleep(1 * time.Second) // wait for the application to process the message
+					os.Exit(0)
+				}
+			}
+
+		// This message is sent by another controller to give a receipt after receiving a previous message
+		case *protocol.ReceiptSc:
+			if rcvmsg.SiteID != *id {
+				if rcvmsg.DestID == *id {
+					if tab[rcvmsg.SiteID].Type != protocol.MsgRequestSc {
+						tab[rcvmsg.SiteID].Type = protocol.MsgReceiptSc
+						tab[rcvmsg.SiteID].Clock = stamprcv
+					}
+					display_d("Receipt received")
+
+					verifyScApproval(tab, *id)
+				}
+			}
+
+		case *protocol.Initialization:
+			// This message is sent by the network to initialize the site
+			if len(rcvmsg.KnownSites) > 0 { // if the site enter in a network
+				display_d("Controller initialization message received as a secondary site")
+				for _, site := range rcvmsg.KnownSites {
+					AddSiteToStateMap(&tab, site)
+				}
+				for site, clock := range rcvmsg.Released { // releases already in the text
+					released[site] = clock
+				}
+				logApplied(rcvmsg.Text)
+
+				sndmsg = &protocol.InitialText{
+					SiteID: rcvmsg.SiteID,
+					Text:   rcvmsg.Text,
+					Invite: rcvmsg.Invite,
+				}
+			} else { // if the site is the first one to enter in the network : primary site
+				display_d("Controller initialization message received as a primary site")
+				sndmsg = &protocol.InitialText{SiteID: rcvmsg.SiteID, Invite: rcvmsg.Invite}
+			}
+		case *protocol.AppDied:
+			applicationClosed = true
+			// Handle application termination
+			display_w("Application has been closed, need to inform the network when critical section access is obtained")
+			if tab[*id].Type != protocol.MsgRequestSc {
+				sndmsg = requestSc(tab, vectorialClock)
+				display_d("Requesting critical section (to at least quit the application)")
+			} else if merge != nil && merge.own {
+				merge.requested = true // asked again after the merge
+			}
+
+		// This message is sent by the site to request a cut
+		// It is then propagated to other controllers
+		case *protocol.AppCut: // add to wave expedition
+
+			siteActionNumber := fmt.Sprintf("site_%s_action_%d", *id, currentAction+1)
+
+			nbcut, _ = GetNextCutNumber(localCutFilePath)
+			finalJsonData, _ := FormatJsonCutData(vectorialClock, rcvmsg.Text)
+
+			if _, ok := nextCutJsonContent[nbcut]; !ok {
+				nextCutJsonContent[nbcut] = make(map[string]string)
+			}
+			nextCutJsonContent[nbcut][siteActionNumber] = finalJsonData
+			sndmsg = &protocol.CutRequest{
+				SiteID:       *id,
+				CutInitiator: *id,
+			}
+			display_d("Cut message received, START WAVE!")
+
+		case *protocol.CutRequest:
+			// ask the text content to the application
+			if *id != rcvmsg.CutInitiator {
+				sndmsg = &protocol.CutContentRequest{CutInitiator: rcvmsg.CutInitiator}
+			}
+
+		case *protocol.CutContentResponse:
+			// receive the text content from the application
+			siteActionNumber := fmt.Sprintf("site_%s_action_%d", *id, currentAction+1)
+			formatJsonTextContent, _ := FormatJsonCutData(vectorialClock, rcvmsg.Text)
+
+			sndmsg = &protocol.CutReceipt{
+				SiteID:      *id,
+				KeyCut:      siteActionNumber,
+				JsonCutData: formatJsonTextContent,
+				DestID:      rcvmsg.CutInitiator, // send the response to the wave initiator
+			}
+
+		case *protocol.CutReceipt:
+			if rcvmsg.DestID == *id && rcvmsg.SiteID != *id { // if the message is for this site and not from itself
+
+				// received a response from the wave
+				if _, ok := nextCutJsonContent[nbcut]; !ok {
+					nextCutJsonContent[nbcut] = make(map[string]string)
+				}
+
+				nextCutJsonContent[nbcut][rcvmsg.KeyCut] = rcvmsg.JsonCutData
+				count := len(nextCutJsonContent[nbcut]) // count the number of sites that have responded to the wave
+				if count == len(tab) {                  // if all sites have responded to the wave
+					display_d("All sites have responded to the wave, saving cut data !!")
+					// convert json data into string
+					stringData, err := json.Marshal(nextCutJsonContent[nbcut])
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					nbcut, _ := GetNextCutNumber(localCutFilePath)
+					saveCutJson(nbcut, localCutFilePath, string(stringData)) // save the cut json data to the file
+				}
+			}
+		}
+		// send message to successor
+		if sndmsg != nil {
+			currentAction++
+			writeMessage(sndmsg)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// testControler runs the controler of a site over pipes in memory: the test
+// plays its network and its application. The controlers share the state of
+// the package, so the tests do not run in parallel
+type testControler struct {
+	id               string
+	stamp            int                   // of the last message of another controler
+	network, app     *wire.Writer          // messages read by the controler
+	toNetwork, toApp chan protocol.Message // messages written by the controler
+	logs             *logBuffer
+}
+
+// logBuffer holds what the controler displays
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startControler runs the controler of siteID, which knows the sites known
+func startControler(t *testing.T, siteID string, known ...string) *testControler {
+	fromNetwork, fromApp := wire.NewPipe(1024), wire.NewPipe(1024)
+	toNetwork, toApp := wire.NewPipe(1024), wire.NewPipe(1024)
+	c := &testControler{
+		id:        siteID,
+		network:   wire.NewWriter(fromNetwork),
+		app:       wire.NewWriter(fromApp),
+		toNetwork: decodeAll(toNetwork, protocol.ControlerToNetwork),
+		toApp:     decodeAll(toApp, protocol.ControlerToApp),
+		logs:      &logBuffer{},
+	}
+	saved := stderr
+	stderr = log.New(c.logs, "", 0)
+	done := make(chan struct{})
+	go func() {
+		Run([]string{"-id", siteID, "-o", t.TempDir()}, fromNetwork, fromApp, toNetwork, toApp)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		fromApp.Close()
+		c.expectLog(t, "Error reading message from application") // its reader is done
+		fromNetwork.Close()                                      // the controler stops with its network
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("controler still running after its network closed the link")
+		}
+		toNetwork.Close()
+		toApp.Close()
+		stderr = saved
+		if t.Failed() {
+			t.Log("controler logs:\n" + c.logs.String())
+		}
+	})
+	if len(known) > 0 {
+		c.fromNetwork(&protocol.KnownSites{KnownSites: append([]string{siteID}, known...), SiteID: siteID})
+		c.expectLog(t, fmt.Sprintf("%d sites in the state map", len(known)+1))
+	}
+	return c
+}
+
+// decodeAll passes the messages written on p to the returned channel
+func decodeAll(p *wire.Pipe, link protocol.Link) chan protocol.Message {
+	messages := make(chan protocol.Message, 1024)
+	go func() {
+		r := wire.NewReader(p)
+		for {
+			line, err := r.ReadFrame()
+			if err != nil {
+				return
+			}
+			if msg, err := protocol.Decode(line, link); err == nil {
+				messages <- msg
+			}
+		}
+	}()
+	return messages
+}
+
+func (c *testControler) fromNetwork(msgs ...protocol.Message) {
+	for _, msg := range msgs {
+		c.network.WriteFrame(protocol.Marshal(msg))
+	}
+}
+
+func (c *testControler) fromApp(msgs ...protocol.Message) {
+	for _, msg := range msgs {
+		c.app.WriteFrame(protocol.Marshal(msg))
+	}
+}
+
+// next returns the next message written by the controler on messages, which
+// must be a T
+func next[T protocol.Message](t *testing.T, messages <-chan protocol.Message) T {
+	t.Helper()
+	var want T
+	select {
+	case msg := <-messages:
+		got, ok := msg.(T)
+		if !ok {
+			t.Fatalf("controler wrote %T %+v, want %T", msg, msg, want)
+		}
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controler wrote no %T", want)
+	}
+	return want
+}
+
+// quiet checks that the controler writes nothing more on messages
+func quiet(t *testing.T, messages <-chan protocol.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("controler wrote %T %+v", msg, msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// expectLog waits until the controler displays a line containing what
+func (c *testControler) expectLog(t *testing.T, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(c.logs.String(), what); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("controler never displayed %q", what)
+		}
+	}
+}
+
+// clock returns the clock of the next message of another controler, later
+// than the messages of this one
+func (c *testControler) clock(vc map[string]int) protocol.Clock {
+	if vc == nil {
+		vc = map[string]int{}
+	}
+	c.stamp += 1000
+	return protocol.Clock{Stamp: c.stamp, VectorialClock: vc}
+}
+
+// receipt is the receipt of siteID for the request of the controler
+func (c *testControler) receipt(siteID string) *protocol.ReceiptSc {
+	return &protocol.ReceiptSc{Clock: c.clock(nil), SiteID: siteID, DestID: c.id}
+}
+
+// expectSection checks that the sites of the state map are exactly the ones
+// whose receipts the controler waits for before entering the section again
+func expectSection(t *testing.T, c *testControler, sites ...string) {
+	t.Helper()
+	c.fromApp(&protocol.AppRequest{})
+	next[*protocol.RequestSc](t, c.toNetwork)
+	for _, siteID := range sites {
+		quiet(t, c.toApp)
+		c.fromNetwork(c.receipt(siteID))
+	}
+	next[*protocol.AppStartSc](t, c.toApp)
+}
+
+// TestCriticalSection asks the section for the application: it is entered once
+// every other site acknowledged the request, and its release is sent on
+func TestCriticalSection(t *testing.T) {
+	c := startControler(t, "a", "b", "c")
+	c.fromApp(&protocol.AppRequest{})
+	if request := next[*protocol.RequestSc](t, c.toNetwork); request.SiteID != "a" {
+		t.Fatalf("request of %q", request.SiteID)
+	}
+	c.fromNetwork(c.receipt("b"))
+	quiet(t, c.toApp)
+	c.fromNetwork(c.receipt("c"))
+	next[*protocol.AppStartSc](t, c.toApp)
+
+	c.fromApp(&protocol.AppRelease{Text: `[{"NbDeleted":0,"NewText":"x"}]`})
+	if release := next[*protocol.ReleaseSc](t, c.toNetwork); release.SiteID != "a" || release.Text != `[{"NbDeleted":0,"NewText":"x"}]` {
+		t.Errorf("release %+v", release)
+	}
+	c.expectLog(t, "Releasing critical section")
+}
+
+// TestSiteFailed removes a failed site while the controler waits for its
+// receipt: the section is entered without it, and its late messages are
+// dropped
+func TestSiteFailed(t *testing.T) {
+	c := startControler(t, "a", "b", "c")
+	c.fromApp(&protocol.AppRequest{})
+	next[*protocol.RequestSc](t, c.toNetwork)
+	c.fromNetwork(c.receipt("b"))
+	quiet(t, c.toApp)
+
+	c.fromNetwork(&protocol.SiteFailed{SiteID: "b", FailedID: "c"})
+	next[*protocol.AppStartSc](t, c.toApp)
+	c.expectLog(t, "Site c has failed (detected by b), removing it from the state map")
+	c.fromNetwork(c.receipt("c"))
+	c.expectLog(t, "Ignoring message from failed site c")
+	c.fromApp(&protocol.AppRelease{Text: "[]"})
+	next[*protocol.ReleaseSc](t, c.toNetwork)
+
+	expectSection(t, c, "b")
+}
+
+// TestResync plays the two ends of a link restored after a cut during a
+// critical section: the controler asks for the releases it missed, sends again
+// the ones the other side missed, and applies each release once
+func TestResync(t *testing.T) {
+	c := startControler(t, "a", "b", "c")
+	expectSection(t, c, "b", "c")
+	c.fromApp(&protocol.AppRelease{Text: logA})
+	own := next[*protocol.ReleaseSc](t, c.toNetwork)
+	other := &protocol.ReleaseSc{Clock: c.clock(map[string]int{"b": 1}), SiteID: "b", Text: logC}
+	c.fromNetwork(other)
+	if update := next[*protocol.AppUpdate](t, c.toApp); update.Text != logC {
+		t.Fatalf("update %q", update.Text)
+	}
+
+	c.fromNetwork(&protocol.LinkRestored{SiteID: "c"})
+	c.expectLog(t, "Link to c restored, asking for the releases missed in between")
+	if resync := next[*protocol.Resync](t, c.toNetwork); resync.SiteID != "a" || resync.Released["a"] != own.VectorialClock["a"] || resync.Released["b"] != 1 {
+		t.Errorf("resync %+v", resync)
+	}
+
+	// c missed the release of this site
+	c.fromNetwork(&protocol.Resync{SiteID: "c", Released: map[string]int{"b": 1}})
+	if again := next[*protocol.ReleaseSc](t, c.toNetwork); again.Text != own.Text || again.VectorialClock["a"] != own.VectorialClock["a"] {
+		t.Errorf("release sent again as %+v, want %+v", again, own)
+	}
+	c.expectLog(t, "Resync asked by c, sending 1 releases again")
+	// b did not miss it
+	c.fromNetwork(&protocol.Resync{SiteID: "b", Released: map[string]int{"a": own.VectorialClock["a"]}})
+	c.expectLog(t, "Resync asked by b, sending 0 releases again")
+	quiet(t, c.toNetwork)
+
+	// the release of b sent again for another site is not applied twice
+	c.fromNetwork(&protocol.ReleaseSc{Clock: c.clock(map[string]int{"b": 1}), SiteID: "b", Text: logC})
+	c.expectLog(t, "Ignoring release of b already applied")
+	quiet(t, c.toApp)
+
+	// a request waiting for the section may have been lost too
+	c.fromApp(&protocol.AppRequest{})
+	request := next[*protocol.RequestSc](t, c.toNetwork)
+	c.fromNetwork(&protocol.Resync{SiteID: "c", Released: map[string]int{"a": own.VectorialClock["a"]}})
+	if again := next[*protocol.RequestSc](t, c.toNetwork); again.Stamp != request.Stamp {
+		t.Errorf("request sent again with the stamp %d, want %d", again.Stamp, request.Stamp)
+	}
+}
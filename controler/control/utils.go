@@ -1,7 +1,8 @@
-package main
+package control
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,11 +10,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-)
+	"time"
 
-var (
-	fieldsep  = "~"
-	keyvalsep = "`"
+	"protocol"
+	"wire"
 )
 
 type CompareElement struct {
@@ -28,48 +28,111 @@ type StateObject struct {
 
 type StateMap map[string]*StateObject
 
-// msg_format constructs a key-value string using predefined separators
-func msg_format(key string, val string) string {
-	return fieldsep + keyvalsep + key + keyvalsep + val
+// writeMessage sends a message to the application or the network, according
+// to the link it is registered for (stdout is shared by both without toApp)
+func writeMessage(m protocol.Message) {
+	out := stdout
+	if toApp != nil && protocol.Registered(m.Type(), protocol.ControlerToApp) {
+		out = toApp
+	}
+	if err := out.WriteFrame(protocol.Marshal(m)); err != nil {
+		display_e("Error sending message : " + err.Error())
+		return
+	}
+	messagesSent.Inc(m.Type())
 }
 
-// resetStamp returns the next logical timestamp, ensuring monotonicity
-func resetStamp(stamp, stamprcv int) int {
-	if stamp < stamprcv {
-		return stamprcv + 1
+// readInput passes every message read from r to inputs until r is closed
+func readInput(name string, r *wire.Reader, inputs chan<- string) {
+	for {
+		line, err := r.ReadFrame()
+		if errors.Is(err, wire.ErrFrameTooLarge) {
+			display_e("Dropped message from " + name + " : " + err.Error())
+			continue
+		} else if err != nil {
+			display_e("Error reading message from " + name + " : " + err.Error())
+			return
+		}
+		inputs <- line
 	}
-	return stamp + 1
 }
 
-// findval searches a formatted message for a given key and returns its value
-func findval(msg string, key string, verbose bool) string {
-	if len(msg) < 4 {
-		if verbose {
-			display_e("Message length too short: " + msg)
-		}
-		return ""
+// currentClock returns a copy of the local clocks to attach to a message
+func currentClock(vectorialClock map[string]int) protocol.Clock {
+	vc := make(map[string]int, len(vectorialClock))
+	for siteID, value := range vectorialClock {
+		vc[siteID] = value
 	}
+	return protocol.Clock{Stamp: s, VectorialClock: vc}
+}
 
-	sep := msg[0:1]
-	tab_allkeyvals := strings.Split(msg[1:], sep)
+// senderOf returns the site which sent a message between controllers, "" for other messages
+func senderOf(m protocol.Message) string {
+	switch m := m.(type) {
+	case *protocol.RequestSc:
+		return m.SiteID
+	case *protocol.ReleaseSc:
+		return m.SiteID
+	case *protocol.ReceiptSc:
+		return m.SiteID
+	}
+	return ""
+}
 
-	for _, keyval := range tab_allkeyvals {
+// requestSc marks the local site as requesting the critical section and returns the request to broadcast
+func requestSc(tab StateMap, vectorialClock map[string]int) *protocol.RequestSc {
+	tab[*id].Type = protocol.MsgRequestSc
+	tab[*id].Clock = s
+	requestedAt = time.Now()
+	return &protocol.RequestSc{
+		Clock:  currentClock(vectorialClock),
+		SiteID: *id,
+	}
+}
 
-		if len(keyval) < 4 {
-			continue
-		}
+// pendingRequest returns the request of the local site again, with its original stamp
+func pendingRequest(tab StateMap, vectorialClock map[string]int) *protocol.RequestSc {
+	clock := currentClock(vectorialClock)
+	clock.Stamp = tab[*id].Clock
+	return &protocol.RequestSc{Clock: clock, SiteID: *id}
+}
+
+const maxReleaseLog = 256 // releases of the local site kept to be sent again after a resync
+
+// logRelease adds a release of the local site to the log, dropping the oldest ones
+func logRelease(releaseLog []*protocol.ReleaseSc, release *protocol.ReleaseSc) []*protocol.ReleaseSc {
+	releaseLog = append(releaseLog, release)
+	if len(releaseLog) > maxReleaseLog {
+		releaseLog = releaseLog[len(releaseLog)-maxReleaseLog:]
+	}
+	return releaseLog
+}
 
-		equ := keyval[0:1]
-		tabkeyval := strings.Split(keyval[1:], equ)
-		if tabkeyval[0] == key {
-			return tabkeyval[1]
+// missedReleases returns the releases of the log which are not covered by the release clock of another site
+func missedReleases(releaseLog []*protocol.ReleaseSc, released map[string]int) []*protocol.ReleaseSc {
+	var missed []*protocol.ReleaseSc
+	for _, release := range releaseLog {
+		if release.VectorialClock[*id] > released[*id] {
+			missed = append(missed, release)
 		}
 	}
-	if verbose {
-		err_msg := fmt.Sprintf("Key %s not found in message", key)
-		display_w(err_msg)
+	return missed
+}
+
+func copyClock(clock map[string]int) map[string]int {
+	c := make(map[string]int, len(clock))
+	for siteID, value := range clock {
+		c[siteID] = value
 	}
-	return ""
+	return c
+}
+
+// resetStamp returns the next logical timestamp, ensuring monotonicity
+func resetStamp(stamp, stamprcv int) int {
+	if stamp < stamprcv {
+		return stamprcv + 1
+	}
+	return stamp + 1
 }
 
 func updateVectorialClock(localClock map[string]int, receivedClock map[string]int, mySiteID string) map[string]int {
@@ -87,14 +150,14 @@ func updateVectorialClock(localClock map[string]int, receivedClock map[string]in
 func CreateDefaultStateMap(siteID string) StateMap {
 
 	stateMap := make(map[string]*StateObject)
-	stateMap[siteID] = &StateObject{Type: MsgReleaseSc, Clock: 0}
+	stateMap[siteID] = &StateObject{Type: protocol.MsgReleaseSc, Clock: 0}
 	return stateMap
 }
 
 func AddSiteToStateMap(stateMap *StateMap, siteID string) {
 	if _, exists := (*stateMap)[siteID]; !exists {
 		(*stateMap)[siteID] = &StateObject{
-			Type:  MsgReleaseSc,
+			Type:  protocol.MsgReleaseSc,
 			Clock: -1, // Initialize with -1 to indicate not set : to be sure we won't get the priority
 		}
 	}
@@ -117,8 +180,7 @@ func timestampComparison(a, b CompareElement) bool {
 
 // verifyScApproval checks if the local site can enter the critical section and signals approval
 func verifyScApproval(tab StateMap, myID string) {
-	var sndmsg string
-	if tab[myID].Type == MsgRequestSc {
+	if tab[myID].Type == protocol.MsgRequestSc {
 
 		site_elem := CompareElement{Clock: tab[myID].Clock, Id: myID}
 
@@ -129,8 +191,17 @@ func verifyScApproval(tab StateMap, myID string) {
 			}
 		}
 
-		sndmsg = msg_format(TypeField, MsgAppStartSc)
-		fmt.Println(sndmsg)
+		if merge != nil && merge.own {
+			if !merge.inSection {
+				merge.inSection = true
+				sectionEntered()
+				display_d("Entering critical section to merge the document with the partition of " + merge.peer)
+				writeMessage(&protocol.CurrentText{SiteID: mergeTextID})
+			}
+			return
+		}
+		sectionEntered()
+		writeMessage(&protocol.AppStartSc{})
 		display_d("Entering critical section")
 	}
 }
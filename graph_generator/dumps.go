@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emicklei/dot"
+)
+
+// topologyDump is the file written by a network site on SIGUSR1 (-topology)
+type topologyDump struct {
+	Site      string    `json:"site"`
+	Addr      string    `json:"addr"`
+	Time      time.Time `json:"time"`
+	Neighbors []struct {
+		Site   string `json:"site"`
+		Addr   string `json:"addr"`
+		Origin string `json:"origin"`
+	} `json:"neighbors"`
+}
+
+// link is an edge of the overlay, as told by the dumps of its ends
+type link struct {
+	a, b     string // a < b
+	origin   string // why the site which dialed it opened it
+	oneSided bool   // only one end has it: it is opening or closing, or the other end has no dump
+}
+
+// readDumps reads the topology dumps of dir (*_topology.json)
+func readDumps(dir string) ([]topologyDump, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_topology.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no topology dump in %s", dir)
+	}
+	var dumps []topologyDump
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var dump topologyDump
+		if err := json.Unmarshal(data, &dump); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps, nil
+}
+
+// recentDumps leaves out the dumps written more than since before the newest
+// one: they are left over by an older signal, from sites which were killed or
+// stopped answering. since <= 0 keeps every dump
+func recentDumps(dumps []topologyDump, since time.Duration) (recent, stale []topologyDump) {
+	if since <= 0 {
+		return dumps, nil
+	}
+	var newest time.Time
+	for _, dump := range dumps {
+		if dump.Time.After(newest) {
+			newest = dump.Time
+		}
+	}
+	for _, dump := range dumps {
+		if newest.Sub(dump.Time) > since {
+			stale = append(stale, dump)
+		} else {
+			recent = append(recent, dump)
+		}
+	}
+	return recent, stale
+}
+
+// overlay returns the sites and the links of the dumps, sorted. A link dialed
+// by one end is "accepted" at the other one: its origin is the one of the
+// dialing end
+func overlay(dumps []topologyDump) ([]string, []link) {
+	var sites []string
+	addSite := func(site string) {
+		if !slices.Contains(sites, site) {
+			sites = append(sites, site)
+		}
+	}
+	ends := make(map[[2]string]int)
+	origins := make(map[[2]string]string)
+	for _, dump := range dumps {
+		addSite(dump.Site)
+		for _, neighbor := range dump.Neighbors {
+			addSite(neighbor.Site)
+			key := [2]string{min(dump.Site, neighbor.Site), max(dump.Site, neighbor.Site)}
+			ends[key]++
+			if origins[key] == "" || origins[key] == "accepted" {
+				origins[key] = neighbor.Origin
+			}
+		}
+	}
+	slices.Sort(sites)
+	var links []link
+	for key, n := range ends {
+		links = append(links, link{a: key[0], b: key[1], origin: origins[key], oneSided: n < 2})
+	}
+	slices.SortFunc(links, func(x, y link) int {
+		if x.a != y.a {
+			return strings.Compare(x.a, y.a)
+		}
+		return strings.Compare(x.b, y.b)
+	})
+	return sites, links
+}
+
+// edge colors by origin, the links of the first targets are black
+var originColors = map[string]string{
+	"reconnect": "orange",
+	"rewire":    "blue",
+}
+
+// dumpsGraph draws the overlay of the dumps
+func dumpsGraph(dumps []topologyDump) *dot.Graph {
+	g := dot.NewGraph(dot.Undirected)
+	addrs := make(map[string]string)
+	for _, dump := range dumps {
+		addrs[dump.Site] = dump.Addr
+	}
+	sites, links := overlay(dumps)
+	nodes := make(map[string]dot.Node)
+	for _, site := range sites {
+		node := g.Node(site)
+		if addr, dumped := addrs[site]; !dumped {
+			node.Attr("style", "dashed") // no dump: only known by its neighbors
+		} else if addr != "" {
+			node.Label(site + "\n" + addr)
+		}
+		nodes[site] = node
+	}
+	for _, l := range links {
+		edge := g.Edge(nodes[l.a], nodes[l.b])
+		if color, ok := originColors[l.origin]; ok {
+			edge.Attr("color", color).Label(l.origin)
+		}
+		if l.oneSided {
+			edge.Dashed()
+		}
+	}
+	return g
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// after site 2 left a line 1-2-3, site 3 dialed site 1 again
+var leftDumps = map[string]string{
+	"1": `{"site":"1","addr":"10.0.0.1:9000","neighbors":[{"site":"3","origin":"accepted"},{"site":"4","origin":"target"}]}`,
+	"3": `{"site":"3","addr":"10.0.0.3:9000","neighbors":[{"site":"1","addr":"10.0.0.1:9000","origin":"rewire"}]}`,
+	"4": `{"site":"4","neighbors":[]}`,
+}
+
+func writeDumps(t *testing.T, dumps map[string]string) string {
+	dir := t.TempDir()
+	for site, dump := range dumps {
+		if err := os.WriteFile(filepath.Join(dir, site+"_topology.json"), []byte(dump), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestOverlayFromDumps(t *testing.T) {
+	dumps, err := readDumps(writeDumps(t, leftDumps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites, links := overlay(dumps)
+	if want := []string{"1", "3", "4"}; !slices.Equal(sites, want) {
+		t.Errorf("sites %v, want %v", sites, want)
+	}
+	want := []link{
+		{a: "1", b: "3", origin: "rewire"},
+		{a: "1", b: "4", origin: "target", oneSided: true}, // 4 has not seen it yet
+	}
+	if !slices.Equal(links, want) {
+		t.Errorf("links %+v, want %+v", links, want)
+	}
+
+	graph := dumpsGraph(dumps).String()
+	if !strings.Contains(graph, `label="rewire"`) || !strings.Contains(graph, `style="dashed"`) {
+		t.Errorf("graph without the rewired and one-sided links:\n%s", graph)
+	}
+}
+
+func TestNoDumps(t *testing.T) {
+	if _, err := readDumps(t.TempDir()); err == nil {
+		t.Error("no error without dumps")
+	}
+	var dump topologyDump
+	if err := json.Unmarshal([]byte(leftDumps["1"]), &dump); err != nil || len(dump.Neighbors) != 2 {
+		t.Errorf("dump of site 1: %+v, %v", dump, err)
+	}
+}
+
+// TestStaleDumps leaves out the dump of a site killed before the last signal
+func TestStaleDumps(t *testing.T) {
+	now := time.Now()
+	dumps := []topologyDump{{Site: "1", Time: now}, {Site: "2", Time: now.Add(-time.Minute)}, {Site: "3", Time: now.Add(-time.Second)}}
+	recent, stale := recentDumps(dumps, 10*time.Second)
+	if len(recent) != 2 || recent[0].Site != "1" || recent[1].Site != "3" || len(stale) != 1 || stale[0].Site != "2" {
+		t.Errorf("recent dumps %+v, stale dumps %+v", recent, stale)
+	}
+	if recent, _ := recentDumps(dumps, 0); len(recent) != 3 {
+		t.Errorf("%d dumps kept without -since, want 3", len(recent))
+	}
+}
@@ -1,26 +1,46 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/emicklei/dot"
 )
 
+var dumpsDir *string = flag.String("dumps", "", "directory of the topology dumps of the running sites (*_topology.json), drawn instead of a matrix")
+var since *time.Duration = flag.Duration("since", 10*time.Second, "dumps written this long before the newest one are not drawn (sites killed before they removed their dump), 0 draws them all")
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run generate_graph.go <output_file> [matrix_data]")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: go run generate_graph.go [-dumps dir [-since duration]] <output_file> [matrix_data]")
 		os.Exit(1)
 	}
 
-	outputFile := os.Args[1]
+	outputFile := flag.Arg(0)
+
+	if *dumpsDir != "" {
+		dumps, err := readDumps(*dumpsDir)
+		if err != nil {
+			fmt.Printf("Error reading the topology dumps: %v\n", err)
+			os.Exit(1)
+		}
+		dumps, stale := recentDumps(dumps, *since)
+		for _, dump := range stale {
+			fmt.Printf("Skipping the dump of site %s, written at %s\n", dump.Site, dump.Time.Format(time.TimeOnly))
+		}
+		render(dumpsGraph(dumps), outputFile)
+		return
+	}
 
 	var matrixData string
-	if len(os.Args) >= 3 {
-		matrixData = os.Args[2]
+	if flag.NArg() >= 2 {
+		matrixData = flag.Arg(1)
 	} else {
 		// Read from stdin
 		data, err := io.ReadAll(os.Stdin)
@@ -80,7 +100,13 @@ func main() {
 				g.Edge(nodes[i], nodes[j])
 			}
 		}
-	} // Check if dot command is available
+	}
+	render(g, outputFile)
+}
+
+// render writes the graph to outputFile as a PNG image
+func render(g *dot.Graph, outputFile string) {
+	// Check if dot command is available
 	_, err := exec.LookPath("dot")
 	if err != nil {
 		// ANSI color codes
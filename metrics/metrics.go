@@ -0,0 +1,314 @@
+// Package metrics exposes the counters of a site over HTTP in the Prometheus
+// text format (version 0.0.4).
+//
+// Every metric belongs to a Registry, which renders all of them on each
+// scrape. A metric may have labels: its values are then kept per list of
+// label values, given in the order of the label names.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds of the histograms of durations, in seconds
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics rendered together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.metrics {
+		if other.name() == m.name() {
+			panic("metrics: " + m.name() + " registered twice")
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo renders every metric of the registry, in the order they were created
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	cw := &countingWriter{w: w}
+	for _, m := range metrics {
+		if err := m.write(cw); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ServeHTTP answers a scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// Serve answers the scrapes of /metrics on addr until the listener fails
+func (r *Registry) Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return http.Serve(ln, mux)
+}
+
+// series holds the values of a metric, by label values
+type series[V any] struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]*V
+	keys   map[string][]string // label values of each key
+}
+
+func newSeries[V any](labels []string) *series[V] {
+	return &series[V]{labels: labels, values: make(map[string]*V), keys: make(map[string][]string)}
+}
+
+// get returns the value for labelValues, created on first use. It must be
+// called with the lock held
+func (s *series[V]) get(labelValues []string) *V {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for the labels %v", len(labelValues), s.labels))
+	}
+	key := strings.Join(labelValues, "\x00")
+	v, ok := s.values[key]
+	if !ok {
+		v = new(V)
+		s.values[key] = v
+		s.keys[key] = slices.Clone(labelValues)
+	}
+	return v
+}
+
+// sorted returns the keys of the values, sorted so that scrapes are stable
+func (s *series[V]) sorted() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Counter is a value which only goes up, e.g. a number of messages
+type Counter struct {
+	metricName, help string
+	*series[float64]
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{metricName: name, help: help, series: newSeries[float64](labels)}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.metricName + " decreased")
+	}
+	c.mu.Lock()
+	*c.get(labelValues) += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) error {
+	return writeValues(w, c.metricName, c.help, "counter", c.series)
+}
+
+// Gauge is a value which goes up and down, e.g. a number of peers
+type Gauge struct {
+	metricName, help string
+	*series[float64]
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{metricName: name, help: help, series: newSeries[float64](labels)}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	*g.get(labelValues) = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mu.Lock()
+	*g.get(labelValues) += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) name() string { return g.metricName }
+
+func (g *Gauge) write(w io.Writer) error {
+	return writeValues(w, g.metricName, g.help, "gauge", g.series)
+}
+
+func writeValues(w io.Writer, name, help, typ string, s *series[float64]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeHeader(w, name, help, typ); err != nil {
+		return err
+	}
+	if len(s.labels) == 0 && len(s.values) == 0 {
+		s.get(nil) // an unlabeled metric is always there, at 0
+	}
+	for _, key := range s.sorted() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, labelPairs(s.labels, s.keys[key]), formatValue(*s.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations, e.g. durations, in buckets of increasing
+// upper bounds
+type Histogram struct {
+	metricName, help string
+	buckets          []float64
+	*series[histogramValue]
+}
+
+type histogramValue struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds, in
+// increasing order (DefaultBuckets when nil)
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " not sorted")
+	}
+	h := &Histogram{metricName: name, help: help, buckets: buckets, series: newSeries[histogramValue](labels)}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value := h.get(labelValues)
+	if value.counts == nil {
+		value.counts = make([]uint64, len(h.buckets))
+	}
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		value.counts[i]++
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := writeHeader(w, h.metricName, h.help, "histogram"); err != nil {
+		return err
+	}
+	labels := append(slices.Clone(h.labels), "le")
+	for _, key := range h.sorted() {
+		value, labelValues := h.values[key], h.keys[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			pairs := labelPairs(labels, append(slices.Clone(labelValues), formatValue(bound)))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, pairs, cumulative); err != nil {
+				return err
+			}
+		}
+		pairs := labelPairs(labels, append(slices.Clone(labelValues), "+Inf"))
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, pairs, value.count); err != nil {
+			return err
+		}
+		pairs = labelPairs(h.labels, labelValues)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.metricName, pairs, formatValue(value.sum), h.metricName, pairs, value.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, name, help, typ string) error {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs renders {name="value",...}, or nothing without labels
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	sent := r.NewCounter("dte_messages_sent_total", "Messages sent, by type.", "type")
+	peers := r.NewGauge("dte_peers", "Connected neighbors.")
+	wait := r.NewHistogram("dte_wait_seconds", "Wait\nin seconds.", []float64{0.1, 1})
+
+	sent.Inc("rls")
+	sent.Add(2, "rqs")
+	sent.Inc(`a"b\`)
+	peers.Set(3)
+	peers.Add(-1)
+	wait.Observe(0.05)
+	wait.Observe(0.1)
+	wait.Observe(4)
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP dte_messages_sent_total Messages sent, by type.
+# TYPE dte_messages_sent_total counter
+dte_messages_sent_total{type="a\"b\\"} 1
+dte_messages_sent_total{type="rls"} 1
+dte_messages_sent_total{type="rqs"} 2
+# HELP dte_peers Connected neighbors.
+# TYPE dte_peers gauge
+dte_peers 2
+# HELP dte_wait_seconds Wait\nin seconds.
+# TYPE dte_wait_seconds histogram
+dte_wait_seconds_bucket{le="0.1"} 2
+dte_wait_seconds_bucket{le="1"} 2
+dte_wait_seconds_bucket{le="+Inf"} 3
+dte_wait_seconds_sum 4.15
+dte_wait_seconds_count 3
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestUnusedMetrics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("by_type_total", "By type.", "type")
+	r.NewGauge("size", "Size.")
+	r.NewHistogram("latency_seconds", "Latency.", nil, "type")
+
+	var out strings.Builder
+	r.WriteTo(&out)
+	// labeled metrics have no value until they are used, the others are at 0
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !strings.HasPrefix(line, "#") && line != "size 0" {
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("scrapes_total", "Scrapes.").Inc()
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if typ := resp.Header.Get("Content-Type"); typ != ContentType {
+		t.Errorf("content type %q, want %q", typ, ContentType)
+	}
+	if !strings.Contains(string(body), "\nscrapes_total 1\n") {
+		t.Errorf("scrape without the counter:\n%s", body)
+	}
+}
@@ -0,0 +1,93 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Addresses are host:port, with IPv6 literals in brackets ([::1]:9000). The
+// site listens on -listen, and tells the other sites to dial -advertise: the
+// address of a link is the ephemeral port of the site which dialed it, not
+// the one it listens on
+
+const defaultPort = 9000
+
+// normalizeAddr returns addr as host:port, with port when addr has none. A
+// bare IPv6 literal (::1 or [::1]) is a host: its port must come after the
+// brackets
+func normalizeAddr(addr string, port int) (string, error) {
+	addr = strings.TrimSpace(addr)
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) || (addrErr.Err != "missing port in address" && addrErr.Err != "too many colons in address") {
+			return "", err
+		}
+		host, portStr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(port)
+	}
+	if p, err := strconv.Atoi(portStr); err != nil || p < 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port in address %s", addr)
+	}
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid host in address %s", addr)
+	}
+	return net.JoinHostPort(host, portStr), nil
+}
+
+// listenAddr returns the address the site listens on: -listen, or every
+// interface on -port
+func listenAddr() (string, error) {
+	return normalizeAddr(*listen, *port)
+}
+
+// advertisedAddr returns the address the other sites dial to reach the site
+// listening on listening: -advertise, or the host it listens on, or the IP
+// of the machine when it listens on every interface
+func advertisedAddr(listening string) (string, error) {
+	host, portStr, err := net.SplitHostPort(listening)
+	if err != nil {
+		return "", err
+	}
+	p, _ := strconv.Atoi(portStr)
+	if *advertise != "" {
+		return normalizeAddr(*advertise, p)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = localIP(ip == nil || ip.To4() != nil)
+	}
+	return net.JoinHostPort(host, portStr), nil
+}
+
+// localIP returns an address of the machine which is not a loopback, IPv4
+// first unless v4 is false, and the loopback when there is none
+func localIP(v4 bool) string {
+	var found [2]string // IPv4, IPv6
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			family := 0
+			if ipnet.IP.To4() == nil {
+				family = 1
+			}
+			if found[family] == "" {
+				found[family] = ipnet.IP.String()
+			}
+		}
+	}
+	order := []string{found[0], found[1], "127.0.0.1"}
+	if !v4 {
+		order = []string{found[1], found[0], "::1"}
+	}
+	for _, ip := range order {
+		if ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
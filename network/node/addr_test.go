@@ -0,0 +1,103 @@
+package node
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"protocol"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	for _, tc := range []struct{ addr, want string }{
+		{"example.org:9001", "example.org:9001"},
+		{" 10.0.0.5 ", "10.0.0.5:9000"},
+		{"[::1]:9001", "[::1]:9001"},
+		{"::1", "[::1]:9000"},
+		{"[::1]", "[::1]:9000"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:9000"},
+		{":9001", ":9001"},
+		{"", ":9000"},
+		{"example.org:port", ""},
+		{"example.org:70000", ""},
+		{"[::1:9001", ""},
+	} {
+		got, err := normalizeAddr(tc.addr, defaultPort)
+		if tc.want == "" && err == nil {
+			t.Errorf("normalizeAddr(%q) = %q, want an error", tc.addr, got)
+		} else if tc.want != "" && got != tc.want {
+			t.Errorf("normalizeAddr(%q) = %q, %v, want %q", tc.addr, got, err, tc.want)
+		}
+	}
+}
+
+func TestTargetsIPv6(t *testing.T) {
+	got := processTargetFlags("[::1]:9001,::1, 127.0.0.1:9001,[::1]:9001,[::1:9002")
+	want := []string{"[::1]:9001", "[::1]:9000", "127.0.0.1:9001"}
+	if !slices.Equal(got, want) {
+		t.Errorf("targets %v, want %v", got, want)
+	}
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	saved := *advertise
+	t.Cleanup(func() { *advertise = saved })
+	for _, tc := range []struct{ listening, advertise, want string }{
+		{"192.168.1.10:9001", "", "192.168.1.10:9001"},
+		{"[2001:db8::1]:9001", "", "[2001:db8::1]:9001"},
+		{":9001", "example.org", "example.org:9001"},
+		{"[::]:9001", "2001:db8::2", "[2001:db8::2]:9001"},
+		{":9001", "example.org:80", "example.org:80"},
+	} {
+		*advertise = tc.advertise
+		if got, err := advertisedAddr(tc.listening); got != tc.want {
+			t.Errorf("advertisedAddr(%q) with -advertise %q = %q, %v, want %q", tc.listening, tc.advertise, got, err, tc.want)
+		}
+	}
+	// on every interface, the site advertises an address of the machine
+	*advertise = ""
+	got, err := advertisedAddr(":9001")
+	if host, port, _ := net.SplitHostPort(got); err != nil || net.ParseIP(host) == nil || port != "9001" {
+		t.Errorf("advertisedAddr(\":9001\") = %q, %v, want an IP of the machine", got, err)
+	}
+}
+
+// TestAdvertisedOverIPv6 joins two nodes over the IPv6 loopback: the site
+// admitting the other one learns the address it listens on, which is given
+// to the neighbors when it leaves
+func TestAdvertisedOverIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	outA, fromA := testController(t)
+	outB, fromB := testController(t)
+	a, b := newNode("a", outA), newNode("b", outB)
+	b.addr = "[::1]:9123"
+	for _, site := range []*Node{a, b} {
+		go site.run()
+		t.Cleanup(site.stop)
+	}
+	go a.serve(ln)
+
+	target := processTargetFlags(ln.Addr().String())
+	if len(target) != 1 {
+		t.Fatalf("targets %v, want %s", target, ln.Addr())
+	}
+	go b.connectToPeer(target[0], linkTarget)
+	expect[*protocol.SharedText](t, a.id, fromA)
+	a.controllerMessages <- &protocol.SharedText{SitesToAdd: []string{b.id}, Text: "shared"}
+	expect[*protocol.Initialization](t, b.id, fromB)
+
+	var listening string
+	a.do(func() { listening = a.connectedSites[b.id].listening })
+	if listening != b.addr {
+		t.Errorf("site a knows b listens on %q, want %q", listening, b.addr)
+	}
+	var dialed string
+	b.do(func() { dialed = b.connectedSites[a.id].listening })
+	if dialed != ln.Addr().String() {
+		t.Errorf("site b knows a listens on %q, want %q", dialed, ln.Addr())
+	}
+}
@@ -0,0 +1,64 @@
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// the proofs of the two sides are signed with different labels so that a
+// proof cannot be sent back to the site which produced it
+const (
+	acceptorProof = "dte-acceptor"
+	joinerProof   = "dte-joiner"
+)
+
+var (
+	errPassphraseRequired = errors.New("the document is protected by a passphrase")
+	errWrongPassphrase    = errors.New("wrong passphrase")
+)
+
+// readPassphrase returns the passphrase given on the command line or in a
+// file, empty when there is none
+func readPassphrase(passphrase, file string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(content), "\r\n")
+	}
+	return passphrase, nil
+}
+
+// loadSecret returns the key derived from the passphrase, or nil when there is
+// none
+func loadSecret(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, nil
+	}
+	return pbkdf2.Key(sha256.New, passphrase, []byte("distributed-text-editor"), 100000, 32)
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// proof signs a nonce received from another site with the key derived from
+// the passphrase
+func proof(key []byte, label, nonce, siteID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label + "\x00" + nonce + "\x00" + siteID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validProof(key []byte, label, nonce, siteID, got string) bool {
+	return hmac.Equal([]byte(proof(key, label, nonce, siteID)), []byte(got))
+}
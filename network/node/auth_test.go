@@ -0,0 +1,136 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// secretConfig returns the default settings of a site of a document protected
+// by passphrase
+func secretConfig(t *testing.T, passphrase string) config {
+	cfg := defaultConfig
+	key, err := loadSecret(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.passphrase, cfg.secretKey = passphrase, key
+	return cfg
+}
+
+// readPeer returns the next message of a peer link
+func readPeer(t *testing.T, r *wire.Reader) protocol.Message {
+	t.Helper()
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.Decode(frame, protocol.NetworkToNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// expectNotAdmitting checks that site has not started the admission of
+// siteID: nothing is asked to its controller and no link waits for the network
+func expectNotAdmitting(t *testing.T, site *memSite, siteID string) {
+	t.Helper()
+	select {
+	case msg := <-site.messages:
+		t.Errorf("site %s gave %T to its controller", site.id, msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	site.do(func() {
+		if _, waiting := site.waitingConnections[siteID]; waiting {
+			t.Errorf("site %s waits for the admission of %s", site.id, siteID)
+		}
+	})
+}
+
+func TestAuthRightPassphrase(t *testing.T) {
+	network := newMemNetwork(1)
+	a := newMemSite(t, network, "a", "a:9000", secretConfig(t, "secret"))
+	b := newMemSite(t, network, "b", "b:9000", secretConfig(t, "secret"))
+	b.join(t, a)
+	if !network.linked(a.addr, b.addr) {
+		t.Error("sites sharing the passphrase not linked")
+	}
+}
+
+// TestAuthWrongPassphrase answers the challenge with the proof of another
+// passphrase: the site is denied and the link closed before it waits for the
+// network
+func TestAuthWrongPassphrase(t *testing.T) {
+	network := newMemNetwork(1)
+	a := newMemSite(t, network, "a", "a:9000", secretConfig(t, "secret"))
+	wrong := secretConfig(t, "guess")
+
+	conn, err := network.host("intruder:9000").dial(a.addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	w, r := wire.NewWriter(conn), wire.NewReader(conn)
+	w.WriteFrame(protocol.Marshal(&protocol.AccessRequest{SiteID: "intruder", Version: protocol.Version, Capabilities: wrong.capabilities, Addr: "intruder:9000", Nonce: newNonce()}))
+	challenge, ok := readPeer(t, r).(*protocol.Challenge)
+	if !ok {
+		t.Fatal("no challenge sent to a site of a protected network")
+	}
+	w.WriteFrame(protocol.Marshal(&protocol.ChallengeResponse{SiteID: "intruder", Proof: proof(wrong.secretKey, joinerProof, challenge.Nonce, "intruder")}))
+	if denied, ok := readPeer(t, r).(*protocol.AccessDenied); !ok || denied.Reason != errWrongPassphrase.Error() {
+		t.Errorf("answer %+v to a wrong passphrase, want a denial", denied)
+	}
+	if frame, err := r.ReadFrame(); err == nil {
+		t.Errorf("link still open after the denial, read %q", frame)
+	}
+	expectNotAdmitting(t, a, "intruder")
+}
+
+// TestAuthMissingPassphrase asks to join a protected network without proof
+func TestAuthMissingPassphrase(t *testing.T) {
+	network := newMemNetwork(1)
+	a := newMemSite(t, network, "a", "a:9000", secretConfig(t, "secret"))
+
+	conn, err := network.host("b:9000").dial(a.addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := wire.NewReader(conn)
+	wire.NewWriter(conn).WriteFrame(protocol.Marshal(&protocol.AccessRequest{SiteID: "b", Version: protocol.Version, Capabilities: defaultConfig.capabilities, Addr: "b:9000"}))
+	if denied, ok := readPeer(t, r).(*protocol.AccessDenied); !ok || denied.Reason != errPassphraseRequired.Error() {
+		t.Errorf("answer %+v to a site without passphrase, want a denial", denied)
+	}
+	if frame, err := r.ReadFrame(); err == nil {
+		t.Errorf("link still open after the denial, read %q", frame)
+	}
+	expectNotAdmitting(t, a, "b")
+}
+
+// TestAuthAcceptorWithoutPassphrase joins through a site which cannot prove
+// it knows the passphrase: the joiner gives up before proving it knows it
+func TestAuthAcceptorWithoutPassphrase(t *testing.T) {
+	network := newMemNetwork(1)
+	a := newMemSite(t, network, "a", "a:9000", secretConfig(t, "other"))
+	b := newMemSite(t, network, "b", "b:9000", secretConfig(t, "secret"))
+
+	conn, err := b.transport.dial(a.addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) // no wait for a grant when the handshake is broken
+	if b.joinThrough(conn, a.addr, linkTarget) {
+		t.Error("site joined a network of another passphrase")
+	}
+	expectNotAdmitting(t, a, b.id)
+	b.do(func() {
+		if len(b.connectedSites) != 0 {
+			t.Errorf("site linked to %d sites", len(b.connectedSites))
+		}
+	})
+}
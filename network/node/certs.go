@@ -0,0 +1,162 @@
+package node
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var siteNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// runCerts implements "network certs": it creates a certificate authority in
+// a directory (unless there is already one) and a certificate signed by it for
+// each site given, so that mutual TLS can be set up offline
+func runCerts(args []string) error {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "directory of the CA and of the site certificates")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: network certs [-dir DIR] SITE...")
+		fmt.Fprintln(fs.Output(), "Creates DIR/ca.pem (if missing) and DIR/SITE.pem, DIR/SITE.key for each site,")
+		fmt.Fprintln(fs.Output(), "to use with: network -cert DIR/SITE.pem -key DIR/SITE.key -ca DIR/ca.pem")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no site given")
+	}
+	for _, site := range fs.Args() {
+		if !siteNamePattern.MatchString(site) || site == "ca" {
+			return fmt.Errorf("invalid site name %q", site)
+		}
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+
+	ca, caKey, err := loadOrCreateCA(*dir)
+	if err != nil {
+		return err
+	}
+	for _, site := range fs.Args() {
+		if err := createSiteCert(*dir, site, ca, caKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if certPEM, err := os.ReadFile(certPath); err == nil {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return parseCA(certPEM, keyPEM)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "distributed-text-editor CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca, err := signCert(template, template, key, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeCertAndKey(certPath, keyPath, ca, key); err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("Created certificate authority " + certPath)
+	return ca, key, nil
+}
+
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("invalid CA certificate or key")
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("the CA key cannot sign certificates")
+	}
+	return ca, signer, nil
+}
+
+func createSiteCert(dir, site string, ca *x509.Certificate, caKey crypto.Signer) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: site},
+		DNSNames:    []string{site},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(2, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := signCert(template, ca, key, caKey)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath := filepath.Join(dir, site+".pem"), filepath.Join(dir, site+".key")
+	if err := writeCertAndKey(certPath, keyPath, cert, key); err != nil {
+		return err
+	}
+	fmt.Println("Created certificate " + certPath + " for site " + site)
+	return nil
+}
+
+func signCert(template, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func writeCertAndKey(certPath, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644)
+}
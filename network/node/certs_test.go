@@ -0,0 +1,101 @@
+package node
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func siteTLSConfig(t *testing.T, dir, site string) *tls.Config {
+	config, err := loadTLSConfig(filepath.Join(dir, site+".pem"), filepath.Join(dir, site+".key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func handshake(client, server *tls.Config) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() { done <- tls.Server(s, server).Handshake() }()
+	err := tls.Client(c, client).Handshake()
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	return err
+}
+
+func TestMutualTLSWithGeneratedCerts(t *testing.T) {
+	network, other := t.TempDir(), t.TempDir()
+	if err := runCerts([]string{"-dir", network, "site1", "site2"}); err != nil {
+		t.Fatal(err)
+	}
+	// sites added later are signed by the same CA
+	if err := runCerts([]string{"-dir", network, "site3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCerts([]string{"-dir", other, "intruder"}); err != nil {
+		t.Fatal(err)
+	}
+
+	site1, site3 := siteTLSConfig(t, network, "site1"), siteTLSConfig(t, network, "site3")
+	intruder := siteTLSConfig(t, other, "intruder")
+	if err := handshake(site3, site1); err != nil {
+		t.Errorf("handshake between sites of the same CA: %v", err)
+	}
+	if err := handshake(intruder, site1); err == nil {
+		t.Error("a site accepted a peer signed by another CA")
+	}
+	if err := handshake(site1, intruder); err == nil {
+		t.Error("a site connected to a peer signed by another CA")
+	}
+
+	if err := runCerts([]string{"-dir", network, "../site"}); err == nil {
+		t.Error("runCerts accepted a site name with a path")
+	}
+	if _, err := loadTLSConfig(filepath.Join(network, "site1.pem"), "", ""); err == nil {
+		t.Error("loadTLSConfig accepted a certificate without key and CA")
+	}
+}
+
+// TestTLSHandshakeTimeout drops a peer which never starts the handshake, and
+// leaves no deadline on the links which complete it
+func TestTLSHandshakeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	if err := runCerts([]string{"-dir", dir, "site1", "site2"}); err != nil {
+		t.Fatal(err)
+	}
+	site1, site2 := siteTLSConfig(t, dir, "site1"), siteTLSConfig(t, dir, "site2")
+
+	silent, s := net.Pipe()
+	defer silent.Close()
+	start := time.Now()
+	if _, err := secureConn(s, site1, false, 100*time.Millisecond); err == nil {
+		t.Fatal("handshake with a silent peer succeeded")
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("silent peer dropped after %v", elapsed)
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := secureConn(s, site1, false, 100*time.Millisecond)
+		done <- conn
+	}()
+	client, err := secureConn(c, site2, true, 100*time.Millisecond)
+	server := <-done
+	if err != nil || server == nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	go client.Write([]byte("x"))
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after the handshake: %v", err)
+	}
+}
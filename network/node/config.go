@@ -0,0 +1,45 @@
+package node
+
+import (
+	"crypto/tls"
+	"maps"
+	"time"
+
+	"protocol"
+)
+
+// config holds the settings of a node. Run builds it once from the flags, the
+// nodes of the tests change their own copy
+type config struct {
+	heartbeat    time.Duration // interval between two heartbeats, 0 disables failure detection
+	suspect      time.Duration // a neighbor silent for longer is lost
+	reconnect    time.Duration // a lost neighbor not reconnected within this delay has failed
+	broadcast    string        // wave or tree
+	compressMin  int           // smallest text compressed, -1 disables compression
+	sendQueue    int           // frames waiting to be sent to a neighbor
+	queueFull    string        // drop or block
+	document     string        // name of the document, written in the invitation links
+	passphrase   string        // of the document, given to the sites invited by this one
+	secretKey    []byte        // derived from the passphrase, nil when the network is open
+	tls          *tls.Config   // configuration of the peer links, nil when they use plain TCP
+	capabilities protocol.Capabilities
+}
+
+// defaultConfig holds the default values of the flags
+var defaultConfig = newConfig()
+
+// newConfig returns the settings given by the flags, without the passphrase
+// and TLS which Run loads
+func newConfig() config {
+	return config{
+		heartbeat:    *heartbeat,
+		suspect:      *suspect,
+		reconnect:    *reconnect,
+		broadcast:    *broadcastMode,
+		compressMin:  *compressMin,
+		sendQueue:    *sendQueue,
+		queueFull:    *queueFull,
+		document:     *document,
+		capabilities: maps.Clone(localCapabilities),
+	}
+}
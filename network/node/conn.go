@@ -0,0 +1,143 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// capabilities supported by the sites, by order of preference
+var localCapabilities = protocol.Capabilities{
+	protocol.CapCompression: {protocol.GzipCompression, protocol.NoCompression},
+	protocol.CapFraming:     {string(wire.LengthFraming), string(wire.LineFraming)},
+	protocol.CapEncryption:  {"none"},
+	protocol.CapEditing:     {"diff"},
+}
+
+// peerConn is a TCP connection to another site with its framed reader and writer.
+// Both start with line framing and switch to the framing negotiated by maq/mag.
+// The writer is only used by the goroutine sending the queued frames.
+type peerConn struct {
+	net.Conn
+	reader       *wire.Reader
+	writer       *wire.Writer
+	queue        chan outFrame // frames waiting to be sent
+	stall        time.Duration // a frame not written within this delay closes the link
+	dropWhenFull bool          // close the link when the queue is full instead of waiting
+	compressMin  int           // smallest text compressed on the link, -1 for none
+	closed       chan struct{}
+	closeOnce    sync.Once
+	capabilities protocol.Choices // capabilities chosen for the link
+
+	challenge string                  // nonce sent to the requesting site
+	pending   *protocol.AccessRequest // access request waiting for the challenge response
+
+	lastSeen  atomic.Int64 // time of the last message received (unix nano)
+	addr      string       // address dialed to open the link, "" when the peer opened it
+	listening string       // address the peer listens on, "" when it did not advertise one
+	origin    string       // why the link was opened, see linkTarget
+	opened    time.Time
+}
+
+func newPeerConn(conn net.Conn, cfg config) *peerConn {
+	peer := makePeerConn(conn, cfg)
+	go peer.writeFrames()
+	return peer
+}
+
+// makePeerConn returns the link without the goroutine writing its frames
+func makePeerConn(conn net.Conn, cfg config) *peerConn {
+	peer := &peerConn{
+		Conn:         conn,
+		reader:       wire.NewReader(conn),
+		writer:       wire.NewWriter(conn),
+		queue:        make(chan outFrame, max(cfg.sendQueue, 1)),
+		stall:        cfg.suspect,
+		dropWhenFull: cfg.queueFull == "drop",
+		compressMin:  cfg.compressMin,
+		closed:       make(chan struct{}),
+		opened:       time.Now(),
+	}
+	peer.lastSeen.Store(time.Now().UnixNano())
+	return peer
+}
+
+// readFrame reads the next message of the peer and records that it is alive
+func (conn *peerConn) readFrame() (string, error) {
+	line, err := conn.reader.ReadFrame()
+	if err == nil {
+		conn.lastSeen.Store(time.Now().UnixNano())
+	}
+	return line, err
+}
+
+// silence returns the time elapsed since the last message of the peer
+func (conn *peerConn) silence() time.Duration {
+	return time.Since(time.Unix(0, conn.lastSeen.Load()))
+}
+
+// framing returns the framing negotiated for the link
+func (conn *peerConn) framing() wire.Framing {
+	return wire.Framing(conn.capabilities.Get(protocol.CapFraming))
+}
+
+// acceptPeer checks that a site asking for access speaks the same protocol and
+// chooses the capabilities of the link
+func acceptPeer(conn *peerConn, msg *protocol.AccessRequest, local protocol.Capabilities) error {
+	if err := protocol.CheckVersion(msg.Version); err != nil {
+		return err
+	}
+	choices, err := protocol.Negotiate(local, msg.Capabilities)
+	if err != nil {
+		return err
+	}
+	conn.capabilities = choices
+	return nil
+}
+
+// grantAccess sends the mag message with the capabilities chosen for the
+// link, which are used for every following message
+func grantAccess(conn *peerConn, msg *protocol.AccessGranted) error {
+	msg.Version = protocol.Version
+	msg.Capabilities = conn.capabilities
+	if text, compression, err := compressField(conn.capabilities.Get(protocol.CapCompression), msg.Text, conn.compressMin); err == nil {
+		msg.Text, msg.Compression = text, compression
+	}
+	err := writeToConn(conn, msg)
+	conn.setWriteFraming(conn.framing())
+	return err
+}
+
+// denyAccess tells a site why it cannot join and closes the connection
+func (n *Node) denyAccess(conn *peerConn, reason error) {
+	writeToConn(conn, &protocol.AccessDenied{SiteID: n.id, Version: protocol.Version, Reason: reason.Error()})
+	conn.closeAfterSend()
+}
+
+// useGrantedCapabilities checks the answer of the site which granted access,
+// decompresses the shared text and switches the link to the capabilities it chose
+func useGrantedCapabilities(conn *peerConn, msg *protocol.AccessGranted, local protocol.Capabilities) error {
+	if err := protocol.CheckVersion(msg.Version); err != nil {
+		return err
+	}
+	for name, value := range msg.Capabilities {
+		if supported, ok := local[name]; !ok || !slices.Contains(supported, value) {
+			return fmt.Errorf("%w: unsupported %s %q", protocol.ErrIncompatible, name, value)
+		}
+	}
+	text, err := protocol.Decompress(msg.Compression, msg.Text)
+	if err != nil {
+		return err
+	}
+	msg.Text, msg.Compression = text, ""
+	conn.capabilities = msg.Capabilities
+	conn.reader.SetFraming(conn.framing())
+	conn.setWriteFraming(conn.framing())
+	return nil
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"protocol"
+)
+
+const announceInterval = time.Second // between two announcements of a site
+
+// discoverTargets listens for the announcements of the sites of the document,
+// and returns the one to join (nil when there is none)
+func discoverTargets() []string {
+	conn, err := listenAnnouncements(*discoverAddr)
+	if err != nil {
+		display_e("Cannot listen for announcements on " + *discoverAddr + " : " + err.Error())
+		return nil
+	}
+	defer conn.Close()
+	display_d("Looking for the sites of document \"" + *document + "\" on " + *discoverAddr + " for " + discoverWait.String())
+	peers := discoverPeers(conn, *document, *discoverWait)
+	if len(peers) == 0 {
+		display_w("No site found for document \"" + *document + "\"")
+		return nil
+	}
+	display_d("Discovered sites: " + strings.Join(peers, ", ") + ", joining " + peers[0])
+	return peers[:1]
+}
+
+// listenAnnouncements opens the socket on which announcements are received: a
+// multicast group, or a plain UDP address (e.g. on loopback, which usually has
+// no multicast)
+func listenAnnouncements(addr string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, udpAddr)
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+// discoverPeers collects during wait the addresses of the sites announcing
+// document, in the order they are first heard
+func discoverPeers(conn net.PacketConn, document string, wait time.Duration) []string {
+	var peers []string
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return peers // deadline reached
+		}
+		msg, err := protocol.Decode(string(buf[:n]), protocol.NetworkToNetwork)
+		if err != nil {
+			display_e("Rejected announcement from " + from.String() + " : " + err.Error())
+			continue
+		}
+		announce, ok := msg.(*protocol.Announce)
+		if !ok || announce.SiteID == *id || announce.Document != document {
+			continue
+		}
+		if announce.Version != protocol.Version {
+			display_w("Ignoring site " + announce.SiteID + " announced by " + from.String() + " : protocol version " + strconv.Itoa(announce.Version))
+			continue
+		}
+		host, _, err := net.SplitHostPort(from.String())
+		if err != nil {
+			continue
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(announce.Port))
+		if announce.Addr != "" {
+			addr = announce.Addr
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			peers = append(peers, addr)
+			display_d("Discovered site " + announce.SiteID + " on " + addr)
+		}
+	}
+}
+
+// announceSite announces the site, reachable on advertised, to addr until the
+// process exits
+func announceSite(addr string, advertised string) {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		display_e("Cannot announce the site on " + addr + " : " + err.Error())
+		return
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		display_e("Cannot announce the site on " + addr + " : " + err.Error())
+		return
+	}
+	defer conn.Close()
+	_, advertisedPort, _ := net.SplitHostPort(advertised)
+	port, _ := strconv.Atoi(advertisedPort)
+	announcement := &protocol.Announce{SiteID: *id, Document: *document, Port: port, Version: protocol.Version}
+	if *advertise != "" { // otherwise the host of the sender is more likely to be reachable than a guess
+		announcement.Addr = advertised
+	}
+	announce := []byte(protocol.Marshal(announcement))
+	failing := false // errors are only reported when they start
+	for {
+		_, err := conn.WriteTo(announce, to)
+		if err != nil && !failing {
+			display_e("Cannot announce the site on " + addr + " : " + err.Error())
+		}
+		failing = err != nil
+		time.Sleep(announceInterval)
+	}
+}
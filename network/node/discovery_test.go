@@ -0,0 +1,47 @@
+package node
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+func TestDiscoveryOnLoopback(t *testing.T) {
+	listener, err := listenAnnouncements("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	announces := []*protocol.Announce{
+		{SiteID: "2", Document: "notes", Port: 9002, Version: protocol.Version},
+		{SiteID: "3", Document: "other", Port: 9003, Version: protocol.Version}, // another document
+		{SiteID: *id, Document: "notes", Port: 9000, Version: protocol.Version}, // the site itself
+		{SiteID: "4", Document: "notes", Port: 9004, Version: protocol.Version + 1},
+		{SiteID: "2", Document: "notes", Port: 9002, Version: protocol.Version}, // announced again
+		{SiteID: "5", Document: "notes", Port: 9005, Version: protocol.Version},
+	}
+	for _, announce := range announces {
+		if _, err := sender.WriteTo([]byte(protocol.Marshal(announce)), listener.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.WriteTo([]byte("not a message"), listener.LocalAddr())
+
+	start := time.Now()
+	peers := discoverPeers(listener, "notes", 300*time.Millisecond)
+	if want := []string{"127.0.0.1:9002", "127.0.0.1:9005"}; !slices.Equal(peers, want) {
+		t.Errorf("discoverPeers() = %v, want %v", peers, want)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("discoverPeers returned after %v, before the end of the wait", elapsed)
+	}
+}
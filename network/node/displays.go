@@ -0,0 +1,32 @@
+package node
+
+import (
+	"log"
+	"os"
+)
+
+var (
+	cyan   string = "\033[1;36m"
+	raz    string = "\033[0;00m"
+	rouge  string = "\033[1;31m"
+	orange string = "\033[1;33m"
+)
+
+var (
+	pid    = os.Getpid()
+	stderr = log.New(os.Stderr, "", 0)
+)
+
+func display(color, mark, siteID, what string) {
+	stderr.Printf("%s %s [%s %d net] %s%s", color, mark, siteID, pid, what, raz)
+}
+
+func display_d(what string) { display(cyan, "+", *id, what) }
+func display_w(what string) { display(orange, "*", *id, what) }
+func display_e(what string) { display(rouge, "!", *id, what) }
+
+// the messages of a node are tagged with its id, there may be several nodes in a process
+
+func (n *Node) display_d(what string) { display(cyan, "+", n.id, what) }
+func (n *Node) display_w(what string) { display(orange, "*", n.id, what) }
+func (n *Node) display_e(what string) { display(rouge, "!", n.id, what) }
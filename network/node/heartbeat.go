@@ -0,0 +1,70 @@
+package node
+
+import (
+	"time"
+
+	"protocol"
+)
+
+// monitorPeers is called at each heartbeat: it sends heartbeats to the
+// neighbors, closes the links which have been silent for longer than the
+// suspicion timeout and declares failed the lost neighbors which have not been
+// reconnected in time
+func (n *Node) monitorPeers() {
+	for siteID, conn := range n.connectedSites {
+		if conn.silence() > n.config.suspect {
+			n.display_w("No message from " + siteID + " for " + conn.silence().Round(time.Millisecond).String() + ", closing the link")
+			n.loseLink(siteID)
+			continue
+		}
+		if err := writeToConn(conn, &protocol.Heartbeat{SiteID: n.id}); err != nil {
+			n.display_e("Error sending heartbeat to " + siteID + ": " + err.Error())
+		}
+	}
+	failed := false
+	for siteID, since := range n.lostSites {
+		if time.Since(since) > n.config.reconnect {
+			failed = true
+			n.display_w("Link to " + siteID + " not restored for " + time.Since(since).Round(time.Millisecond).String() + ", considering it failed")
+			failure := &protocol.SiteFailed{SiteID: n.id, FailedID: siteID}
+			n.handleSiteFailed(failure)
+			if len(n.connectedSites) > 0 {
+				n.startWave(failure) // the sites which are not neighbors of the failed one must know it too
+			}
+		}
+	}
+	if failed {
+		n.startCensus() // the failed site may have been the only way to some sites
+	}
+}
+
+// handleSiteFailed removes a failed site from the network, and tells the
+// controller the first time the failure is known
+func (n *Node) handleSiteFailed(failure *protocol.SiteFailed) {
+	if failure.FailedID == n.id {
+		n.display_e("Site " + failure.SiteID + " considers this site as failed")
+		return
+	}
+	if !n.isKnownSite(failure.FailedID) {
+		return // already removed
+	}
+	n.delKnownSite(failure.FailedID)
+	delete(n.lostSites, failure.FailedID)
+	n.partitionedSites[failure.FailedID] = true // it may only be out of reach, its address is still dialed
+	n.forgetRoutes(failure.FailedID)
+	// before the waves it settles, which may carry messages of the failed site
+	n.writeMessage(failure)
+	if conn := getAndRemoveConn(failure.FailedID, &n.connectedSites); conn != nil {
+		conn.Close()
+		n.display_w("Closed connection to failed site " + failure.FailedID)
+		n.linkRemoved(failure.FailedID)
+	}
+}
+
+// settleWaves counts the red message that a neighbor which left will never send
+// in every wave still waiting for it, so that these waves can end
+func (n *Node) settleWaves(siteID string) {
+	for diffusionID, status := range n.waves.active {
+		n.answerWave(diffusionID, status, siteID, 0, nil)
+	}
+}
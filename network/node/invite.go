@@ -0,0 +1,31 @@
+package node
+
+import "protocol"
+
+// applyInvite gives -targets, -document and -secret the values of an
+// invitation link, the flags given explicitly are kept
+func applyInvite(link string) error {
+	invite, err := protocol.ParseInvite(link)
+	if err != nil {
+		return err
+	}
+	if *targets == "" {
+		*targets = invite.Target
+	}
+	if *document == "" {
+		*document = invite.Document
+	}
+	if *secret == "" && *secretFile == "" {
+		*secret = invite.Token
+	}
+	return nil
+}
+
+// invite returns the link to join the document through this site, empty when
+// the document has no name
+func (n *Node) invite() string {
+	if n.config.document == "" {
+		return ""
+	}
+	return protocol.Invite{Target: n.addr, Document: n.config.document, Token: n.config.passphrase}.String()
+}
@@ -0,0 +1,36 @@
+package node
+
+import (
+	"io"
+	"testing"
+)
+
+// TestInvite joins through the link of a site: the invited site gets its
+// address, the document and the passphrase, except the flags it was given
+func TestInvite(t *testing.T) {
+	defer func(t, d, s string) { *targets, *document, *secret = t, d, s }(*targets, *document, *secret)
+	n := newNode("1", io.Discard)
+	n.addr = "192.0.2.1:9000"
+	n.config.document, n.config.passphrase = "Team notes", "open sesame"
+	link := n.invite()
+
+	*targets, *document, *secret = "", "", ""
+	if err := applyInvite(link); err != nil {
+		t.Fatal(err)
+	}
+	if *targets != n.addr || *document != "Team notes" || *secret != "open sesame" {
+		t.Errorf("invited with -targets %q -document %q -secret %q", *targets, *document, *secret)
+	}
+
+	*targets, *document, *secret = "192.0.2.2:9000", "", "mine"
+	applyInvite(link)
+	if *targets != "192.0.2.2:9000" || *secret != "mine" {
+		t.Errorf("flags given replaced by the link: -targets %q -secret %q", *targets, *secret)
+	}
+	if err := applyInvite("dte://" + n.addr); err == nil {
+		t.Error("link without document accepted")
+	}
+	if n.config.document = ""; n.invite() != "" {
+		t.Error("link given for a document without name")
+	}
+}
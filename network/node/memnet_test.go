@@ -0,0 +1,419 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memory links between nodes of this process, which can delay, reorder,
+// duplicate and drop the frames, and be cut. Each Write of the writer of a
+// link is one frame (see wire.Writer.WriteFrame), the faults apply to whole
+// frames. The faults are drawn from a seeded source: with the same seed, the
+// same frames are faulty
+
+// memFaults are the faults applied to the frames written on the links
+type memFaults struct {
+	latency   time.Duration // added to every frame
+	jitter    time.Duration // random extra latency, the frames stay in order
+	reorder   float64       // probability that a frame is held back, and overtaken by the next ones
+	duplicate float64       // probability that a frame is delivered twice
+	drop      float64       // probability that a frame is lost
+}
+
+// held back frames are delivered this late
+const reorderDelay = 20 * time.Millisecond
+
+var errConnRefused = errors.New("connection refused")
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memNetwork holds the listeners and the links of the memory transport
+type memNetwork struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	faults    memFaults
+	listeners map[string]*memListener
+	links     []*memLink
+	blocked   map[[2]string]bool // pairs of sites which cannot dial each other
+	frozen    map[string]bool    // sites whose frames are lost, see freeze
+	ports     int                // last ephemeral port
+	frames    int                // frames written
+	faulty    int                // frames dropped, duplicated or held back
+}
+
+func newMemNetwork(seed uint64) *memNetwork {
+	return &memNetwork{
+		rand:      rand.New(rand.NewPCG(seed, seed)),
+		listeners: make(map[string]*memListener),
+		blocked:   make(map[[2]string]bool),
+		frozen:    make(map[string]bool),
+		ports:     50000,
+	}
+}
+
+// setFaults changes the faults of the frames written from now on. The access
+// handshake switches the framing of the links, so only latency and jitter
+// keep the frames of a link readable before the sites joined
+func (m *memNetwork) setFaults(faults memFaults) {
+	m.mu.Lock()
+	m.faults = faults
+	m.mu.Unlock()
+}
+
+// host returns the transport of the site listening on addr
+func (m *memNetwork) host(addr string) *memHost {
+	return &memHost{network: m, addr: addr}
+}
+
+func pair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// cut closes the links between the sites listening on a and b, and keeps them
+// from dialing each other until heal is called. The frames in transit are lost
+func (m *memNetwork) cut(a, b string) int {
+	m.mu.Lock()
+	m.blocked[pair(a, b)] = true
+	var cut []*memLink
+	m.links = slices.DeleteFunc(m.links, func(link *memLink) bool {
+		if pair(link.from, link.to) == pair(a, b) {
+			cut = append(cut, link)
+			return true
+		}
+		return false
+	})
+	m.mu.Unlock()
+	for _, link := range cut {
+		link.ends[0].in.reset()
+		link.ends[1].in.reset()
+	}
+	return len(cut)
+}
+
+// heal lets the sites listening on a and b dial each other again
+func (m *memNetwork) heal(a, b string) {
+	m.mu.Lock()
+	delete(m.blocked, pair(a, b))
+	m.mu.Unlock()
+}
+
+// freeze makes the site listening on addr silent, like a site which hangs:
+// its links stay open but the frames it writes are lost, and it can neither
+// dial nor be dialed
+func (m *memNetwork) freeze(addr string) {
+	m.mu.Lock()
+	m.frozen[addr] = true
+	m.mu.Unlock()
+}
+
+func (m *memNetwork) isFrozen(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.frozen[addr]
+}
+
+// linked tells whether a link between the sites listening on a and b is open
+func (m *memNetwork) linked(a, b string) bool {
+	m.mu.Lock()
+	links := slices.Clone(m.links) // the pipes are locked after the network, see write
+	m.mu.Unlock()
+	for _, link := range links {
+		if pair(link.from, link.to) == pair(a, b) && !link.ends[0].in.isClosed() && !link.ends[1].in.isClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+// faultyFrames returns the number of frames dropped, duplicated or held back
+func (m *memNetwork) faultyFrames() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.faulty
+}
+
+// schedule returns when the copies of a frame are delivered after the
+// previous frame delivered at last: none when it is dropped, two when it is
+// duplicated
+func (m *memNetwork) schedule(last time.Time) (deliveries []time.Time, next time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frames++
+	f := m.faults
+	if f.drop > 0 && m.rand.Float64() < f.drop {
+		m.faulty++
+		return nil, last
+	}
+	at := time.Now().Add(f.latency)
+	if f.jitter > 0 {
+		at = at.Add(time.Duration(m.rand.Int64N(int64(f.jitter))))
+	}
+	if at.Before(last) {
+		at = last // a link delivers in order
+	}
+	next = at
+	if f.reorder > 0 && m.rand.Float64() < f.reorder {
+		m.faulty++
+		at, next = at.Add(reorderDelay), last
+	}
+	deliveries = []time.Time{at}
+	if f.duplicate > 0 && m.rand.Float64() < f.duplicate {
+		m.faulty++
+		deliveries = append(deliveries, at)
+	}
+	return deliveries, next
+}
+
+// memHost is the transport of one site
+type memHost struct {
+	network *memNetwork
+	addr    string
+}
+
+func (h *memHost) listen(addr string) (net.Listener, error) {
+	m := h.network
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, used := m.listeners[addr]; used {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(addr), Err: errors.New("address already in use")}
+	}
+	ln := &memListener{network: m, addr: addr, conns: make(chan *memConn), closed: make(chan struct{})}
+	m.listeners[addr] = ln
+	return ln, nil
+}
+
+func (h *memHost) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m := h.network
+	m.mu.Lock()
+	ln := m.listeners[addr]
+	if ln == nil || m.blocked[pair(h.addr, addr)] || m.frozen[h.addr] || m.frozen[addr] {
+		m.mu.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errConnRefused}
+	}
+	m.ports++
+	local := memAddr(fmt.Sprintf("%s:%d", h.addr, m.ports))
+	link := &memLink{from: h.addr, to: addr}
+	toListener, toDialer := newMemPipe(), newMemPipe()
+	link.ends = [2]*memConn{
+		{network: m, site: h.addr, local: local, remote: memAddr(addr), in: toDialer, out: toListener},
+		{network: m, site: addr, local: memAddr(addr), remote: local, in: toListener, out: toDialer},
+	}
+	m.links = append(m.links, link)
+	m.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case ln.conns <- link.ends[1]:
+		return link.ends[0], nil
+	case <-ln.closed:
+	case <-expired:
+	}
+	link.ends[0].Close()
+	return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errConnRefused}
+}
+
+type memListener struct {
+	network   *memNetwork
+	addr      string
+	conns     chan *memConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.network.mu.Lock()
+		delete(ln.network.listeners, ln.addr)
+		ln.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr { return memAddr(ln.addr) }
+
+// memLink is a link dialed by the site listening on from
+type memLink struct {
+	from, to string
+	ends     [2]*memConn // dialer, listener
+}
+
+// memConn is an end of a link
+type memConn struct {
+	network       *memNetwork
+	site          string // address of the site which holds this end
+	local, remote memAddr
+	in, out       *memPipe
+}
+
+func (c *memConn) Read(p []byte) (int, error) { return c.in.read(p) }
+
+func (c *memConn) Write(p []byte) (int, error) {
+	if c.out.isClosed() || c.in.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if c.network.isFrozen(c.site) {
+		return len(p), nil
+	}
+	c.out.write(p, c.network)
+	return len(p), nil
+}
+
+// Close ends both directions: the reads of this end fail, the other end reads
+// the frames in transit then io.EOF
+func (c *memConn) Close() error {
+	c.in.close(net.ErrClosed)
+	c.out.close(io.EOF)
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.local }
+func (c *memConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil } // writes never block
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.mu.Lock()
+	c.in.deadline = t
+	c.in.cond.Broadcast()
+	c.in.mu.Unlock()
+	return nil
+}
+
+type memFrame struct {
+	data []byte
+	at   time.Time
+}
+
+// memPipe is a direction of a link: the frames written wait for their time of
+// delivery, then can be read
+type memPipe struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []memFrame // by time of delivery
+	ready    []byte
+	last     time.Time // delivery of the last frame in order
+	err      error     // returned once the frames are read, when the pipe is closed
+	deadline time.Time
+}
+
+func newMemPipe() *memPipe {
+	p := &memPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *memPipe) write(data []byte, m *memNetwork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	deliveries, next := m.schedule(p.last)
+	p.last = next
+	for _, at := range deliveries {
+		i, _ := slices.BinarySearchFunc(p.pending, at, func(f memFrame, at time.Time) int {
+			if f.at.After(at) {
+				return 1
+			}
+			return -1 // after the frames delivered at the same time
+		})
+		p.pending = slices.Insert(p.pending, i, memFrame{slices.Clone(data), at})
+	}
+	p.cond.Broadcast()
+}
+
+func (p *memPipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		now := time.Now()
+		for len(p.pending) > 0 && !p.pending[0].at.After(now) {
+			p.ready = append(p.ready, p.pending[0].data...)
+			p.pending = p.pending[1:]
+		}
+		if len(p.ready) > 0 {
+			n := copy(b, p.ready)
+			p.ready = p.ready[n:]
+			return n, nil
+		}
+		if p.err != nil && (len(p.pending) == 0 || p.err != io.EOF) {
+			return 0, p.err
+		}
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		var wake time.Time
+		if len(p.pending) > 0 {
+			wake = p.pending[0].at
+		}
+		if !p.deadline.IsZero() && (wake.IsZero() || p.deadline.Before(wake)) {
+			wake = p.deadline
+		}
+		if !wake.IsZero() {
+			timer := time.AfterFunc(time.Until(wake), func() {
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			})
+			p.cond.Wait()
+			timer.Stop()
+		} else {
+			p.cond.Wait()
+		}
+	}
+}
+
+// close ends the pipe: err is read after the frames in transit when it is
+// io.EOF, at once otherwise
+func (p *memPipe) close(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// reset ends the pipe at once, the frames in transit are lost
+func (p *memPipe) reset() {
+	p.mu.Lock()
+	p.pending, p.ready = nil, nil
+	if p.err == nil || p.err == io.EOF {
+		p.err = errConnReset
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+var errConnReset = &net.OpError{Op: "read", Net: "mem", Err: errors.New("connection reset by peer")}
+
+func (p *memPipe) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
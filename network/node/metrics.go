@@ -0,0 +1,37 @@
+package node
+
+import (
+	"time"
+
+	"metrics"
+)
+
+// metrics of the site, served on -metrics
+var (
+	registry = metrics.NewRegistry()
+
+	messagesSent     = registry.NewCounter("dte_network_messages_sent_total", "Messages sent by the network layer, by link (peer or controller) and type.", "link", "type")
+	messagesReceived = registry.NewCounter("dte_network_messages_received_total", "Messages received by the network layer, by link (peer or controller) and type.", "link", "type")
+	waveDuration     = registry.NewHistogram("dte_network_wave_duration_seconds", "Time from the start of a wave by this site to its end, by type of the message it carries.", nil, "type")
+	peerCount        = registry.NewGauge("dte_network_peers", "Neighbors in the network.")
+	knownSiteCount   = registry.NewGauge("dte_network_known_sites", "Sites of the network known by this site.")
+)
+
+// serveMetrics answers the scrapes on addr
+func serveMetrics(addr string) {
+	display_d("Serving the metrics on http://" + addr + "/metrics")
+	if err := registry.Serve(addr); err != nil {
+		display_e("Cannot serve the metrics: " + err.Error())
+	}
+}
+
+// updateGauges sets the gauges from the state of the node, after each event
+func (n *Node) updateGauges() {
+	peerCount.Set(float64(len(n.connectedSites)))
+	knownSiteCount.Set(float64(len(n.knownSites)))
+}
+
+// waveEnded records the duration of a wave started by this site
+func waveEnded(status *DiffusionStatus) {
+	waveDuration.Observe(time.Since(status.started).Seconds(), status.message.Type())
+}
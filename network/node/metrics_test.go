@@ -0,0 +1,58 @@
+package node
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"protocol"
+)
+
+// scraped returns the value of a series of the metrics of the process, 0 when
+// it is not there yet
+func scraped(t *testing.T, series string) float64 {
+	t.Helper()
+	var out strings.Builder
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestWaveMetrics(t *testing.T) {
+	site, _ := setupWaves(t)
+	connectNeighbor(site, "2")
+	mct, _, _ := newWavePayload(waveContent).encode(protocol.NoCompression, 0)
+
+	series := []string{
+		`dte_network_messages_sent_total{link="peer",type="dif"}`,
+		`dte_network_messages_sent_total{link="controller",type="rqs"}`,
+		`dte_network_wave_duration_seconds_count{type="rqs"}`,
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = scraped(t, s)
+	}
+
+	site.startWave(waveContent)
+	site.handleDiffusion(&protocol.Diffusion{ID: site.id + ":message_1", Color: RedMsg, Content: mct, SiteID: "2"}, "2")
+
+	for i, s := range series {
+		if got := scraped(t, s) - before[i]; got != 1 {
+			t.Errorf("%s went up by %v, want 1", s, got)
+		}
+	}
+	site.updateGauges()
+	if got := scraped(t, "dte_network_peers"); got != 1 {
+		t.Errorf("dte_network_peers = %v, want 1", got)
+	}
+}
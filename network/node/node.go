@@ -0,0 +1,120 @@
+package node
+
+import (
+	"io"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// Node is a site of the network. Its state is only used by its event loop
+// (run): the goroutines reading the links and the controller, and the timers,
+// hand it their events through channels, so several nodes can run in one
+// process
+type Node struct {
+	id     string
+	addr   string // address the other sites dial to reach this site
+	config config // settings of the node, given by the flags
+
+	connectedSites                 map[string]*peerConn // connections which are in the network
+	connectedSitesWaitingAdmission map[string]*peerConn // connections waiting for admission
+	waitingConnections             WaitingMap           // connections waiting for processing (to be recuperated with both site id and address in the controller reading routine)
+	knownSites                     []string             // contains the ids of known sites in the network
+	waves                          *waveTable           // diffusions seen by this site
+	tree                           *spanningTree        // spanning tree of the network, as known by this site
+	routes                         map[string]string    // next hop toward the sites which are not neighbors
+	lostSites                      map[string]time.Time // neighbors whose link was lost, with the time of the loss
+	partitionedSites               map[string]bool      // sites removed from the network because they were out of reach, until the partitions merge
+
+	controller *wire.Writer // messages to the controller
+	transport  transport    // opens the links to the other sites
+
+	peerMessages       chan peerMessage      // messages read on the links
+	controllerMessages chan protocol.Message // messages read from the controller
+	closedLinks        chan *peerConn        // links which stopped being read
+	calls              chan func()           // other work on the state, see do
+	quit               chan struct{}
+}
+
+// peerMessage is a message read on the link to a peer
+type peerMessage struct {
+	conn *peerConn
+	addr string
+	msg  protocol.Message
+}
+
+func newNode(siteID string, controller io.Writer) *Node {
+	return &Node{
+		id:                             siteID,
+		config:                         defaultConfig,
+		connectedSites:                 make(map[string]*peerConn),
+		connectedSitesWaitingAdmission: make(map[string]*peerConn),
+		waitingConnections:             make(WaitingMap),
+		waves:                          newWaveTable(),
+		tree:                           newSpanningTree(),
+		routes:                         make(map[string]string),
+		lostSites:                      make(map[string]time.Time),
+		partitionedSites:               make(map[string]bool),
+		controller:                     wire.NewWriter(controller),
+		transport:                      tcpTransport{},
+		peerMessages:                   make(chan peerMessage),
+		controllerMessages:             make(chan protocol.Message),
+		closedLinks:                    make(chan *peerConn),
+		calls:                          make(chan func()),
+		quit:                           make(chan struct{}),
+	}
+}
+
+// run handles the events of the node one at a time, until stop is called.
+// The heartbeats are sent from the loop too
+func (n *Node) run() {
+	var ticks <-chan time.Time
+	if n.config.heartbeat > 0 {
+		ticker := time.NewTicker(n.config.heartbeat)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case m := <-n.peerMessages:
+			n.handlePeerMessage(m.conn, m.addr, m.msg)
+		case msg := <-n.controllerMessages:
+			n.handleControllerMessage(msg)
+		case conn := <-n.closedLinks:
+			n.linkLost(conn)
+		case <-ticks:
+			n.monitorPeers()
+		case f := <-n.calls:
+			f()
+		case <-n.quit:
+			return
+		}
+		n.updateGauges()
+	}
+}
+
+// do runs f in the event loop and waits for it. It must not be called from
+// the loop itself
+func (n *Node) do(f func()) {
+	done := make(chan struct{})
+	select {
+	case n.calls <- func() { f(); close(done) }:
+		<-done
+	case <-n.quit:
+	}
+}
+
+// stop ends the event loop and closes every connection of the node. It does
+// nothing once the node is closed
+func (n *Node) stop() {
+	n.do(n.close)
+}
+
+// close closes every connection of the node and ends its event loop, from the
+// loop itself
+func (n *Node) close() {
+	unregisterAllConns(&n.connectedSites)
+	unregisterAllConns(&n.connectedSitesWaitingAdmission)
+	close(n.quit)
+}
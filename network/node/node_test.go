@@ -0,0 +1,126 @@
+package node
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// testController returns the writer given to a node as its controller, and
+// the channel of the messages the node writes to it
+func testController(t *testing.T) (io.Writer, <-chan protocol.Message) {
+	r, w := io.Pipe()
+	t.Cleanup(func() { r.Close() })
+	messages := make(chan protocol.Message, 64)
+	go func() {
+		reader := wire.NewReader(r)
+		for {
+			line, err := reader.ReadFrame()
+			if err != nil {
+				return
+			}
+			if msg, err := protocol.Decode(line, protocol.NetworkToControler); err == nil {
+				messages <- msg
+			}
+		}
+	}()
+	return w, messages
+}
+
+func expect[T protocol.Message](t *testing.T, siteID string, messages <-chan protocol.Message) T {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msg, ok := msg.(T); ok {
+				return msg
+			}
+		case <-timeout:
+			var want T
+			t.Fatalf("site %s: no %T given to the controller", siteID, want)
+			return want
+		}
+	}
+}
+
+// TestNodesInOneProcess joins two nodes over loopback TCP, each with its own
+// event loop, and broadcasts a message of one of them
+func TestNodesInOneProcess(t *testing.T) {
+	outA, fromA := testController(t)
+	outB, fromB := testController(t)
+	a, b := newNode("a", outA), newNode("b", outB)
+	for _, site := range []*Node{a, b} {
+		go site.run()
+		t.Cleanup(site.stop)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go a.serve(ln)
+
+	go b.connectToPeer(ln.Addr().String(), linkTarget)
+	// a is alone: its controller gives the shared text to b
+	if request := expect[*protocol.SharedText](t, a.id, fromA); request.SiteID != b.id {
+		t.Fatalf("site a asked the shared text for %q, want %q", request.SiteID, b.id)
+	}
+	a.controllerMessages <- &protocol.SharedText{SitesToAdd: []string{b.id}, Text: "shared"}
+	if init := expect[*protocol.Initialization](t, b.id, fromB); init.Text != "shared" {
+		t.Errorf("site b joined with the text %q, want %q", init.Text, "shared")
+	}
+
+	b.controllerMessages <- &protocol.RequestSc{SiteID: b.id, Clock: protocol.Clock{Stamp: 1, VectorialClock: map[string]int{"a": 0, "b": 1}}}
+	for _, site := range []struct {
+		*Node
+		messages <-chan protocol.Message
+	}{{a, fromA}, {b, fromB}} {
+		if request := expect[*protocol.RequestSc](t, site.id, site.messages); request.SiteID != b.id {
+			t.Errorf("site %s got the request of %q, want %q", site.id, request.SiteID, b.id)
+		}
+	}
+}
+
+// TestReadControllerStops returns once the controller closes its link, instead
+// of reading it again and again
+func TestReadControllerStops(t *testing.T) {
+	out, _ := testController(t)
+	site := newNode("a", out)
+	go site.run()
+	t.Cleanup(site.stop)
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		site.readController(wire.NewReader(r))
+		close(done)
+	}()
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still reading a closed link")
+	}
+}
+
+// TestSiteLeavingAlone closes the node of a site alone in the network once its
+// application is closed, without exiting the process
+func TestSiteLeavingAlone(t *testing.T) {
+	out, messages := testController(t)
+	site := newNode("a", out)
+	go site.run()
+	t.Cleanup(site.stop)
+	site.controllerMessages <- &protocol.ReleaseSc{SiteID: "a", Clock: protocol.Clock{VectorialClock: map[string]int{}}, Close: true}
+	if release := expect[*protocol.ReleaseSc](t, "a", messages); !release.Close {
+		t.Errorf("release %+v given back to the controller, want the closing one", release)
+	}
+	select {
+	case <-site.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node still running after its site left")
+	}
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"protocol"
+)
+
+var errPartitionUndetected = errors.New("the partition is not known by both sites yet")
+
+// startCensus diffuses a census over every link: the known sites which do not
+// answer are in another partition
+func (n *Node) startCensus() {
+	n.display_d("Starting a census of the reachable sites")
+	n.startWaveAlong(&protocol.Census{SiteID: n.id}, "")
+}
+
+// censusDone is called when the census of this site ends with the sites it
+// reached
+func (n *Node) censusDone(reached []string) {
+	var unreachable []string
+	for _, siteID := range n.knownSites {
+		if siteID != n.id && !slices.Contains(reached, siteID) {
+			unreachable = append(unreachable, siteID)
+		}
+	}
+	if len(unreachable) == 0 {
+		n.display_d("Census done, every known site is reachable")
+		return
+	}
+	partition := &protocol.Partition{SiteID: n.id, Unreachable: unreachable}
+	n.handlePartition(partition)
+	if len(n.connectedSites) > 0 {
+		n.startWave(partition) // the sites of the partition remove them too
+	}
+}
+
+// handlePartition removes the sites out of reach from the network, and tells
+// the controller which ones were still known
+func (n *Node) handlePartition(partition *protocol.Partition) {
+	var removed []string
+	for _, siteID := range partition.Unreachable {
+		if siteID == n.id {
+			continue
+		}
+		n.partitionedSites[siteID] = true
+		if n.isKnownSite(siteID) {
+			n.delKnownSite(siteID)
+			n.forgetRoutes(siteID)
+			removed = append(removed, siteID)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	n.display_w("Network split, " + strings.Join(removed, ", ") + " out of reach : going on without them")
+	n.writeMessage(&protocol.Partition{SiteID: partition.SiteID, Unreachable: removed})
+}
+
+// mergeNeeded reports whether a site which asks for access through this one
+// is in another partition, and whether both sites know it
+func (n *Node) mergeNeeded(request *protocol.AccessRequest) (merge bool, err error) {
+	merge = n.partitionedSites[request.SiteID]
+	if merge != slices.Contains(request.Partitioned, n.id) {
+		return false, errPartitionUndetected // the failure detection of the other site is late, it will try again
+	}
+	return merge, nil
+}
+
+// mergeLink registers a link to a site of another partition: the controllers
+// at both ends merge the documents of the partitions, the sites are known
+// again after the merge
+func (n *Node) mergeLink(siteID string, conn *peerConn) {
+	delete(n.lostSites, siteID) // not a restored link, there is nothing to resync
+	n.useLink(siteID, conn)
+	n.display_w("Link to " + siteID + " of another partition, merging the documents")
+	n.writeMessage(&protocol.Merge{SiteID: siteID})
+}
+
+// rejoinSites adds again the sites of a merged release to the network
+func (n *Node) rejoinSites(release *protocol.ReleaseSc) {
+	for _, siteID := range release.Rejoined {
+		delete(n.partitionedSites, siteID)
+		if siteID != n.id {
+			n.addKnownSite(siteID)
+		}
+	}
+}
+
+// partitionedList returns the sites in another partition, sent with the
+// access requests
+func (n *Node) partitionedList() []string {
+	var sites []string
+	for siteID := range n.partitionedSites {
+		sites = append(sites, siteID)
+	}
+	slices.Sort(sites)
+	return sites
+}
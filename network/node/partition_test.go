@@ -0,0 +1,64 @@
+package node
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"protocol"
+)
+
+// TestCensusFindsPartition splits a network in two halves: the census of each
+// half removes the sites of the other one, which are admitted again for a
+// merge once both halves know the partition
+func TestCensusFindsPartition(t *testing.T) {
+	n := newSimNetwork(t, 12)
+	halves := [][]string{n.ids[:6], n.ids[6:]}
+	for _, half := range halves {
+		for i := 1; i < len(half); i++ {
+			n.link(half[i], half[i/2])
+		}
+		n.link(half[0], half[len(half)-1])
+	}
+	left, right := halves[0], halves[1]
+	n.link(left[5], right[0])
+	if n.unlink(left[5], right[0]) {
+		t.Fatal("the network is not split")
+	}
+
+	before := n.deliveries()
+	n.as(n.sites[left[2]], n.sites[left[2]].startCensus)
+	n.deliver()
+	// the census of a site alone in its partition ends without any link
+	alone := n.sites[right[3]]
+	n.as(alone, func() { unregisterAllConns(&alone.connectedSites) })
+	n.as(alone, alone.startCensus)
+
+	check := func(half, others []string) {
+		for _, siteID := range half {
+			site := n.sites[siteID]
+			for _, other := range others {
+				if slices.Contains(site.knownSites, other) || !site.partitionedSites[other] {
+					t.Errorf("site %s still knows %s (partitioned: %v)", siteID, other, site.partitionedSites[other])
+				}
+			}
+			if got := n.deliveries()[siteID] - before[siteID]; got != 1 {
+				t.Errorf("site %s gave %d messages to its controller, want the partition only", siteID, got)
+			}
+		}
+	}
+	check(left, right)
+	check(right[3:4], append(left, right[:3]...))
+
+	request := &protocol.AccessRequest{SiteID: left[5], Partitioned: right}
+	n.as(alone, func() {
+		if merge, err := alone.mergeNeeded(request); !merge || err != nil {
+			t.Errorf("site of another partition not admitted for a merge: %v, %v", merge, err)
+		}
+	})
+	n.as(n.sites[right[0]], func() {
+		if _, err := n.sites[right[0]].mergeNeeded(request); !errors.Is(err, errPartitionUndetected) {
+			t.Errorf("site which does not know the partition yet gave %v, want %v", err, errPartitionUndetected)
+		}
+	})
+}
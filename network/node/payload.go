@@ -0,0 +1,96 @@
+package node
+
+import (
+	"protocol"
+)
+
+// wavePayload is the content of a wave in the encodings already computed, so
+// that it is encoded once per site and not once per neighbor, and forwarded
+// as received instead of being decoded and encoded again at every hop
+type wavePayload struct {
+	encoded map[string]string // mct value by compression, NoCompression is the plain json
+}
+
+func newWavePayload(content protocol.Message) *wavePayload {
+	plain, _ := msgToJSON(protocol.Marshal(content), true)
+	return &wavePayload{encoded: map[string]string{protocol.NoCompression: plain}}
+}
+
+// readWavePayload returns the payload of a diffusion message and the
+// controller message it carries
+func readWavePayload(msg *protocol.Diffusion) (*wavePayload, protocol.Message, error) {
+	return readPayload(msg.Content, msg.Compression)
+}
+
+// readPayload returns the payload of a mct field compressed with compression,
+// and the controller message it carries
+func readPayload(value string, compression string) (*wavePayload, protocol.Message, error) {
+	if compression == "" {
+		compression = protocol.NoCompression
+	}
+	payload := &wavePayload{encoded: map[string]string{compression: value}}
+	plain, err := payload.plain()
+	if err != nil {
+		return nil, nil, err
+	}
+	line, err := jsonToMsg(plain, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := protocol.Decode(line, protocol.Wave)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, content, nil
+}
+
+func (p *wavePayload) plain() (string, error) {
+	if plain, ok := p.encoded[protocol.NoCompression]; ok {
+		return plain, nil
+	}
+	for compression, value := range p.encoded {
+		plain, err := protocol.Decompress(compression, value)
+		if err != nil {
+			return "", err
+		}
+		p.encoded[protocol.NoCompression] = plain
+		return plain, nil
+	}
+	return "", nil
+}
+
+// encode returns the payload for a link using compression, and the compression
+// actually applied ("" when the payload is sent as is)
+func (p *wavePayload) encode(compression string, minSize int) (string, string, error) {
+	if value, ok := p.encoded[compression]; ok {
+		if compression == protocol.NoCompression {
+			compression = ""
+		}
+		return value, compression, nil
+	}
+	plain, err := p.plain()
+	if err != nil {
+		return "", "", err
+	}
+	value, used, err := compressField(compression, plain, minSize)
+	if err != nil {
+		return "", "", err
+	}
+	if used != "" {
+		p.encoded[compression] = value
+	}
+	return value, used, nil
+}
+
+// compressField compresses a upt or mct value when it is large enough and the
+// link supports it, it returns the compression applied ("" for none)
+func compressField(compression string, value string, minSize int) (string, string, error) {
+	if compression == "" || compression == protocol.NoCompression || minSize < 0 || len(value) < minSize {
+		return value, "", nil
+	}
+	compressed, err := protocol.Compress(compression, value)
+	if err != nil {
+		return "", "", err
+	}
+	return compressed, compression, nil
+}
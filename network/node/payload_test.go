@@ -0,0 +1,107 @@
+package node
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"protocol"
+)
+
+// releaseOfDocument returns the release message sent when a document of
+// size bytes is pasted in the editor
+func releaseOfDocument(size int) *protocol.ReleaseSc {
+	words := []string{"le", "texte", "partagé", "distributed", "editor", "site", "wave", "~", "`", "\\", "\n"}
+	rng := rand.New(rand.NewSource(1))
+	var text strings.Builder
+	for text.Len() < size {
+		text.WriteString(words[rng.Intn(len(words))])
+		text.WriteByte(' ')
+	}
+	diffs, _ := json.Marshal([]map[string]any{{"Pos": 0, "NbDeleted": 0, "NewText": text.String()}})
+	return &protocol.ReleaseSc{
+		Clock:  protocol.Clock{Stamp: 12, VectorialClock: map[string]int{"1": 4, "2": 7}},
+		SiteID: "1",
+		Text:   string(diffs),
+	}
+}
+
+func linkWith(compression string) *peerConn {
+	return &peerConn{capabilities: protocol.Choices{protocol.CapCompression: compression}}
+}
+
+func TestWavePayloadThroughCompressedLinks(t *testing.T) {
+	release := releaseOfDocument(100 << 10)
+	payload := newWavePayload(release)
+	site := newNode("1", io.Discard)
+	for _, compression := range []string{protocol.GzipCompression, protocol.NoCompression} {
+		sndmsg, err := site.prepareWaveMessages("1:message_0", BlueMsg, payload, linkWith(compression))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := protocol.Decode(protocol.Marshal(sndmsg), protocol.NetworkToNetwork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, content, err := readWavePayload(received.(*protocol.Diffusion))
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if !reflect.DeepEqual(content, release) {
+			t.Errorf("%s: the release message changed through the link", compression)
+		}
+	}
+}
+
+// BenchmarkWaveHop measures a site receiving a wave carrying a 1 MB document
+// and forwarding it to a neighbor. wire-B/op is the size of the message sent.
+func BenchmarkWaveHop(b *testing.B) {
+	release := releaseOfDocument(1 << 20)
+	site := newNode("1", io.Discard)
+	received := func(compression string) *protocol.Diffusion {
+		sndmsg, err := site.prepareWaveMessages("1:message_0", BlueMsg, newWavePayload(release), linkWith(compression))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return sndmsg
+	}
+
+	// content decoded and encoded again in json at every hop, without compression
+	b.Run("before", func(b *testing.B) {
+		msg := received(protocol.NoCompression)
+		var sent int
+		for i := 0; i < b.N; i++ {
+			line, _ := jsonToMsg(msg.Content, true)
+			content, err := protocol.Decode(line, protocol.ControlerToNetwork)
+			if err != nil {
+				b.Fatal(err)
+			}
+			formated, _ := msgToJSON(protocol.Marshal(content), true)
+			sent = len(protocol.Marshal(&protocol.Diffusion{ID: msg.ID, Color: BlueMsg, Content: formated, SiteID: site.id}))
+		}
+		b.ReportMetric(float64(sent), "wire-B/op")
+	})
+
+	for _, compression := range []string{protocol.NoCompression, protocol.GzipCompression} {
+		b.Run(compression, func(b *testing.B) {
+			msg := received(compression)
+			link := linkWith(compression)
+			var sent int
+			for i := 0; i < b.N; i++ {
+				payload, _, err := readWavePayload(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sndmsg, err := site.prepareWaveMessages(msg.ID, BlueMsg, payload, link)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sent = len(protocol.Marshal(sndmsg))
+			}
+			b.ReportMetric(float64(sent), "wire-B/op")
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"wire"
+)
+
+// Every link has its own queue of outgoing frames, written by its own
+// goroutine: a neighbor which does not read its messages never blocks the
+// event loop of the site
+
+var errQueueFull = errors.New("send queue full")
+
+// outFrame is a frame waiting to be sent, or a change of the link applied in
+// order with the frames queued before it
+type outFrame struct {
+	frame   string
+	framing wire.Framing // when set, the framing of the frames after it
+	close   bool         // close the connection once the frames before it are sent
+}
+
+// queueFrame gives a frame to the writer of the link. When the queue is full,
+// the link is closed (the neighbor reconnects) or the site waits for the
+// writer, as chosen by -queue-full
+func (conn *peerConn) queueFrame(out outFrame) error {
+	select {
+	case <-conn.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case conn.queue <- out:
+		return nil
+	default:
+	}
+	if conn.dropWhenFull && out.frame != "" {
+		display_w("Send queue of " + conn.RemoteAddr().String() + " full, closing the link")
+		conn.Close()
+		return errQueueFull
+	}
+	select {
+	case conn.queue <- out:
+		return nil
+	case <-conn.closed:
+		return net.ErrClosed
+	}
+}
+
+// writeFrames sends the queued frames until the link is closed
+func (conn *peerConn) writeFrames() {
+	for {
+		select {
+		case out := <-conn.queue:
+			conn.writeFrame(out)
+		case <-conn.closed:
+			return // the frames left are lost with the link
+		}
+	}
+}
+
+func (conn *peerConn) writeFrame(out outFrame) {
+	switch {
+	case out.close:
+		conn.Close()
+	case out.framing != "":
+		conn.writer.SetFraming(out.framing)
+	default:
+		if conn.stall > 0 {
+			conn.SetWriteDeadline(time.Now().Add(conn.stall))
+		}
+		if err := conn.writer.WriteFrame(out.frame); err != nil {
+			display_w("Cannot write to " + conn.RemoteAddr().String() + " : " + err.Error())
+			conn.Close()
+		}
+	}
+}
+
+// setWriteFraming switches the framing of the frames queued after the call
+func (conn *peerConn) setWriteFraming(framing wire.Framing) {
+	conn.queueFrame(outFrame{framing: framing})
+}
+
+// closeAfterSend closes the connection once the queued frames are sent
+func (conn *peerConn) closeAfterSend() {
+	conn.queueFrame(outFrame{close: true})
+}
+
+// Close closes the connection, the frames not sent yet are dropped
+func (conn *peerConn) Close() error {
+	err := net.ErrClosed
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		err = conn.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// stalledNeighbor links the site to a neighbor which never reads its messages
+func stalledNeighbor(t *testing.T, site *Node, siteID string) *peerConn {
+	link, neighbor := net.Pipe()
+	t.Cleanup(func() { neighbor.Close() })
+	conn := newPeerConn(link, site.config)
+	registerConn(siteID, conn, &site.connectedSites)
+	return conn
+}
+
+// countingNeighbor links the site to a neighbor, and returns the channel of
+// the types of the messages it reads
+func countingNeighbor(t *testing.T, site *Node, siteID string) <-chan string {
+	link, neighbor := net.Pipe()
+	t.Cleanup(func() { neighbor.Close() })
+	registerConn(siteID, newPeerConn(link, site.config), &site.connectedSites)
+	types := make(chan string, 1024)
+	go func() {
+		reader := wire.NewReader(neighbor)
+		for {
+			line, err := reader.ReadFrame()
+			if err != nil {
+				return
+			}
+			msg, err := protocol.Decode(line, protocol.NetworkToNetwork)
+			if err == nil {
+				types <- msg.Type()
+			}
+		}
+	}()
+	return types
+}
+
+// setQueue sets the queue of the links the site opens next
+func setQueue(site *Node, size int, policy string, stall time.Duration) {
+	site.config.sendQueue, site.config.queueFull, site.config.suspect = size, policy, stall
+}
+
+func TestStalledPeerDropped(t *testing.T) {
+	site, _ := setupWaves(t)
+	setQueue(site, 8, "drop", time.Minute)
+	stalled := stalledNeighbor(t, site, "2")
+	healthy := countingNeighbor(t, site, "3")
+
+	start := time.Now()
+	var err error
+	for range 20 {
+		if err = writeToConn(stalled, &protocol.Heartbeat{SiteID: site.id}); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("writing to a stalled neighbor gave %v, want %v", err, errQueueFull)
+	}
+	select {
+	case <-stalled.closed:
+	default:
+		t.Error("the link to the stalled neighbor is still open")
+	}
+
+	// the other neighbor still gets the messages of the site
+	for range 5 {
+		site.startWave(waveContent)
+	}
+	for i := range 5 {
+		select {
+		case typ := <-healthy:
+			if typ != protocol.DiffusionMessage {
+				t.Errorf("neighbor read %s, want %s", typ, protocol.DiffusionMessage)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("neighbor read %d messages, want 5", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the stalled neighbor held the site for %v", elapsed)
+	}
+}
+
+func TestStalledPeerBlocks(t *testing.T) {
+	stall := 200 * time.Millisecond
+	site, _ := setupWaves(t)
+	setQueue(site, 4, "block", stall)
+	stalled := stalledNeighbor(t, site, "2")
+
+	start := time.Now()
+	var err error
+	for range 20 {
+		if err = writeToConn(stalled, &protocol.Heartbeat{SiteID: site.id}); err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("writing to a stalled neighbor gave %v, want %v", err, net.ErrClosed)
+	}
+	if elapsed < stall || elapsed > 5*stall {
+		t.Errorf("the site waited %v for the stalled neighbor, want about %v", elapsed, stall)
+	}
+}
+
+// TestFramingSwitchQueued checks that the framing negotiated by mag is used
+// from the frame following it, even when the writer is behind
+func TestFramingSwitchQueued(t *testing.T) {
+	link, neighbor := net.Pipe()
+	defer neighbor.Close()
+	conn := newPeerConn(link, defaultConfig)
+	defer conn.Close()
+	conn.capabilities = protocol.Choices{protocol.CapFraming: string(wire.LengthFraming)}
+
+	grantAccess(conn, &protocol.AccessGranted{SiteID: "1"})
+	writeToConn(conn, &protocol.Heartbeat{SiteID: "1"})
+
+	reader := wire.NewReader(neighbor)
+	line, err := reader.ReadFrame()
+	if err != nil || !strings.Contains(line, protocol.MsgAccessGranted) {
+		t.Fatalf("first frame %q, %v, want the access granted", line, err)
+	}
+	reader.SetFraming(wire.LengthFraming)
+	line, err = reader.ReadFrame()
+	if err != nil || !strings.Contains(line, protocol.MsgHeartbeat) {
+		t.Fatalf("second frame %q, %v, want a length framed heartbeat", line, err)
+	}
+}
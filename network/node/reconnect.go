@@ -0,0 +1,92 @@
+package node
+
+import (
+	"strconv"
+	"time"
+
+	"protocol"
+)
+
+// backoff between two attempts to reconnect a lost neighbor
+const (
+	minReconnectDelay = 250 * time.Millisecond
+	maxReconnectDelay = 8 * time.Second
+)
+
+// linkLost is called when a link stops being read: if it was the link to a
+// neighbor, the neighbor is considered lost until it is reconnected
+func (n *Node) linkLost(conn *peerConn) {
+	for siteID, neighbor := range n.connectedSites {
+		if neighbor == conn {
+			n.loseLink(siteID)
+			return
+		}
+	}
+}
+
+// loseLink removes the link to a neighbor which may come back: the waves
+// waiting for it end without it, and the site which dialed the link dials it
+// again
+func (n *Node) loseLink(siteID string) {
+	conn := getAndRemoveConn(siteID, &n.connectedSites)
+	if conn == nil {
+		return
+	}
+	conn.Close()
+	n.lostSites[siteID] = time.Now()
+	n.display_w("Lost the link to " + siteID)
+	n.linkRemoved(siteID)
+	if conn.addr != "" {
+		go n.reconnectPeer(siteID, conn.addr)
+	}
+}
+
+// useLink registers the link to a site admitted in the network, in place of
+// the previous one if any, and tells the controller when it replaces a link
+// which was lost so that the messages missed in between are fetched again
+func (n *Node) useLink(siteID string, conn *peerConn) {
+	if old := n.connectedSites[siteID]; old != nil && old != conn {
+		n.loseLink(siteID) // the peer noticed the loss first
+	}
+	registerConn(siteID, conn, &n.connectedSites)
+	n.topologyChanged()
+	if _, lost := n.lostSites[siteID]; lost {
+		delete(n.lostSites, siteID)
+		n.display_w("Link to " + siteID + " restored")
+		n.writeMessage(&protocol.LinkRestored{SiteID: siteID})
+	}
+}
+
+// linkRemoved updates the state which depends on the link to a neighbor,
+// after the link was removed
+func (n *Node) linkRemoved(siteID string) {
+	n.settleWaves(siteID)
+	n.topologyChanged()
+	n.forgetRoutes(siteID)
+}
+
+// reconnectPeer dials a lost neighbor with an exponential backoff, until it is
+// reconnected (by either side) or has left the network. A neighbor considered
+// failed is still dialed, as it may be in another partition
+func (n *Node) reconnectPeer(siteID, addr string) {
+	delay := minReconnectDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		lost := false
+		n.do(func() {
+			_, lost = n.lostSites[siteID]
+			lost = (lost || n.partitionedSites[siteID]) && !n.isConnected(siteID)
+		})
+		if !lost {
+			return
+		}
+		conn, err := n.transport.dial(addr, maxReconnectDelay)
+		if err == nil && n.joinThrough(conn, addr, linkReconnect) {
+			return
+		}
+		if err != nil {
+			n.display_w("Cannot reconnect to " + siteID + " on " + addr + " (attempt " + strconv.Itoa(attempt) + ") : " + err.Error())
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
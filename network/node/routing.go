@@ -0,0 +1,98 @@
+package node
+
+import (
+	"strconv"
+	"strings"
+
+	"protocol"
+)
+
+const maxUnicastHops = 64 // a message which crossed more links follows a loop of stale routes, it is broadcast instead
+
+// learnRoute is called with the neighbor which sent the first blue message of
+// a wave: the wave came from its initiator through it, so it is a next hop
+// toward the initiator
+func (n *Node) learnRoute(diffusionID string, neighbor string) {
+	origin, _, found := strings.Cut(diffusionID, ":message_")
+	if found && origin != n.id && origin != neighbor {
+		n.routes[origin] = neighbor
+	}
+}
+
+// forgetRoutes removes the routes to a site and through it
+func (n *Node) forgetRoutes(siteID string) {
+	delete(n.routes, siteID)
+	for destID, hop := range n.routes {
+		if hop == siteID {
+			delete(n.routes, destID)
+		}
+	}
+}
+
+// nextHop returns the neighbor to send a message for destID to, "" when no
+// route is known
+func (n *Node) nextHop(destID string) string {
+	if n.isConnected(destID) {
+		return destID
+	}
+	if hop := n.routes[destID]; n.isConnected(hop) {
+		return hop
+	}
+	return ""
+}
+
+// sendUnicast sends a message of the controller toward its destination, and
+// reports whether a route was known
+func (n *Node) sendUnicast(msg protocol.Addressed) bool {
+	return n.forwardUnicast(&protocol.Unicast{SiteID: n.id, DestID: msg.Destination()}, newWavePayload(msg))
+}
+
+func (n *Node) forwardUnicast(msg *protocol.Unicast, payload *wavePayload) bool {
+	hop := n.nextHop(msg.DestID)
+	if hop == "" || msg.Hops >= maxUnicastHops {
+		return false
+	}
+	conn := n.connectedSites[hop]
+	content, compression, err := payload.encode(conn.capabilities.Get(protocol.CapCompression), conn.compressMin)
+	if err == nil {
+		err = writeToConn(conn, &protocol.Unicast{
+			SiteID:      msg.SiteID,
+			DestID:      msg.DestID,
+			Content:     content,
+			Compression: compression,
+			Hops:        msg.Hops + 1,
+		})
+	}
+	if err != nil {
+		n.display_e("Error sending message to " + hop + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// handleUnicast gives a message to the controller when this site is its
+// destination, and sends it on otherwise. When no route is known, it is
+// broadcast, and only its destination keeps it
+func (n *Node) handleUnicast(msg *protocol.Unicast, neighbor string) {
+	payload, content, err := readPayload(msg.Content, msg.Compression)
+	if err == nil {
+		if _, ok := content.(protocol.Addressed); !ok {
+			err = protocol.ErrNotAddressed
+		}
+	}
+	if err != nil {
+		n.display_e("Rejected unicast content from " + neighbor + " : " + err.Error())
+		return
+	}
+	if msg.SiteID != n.id && msg.SiteID != neighbor {
+		n.routes[msg.SiteID] = neighbor // the answer goes back the same way
+	}
+	if msg.DestID == n.id {
+		n.writeMessage(content)
+		return
+	}
+	if !n.forwardUnicast(msg, payload) {
+		n.display_w("No route to " + msg.DestID + " after " + strconv.Itoa(msg.Hops) + " hops, broadcasting the message of " + msg.SiteID)
+		n.startWave(content)
+	}
+}
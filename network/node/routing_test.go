@@ -0,0 +1,77 @@
+package node
+
+import (
+	"testing"
+
+	"protocol"
+)
+
+// received returns the sites whose controller got a message since before
+func received(n *simNetwork, before map[string]int) []string {
+	var sites []string
+	for siteID, count := range n.deliveries() {
+		if count > before[siteID] {
+			sites = append(sites, siteID)
+		}
+	}
+	return sites
+}
+
+func TestUnicastFollowsRoutes(t *testing.T) {
+	n := newSimNetwork(t, 20).randomLinks(3, 3)
+	for _, siteID := range n.ids {
+		n.broadcast(siteID) // the routes are learnt from the waves
+	}
+	for _, from := range n.ids {
+		for _, to := range n.ids {
+			if from == to {
+				continue
+			}
+			before := n.deliveries()
+			frames := n.send(from, &protocol.ReceiptSc{SiteID: from, DestID: to})
+			if got := received(n, before); len(got) != 1 || got[0] != to {
+				t.Fatalf("receipt from %s to %s given to the controllers of %v", from, to, got)
+			}
+			if frames >= len(n.ids) {
+				t.Errorf("receipt from %s to %s crossed %d links", from, to, frames)
+			}
+		}
+	}
+}
+
+func TestUnicastWithoutRoute(t *testing.T) {
+	n := newSimNetwork(t, 12).randomLinks(3, 4)
+	// a and b are neighbors, to is a neighbor of none of them
+	var a, b, to string
+	for _, siteID := range n.ids {
+		for neighbor := range n.sites[siteID].connectedSites {
+			for _, destID := range n.ids {
+				if destID != siteID && destID != neighbor && n.sites[siteID].connectedSites[destID] == nil && n.sites[neighbor].connectedSites[destID] == nil {
+					a, b, to = siteID, neighbor, destID
+				}
+			}
+		}
+	}
+	if a == "" {
+		t.Fatal("no pair of neighbors away from another site in this network")
+	}
+
+	// no wave taught the route yet: the message is broadcast
+	before := n.deliveries()
+	n.send(a, &protocol.CutReceipt{SiteID: a, DestID: to, KeyCut: "k", JsonCutData: "{}"})
+	if got := n.deliveries()[to] - before[to]; got != 1 {
+		t.Errorf("destination got the message %d times, want 1", got)
+	}
+
+	// stale routes make a loop between the two neighbors: the message is
+	// broadcast when it has crossed too many links
+	n.sites[a].routes[to] = b
+	n.sites[b].routes[to] = a
+	before = n.deliveries()
+	if frames := n.send(a, &protocol.ReceiptSc{SiteID: a, DestID: to}); frames < maxUnicastHops {
+		t.Errorf("looping message crossed %d links, want at least %d", frames, maxUnicastHops)
+	}
+	if got := n.deliveries()[to] - before[to]; got != 1 {
+		t.Errorf("destination got the looping message %d times, want 1", got)
+	}
+}
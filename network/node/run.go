@@ -0,0 +1,915 @@
+package node
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+type DiffusionStatus struct {
+	message protocol.Message
+	payload *wavePayload
+	parent  string
+	tree    string          // spanning tree the wave follows, "" when it is flooded
+	reached int             // sites which received the wave through this site, itself included
+	waiting map[string]bool // neighbors the blue message was sent to, which have not answered yet
+	sites   []string        // census: sites which answered through this site
+	started time.Time       // start of the wave, on its initiator
+}
+
+type WaitingObject struct {
+	Conn *peerConn
+	Addr string
+}
+type WaitingMap map[string]*WaitingObject
+
+// colors for diffusion
+const (
+	BlueMsg string = "blu"
+	RedMsg  string = "red"
+)
+
+// flags of the network, parsed by Run
+var flags = flag.NewFlagSet("network", flag.ExitOnError)
+
+var (
+	id          *string = flags.String("id", "0", "unique id of site (timestamp)") // get the timestamp id from site.sh
+	port        *int    = flags.Int("port", defaultPort, "port of site (default is 9000)")
+	listen      *string = flags.String("listen", "", "address to listen on, e.g. 192.168.1.10:9000 or [::]:9000 (default: every interface on -port)")
+	advertise   *string = flags.String("advertise", "", "address the other sites dial to reach this site, e.g. example.org:9000 or [2001:db8::1]:9000 (default: the host of -listen, or the IP of the machine)")
+	targets     *string = flags.String("targets", "", "comma-separated list of targets (e.g., 'hostA:portA,hostB:portB')")
+	compressMin *int    = flags.Int("compress-min", 4096, "minimum size in bytes of the texts compressed on the links which support it (-1 to disable)")
+	framing     *string = flags.String("framing", "line", "framing of the messages exchanged with the controller (line or len)")
+	certFile    *string = flags.String("cert", "", "certificate of the site for mutual TLS with its peers (PEM, see 'network certs')")
+	keyFile     *string = flags.String("key", "", "private key of the -cert certificate (PEM)")
+	caFile      *string = flags.String("ca", "", "certificate authority which signed the certificates of the peers (PEM); any site it signed may announce any site id")
+	secret      *string = flags.String("secret", "", "passphrase of the document, required to join the network through this site")
+	secretFile  *string = flags.String("secret-file", "", "file containing the passphrase of the document (instead of -secret)")
+)
+
+// failure detection. The periods are not negotiated with the neighbors: every
+// site of a network must use the same values
+var (
+	heartbeat *time.Duration = flags.Duration("heartbeat", time.Second, "interval between two heartbeats sent to each neighbor, the same on every site (0 to disable failure detection)")
+	suspect   *time.Duration = flags.Duration("suspect", 5*time.Second, "a neighbor silent for longer than this is considered lost, and its link is closed (also the time given to a TLS handshake)")
+	reconnect *time.Duration = flags.Duration("reconnect", 10*time.Second, "a lost neighbor which is not reconnected within this delay is considered failed")
+)
+
+// outgoing frames
+var (
+	sendQueue *int    = flags.Int("send-queue", 1024, "maximum number of messages waiting to be sent to a neighbor")
+	queueFull *string = flags.String("queue-full", "drop", "when the queue of a neighbor is full: drop (close its link, it reconnects) or block (wait for it to drain)")
+)
+
+// discovery of the sites on the LAN
+var (
+	discover     *bool          = flags.Bool("discover", false, "announce the site on the LAN, and join a site found there when there are no targets")
+	document     *string        = flags.String("document", "", "name of the document, only the sites of the same document are discovered (also written in the invitation links)")
+	discoverAddr *string        = flags.String("discover-addr", "239.255.77.77:9977", "multicast group of the announcements (or a unicast address, e.g. on loopback)")
+	discoverWait *time.Duration = flags.Duration("discover-wait", 3*time.Second, "how long a site without targets looks for other sites before starting alone")
+)
+
+var broadcastMode *string = flags.String("broadcast", "wave", "how the messages of the controller are broadcast: wave (echo over every link) or tree (echo over a spanning tree of the network)")
+
+var topologyFile *string = flags.String("topology", "", "file the neighbors of the site are written to on SIGUSR1, read by graph_generator (written in the log when empty), removed when the site is closed")
+
+var metricsAddr *string = flags.String("metrics", "", "address of the HTTP endpoint serving the metrics of the site in the Prometheus text format, e.g. 127.0.0.1:9100 (disabled when empty)")
+
+var inviteLink *string = flags.String("invite", "", "invitation link dte://host:port/<document>?token=<passphrase>, giving -targets, -document and -secret when they are not set")
+
+var socketDir *string = flags.String("socket", "", "directory of the Unix sockets of the site: wait for the controller on the socket of the network instead of using stdin and stdout")
+
+// Run runs the network of a site with the flags in args: it reads the
+// messages of its controller on in, and writes its messages to out (or on the
+// link opened by the controller with -socket). It returns once the site is
+// closed, or once the certificates of the certs command are written
+func Run(args []string, in io.Reader, out io.Writer) {
+	if len(args) > 0 && args[0] == "certs" {
+		if err := runCerts(args[1:]); err != nil {
+			display_e(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	flags.Parse(args)
+	if *inviteLink != "" {
+		if err := applyInvite(*inviteLink); err != nil {
+			display_e(err.Error())
+			os.Exit(1)
+		}
+	}
+	pipeFraming, err := wire.ParseFraming(*framing)
+	if err != nil {
+		display_e(err.Error())
+		os.Exit(1)
+	}
+	cfg := newConfig()
+	if cfg.broadcast != "wave" && cfg.broadcast != "tree" {
+		display_e("Unknown broadcast mode " + cfg.broadcast + " (wave or tree)")
+		os.Exit(1)
+	}
+	if cfg.heartbeat > 0 && cfg.suspect <= cfg.heartbeat {
+		display_e("-suspect must be longer than -heartbeat, or every neighbor is lost between two heartbeats")
+		os.Exit(1)
+	}
+	if cfg.queueFull != "drop" && cfg.queueFull != "block" {
+		display_e("Unknown queue policy " + cfg.queueFull + " (drop or block)")
+		os.Exit(1)
+	}
+	cfg.tls, err = loadTLSConfig(*certFile, *keyFile, *caFile)
+	if err != nil {
+		display_e("Cannot set up TLS: " + err.Error())
+		os.Exit(1)
+	}
+	if cfg.tls != nil {
+		cfg.capabilities[protocol.CapEncryption] = []string{"tls"}
+		display_d("Peer links use mutual TLS")
+	}
+	cfg.passphrase, err = readPassphrase(*secret, *secretFile)
+	if err == nil {
+		cfg.secretKey, err = loadSecret(cfg.passphrase)
+	}
+	if err != nil {
+		display_e("Cannot read the passphrase: " + err.Error())
+		os.Exit(1)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	listening, err := listenAddr()
+	if err != nil {
+		display_e("Cannot listen on " + *listen + ": " + err.Error())
+		os.Exit(1)
+	}
+	advertised, err := advertisedAddr(listening)
+	if err != nil {
+		display_e("Cannot advertise " + *advertise + ": " + err.Error())
+		os.Exit(1)
+	}
+	if *socketDir != "" {
+		conn, err := wire.AcceptSocket(wire.SocketPath(*socketDir, *id, wire.NetworkSocket))
+		if err != nil {
+			display_e("Cannot open the socket of the network: " + err.Error())
+			os.Exit(1)
+		}
+		in, out = conn, conn
+	}
+	stdin := wire.NewReader(in) // messages from the controller
+	stdin.SetFraming(pipeFraming)
+	n := newNode(*id, out)
+	n.config = cfg
+	n.addr = advertised
+	n.controller.SetFraming(pipeFraming)
+	go n.run()
+	go n.dumpTopologyOnSignal(*topologyFile)
+	// Setup signal handling
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		display_w(fmt.Sprintf("Received signal: %s", sig))
+		n.stop()
+	}()
+
+	targetsList := processTargetFlags(*targets)
+	if targetsList == nil && *discover {
+		targetsList = discoverTargets()
+	}
+
+	if targetsList == nil {
+		display_d("Starting as a primary site, no targets specified.")
+
+		// Send the launching message to the controller
+		n.do(func() { n.writeMessage(&protocol.Initialization{SiteID: "", Invite: n.invite()}) }) // convention for reception in app
+
+	} else {
+		display_d("Starting as a secondary site, connecting to targets starting with " + targetsList[0])
+		for _, addr := range targetsList {
+			n.connectToPeer(addr, linkTarget) // get the ID of the site that has been connected and etablish connection
+		}
+		connected := 0
+		n.do(func() { connected = len(n.connectedSites) })
+		if connected == 0 {
+			display_e("No connections established. Exiting.")
+			os.Exit(1)
+		}
+
+	}
+
+	// Listens on its own port
+	go n.startTCPServer(listening)
+	if *discover {
+		go announceSite(*discoverAddr, advertised)
+	}
+	// Wait a bit to ensure connections are established
+	time.Sleep(1 * time.Second)
+
+	// the node runs as long as its controller, or until the site leaves
+	go func() {
+		n.readController(stdin)
+		n.stop()
+	}()
+	<-n.quit
+	n.removeTopology(*topologyFile)
+	display_w("All connections unregistered. Exiting.")
+}
+
+// startTCPServer accepts the links of the other sites on addr, until the node
+// is closed
+func (n *Node) startTCPServer(addr string) {
+	ln, err := n.transport.listen(addr)
+	if err != nil {
+		n.display_e("Server error: " + err.Error())
+		n.stop()
+		return
+	}
+	go func() {
+		<-n.quit
+		ln.Close()
+	}()
+	n.display_d("Listening on " + ln.Addr().String() + ", advertised as " + n.addr + "...")
+	n.serve(ln)
+}
+
+// serve reads the connections accepted on ln, until it is closed
+func (n *Node) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			n.display_e("Accept error: " + err.Error())
+			continue
+		}
+		addr := conn.RemoteAddr().String()
+		n.display_d("New connection from " + addr)
+		go func() {
+			conn, err := secureConn(conn, n.config.tls, false, n.config.suspect)
+			if err != nil {
+				n.display_e("TLS handshake with " + addr + " failed : " + err.Error())
+				return
+			}
+			peer := newPeerConn(conn, n.config)
+			peer.origin = linkAccepted
+			n.do(func() { registerConn(addr, peer, &n.connectedSitesWaitingAdmission) })
+			n.readConn(peer, addr)
+		}()
+	}
+}
+
+func (n *Node) connectToPeer(addr string, origin string) {
+
+	// Avoid connecting to the same peer multiple times
+	connected := false
+	n.do(func() { connected = n.isConnected(addr) })
+	if connected {
+		return
+	}
+
+	// Try to connect with retries (for progressive joining)
+	maxRetries := 30
+	retryDelay := 1000 * time.Millisecond
+	var conn net.Conn
+	var err error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		conn, err = n.transport.dial(addr, 0)
+		if err != nil {
+			if attempt == 0 {
+				n.display_w(fmt.Sprintf("Waiting for peer on %s to become available...", addr))
+			}
+			time.Sleep(retryDelay)
+			continue
+		}
+		n.display_w("Connected to peer on " + addr)
+		break
+	}
+	// connection established send access request to network
+	if conn == nil {
+		n.display_e(fmt.Sprintf("Failed to connect to %s after %d attempts", addr, maxRetries))
+		return
+	}
+	n.joinThrough(conn, addr, origin)
+}
+
+// joinThrough runs the access handshake on a new link to addr, and starts
+// reading it when the access is granted. origin tells why the link was dialed
+func (n *Node) joinThrough(conn net.Conn, addr string, origin string) bool {
+	conn, err := secureConn(conn, n.config.tls, true, n.config.suspect)
+	if err != nil {
+		n.display_e("TLS handshake with " + addr + " failed : " + err.Error())
+		return false
+	}
+
+	peer := newPeerConn(conn, n.config)
+	peer.addr = addr
+	peer.listening = addr
+	peer.origin = origin
+	request := &protocol.AccessRequest{SiteID: n.id, Version: protocol.Version, Capabilities: n.config.capabilities, Addr: n.addr}
+	if n.config.secretKey != nil {
+		request.Nonce = newNonce()
+	}
+	authenticated := false // the site answering knows the passphrase
+	n.do(func() { request.Partitioned = n.partitionedList() })
+	writeToConn(peer, request)
+	n.display_d("Connected to " + addr + ", access request demanded")
+	// Wait for admission response, nothing else is sent on the connection before it
+	for {
+		line, err := peer.readFrame()
+		if err != nil {
+			reportReadError(addr, err)
+			peer.Close()
+			return false
+		}
+		msg, err := protocol.Decode(line, protocol.NetworkToNetwork)
+		if err != nil {
+			n.display_e("Rejected message from " + addr + " : " + err.Error())
+			continue
+		}
+		messagesReceived.Inc("peer", msg.Type())
+		if denied, ok := msg.(*protocol.AccessDenied); ok {
+			n.display_e("Access to the network refused by " + addr + " (sender ID: " + denied.SiteID + ") : " + denied.Reason)
+			peer.Close()
+			return false
+		}
+		if challenge, ok := msg.(*protocol.Challenge); ok {
+			if n.config.secretKey == nil {
+				n.display_e("Cannot join the network through " + addr + " : " + errPassphraseRequired.Error() + " (-secret)")
+				peer.Close()
+				return false
+			}
+			if !validProof(n.config.secretKey, acceptorProof, request.Nonce, challenge.SiteID, challenge.Proof) {
+				n.display_e("Cannot join the network through " + addr + " : the site does not know the passphrase of the document")
+				peer.Close()
+				return false
+			}
+			authenticated = true
+			writeToConn(peer, &protocol.ChallengeResponse{SiteID: n.id, Proof: proof(n.config.secretKey, joinerProof, challenge.Nonce, n.id)})
+			continue
+		}
+		granted, ok := msg.(*protocol.AccessGranted)
+		if !ok {
+			continue
+		}
+		if n.config.secretKey != nil && !authenticated {
+			n.display_e("Cannot join the network through " + addr + " : the site did not check the passphrase of the document")
+			peer.Close()
+			return false
+		}
+		if err := useGrantedCapabilities(peer, granted, n.config.capabilities); err != nil {
+			n.display_e("Cannot use the network joined through " + addr + " : " + err.Error())
+			peer.Close()
+			return false
+		}
+		n.do(func() { n.useGrantedAccess(peer, addr, granted) })
+		go n.readConn(peer, addr)
+		return true
+	}
+}
+
+// useGrantedAccess registers the link to the site which granted access, and
+// joins the network through it the first time
+func (n *Node) useGrantedAccess(peer *peerConn, addr string, granted *protocol.AccessGranted) {
+	if granted.Merge {
+		n.mergeLink(granted.SiteID, peer)
+		return
+	}
+	//also add the known site of the sender
+	if len(granted.KnownSites) == 0 { //correspond to case 2 : current site is already in the network
+		// so we already have the shared text and the known sites of the network
+		n.display_d("Already in the network, access granted by a new connection " + addr + " (sender ID: " + granted.SiteID + ")")
+	} else { // case 1 or 3 : we are a new site in the network
+		n.display_d("Access granted to the network by " + addr + " (sender ID: " + granted.SiteID + ")")
+		n.addKnownSite(granted.SiteID) //add the other site to known sites
+		for _, site := range granted.KnownSites {
+			if site != "" {
+				// add all the known site to the list
+				n.addKnownSite(site)
+			}
+		}
+		// send the known site list to the controleur
+		n.writeMessage(&protocol.Initialization{
+			KnownSites: n.knownSites,
+			SiteID:     n.id,
+			Text:       granted.Text,
+			Released:   granted.Released,
+			Invite:     n.invite(),
+		})
+	}
+	n.useLink(granted.SiteID, peer)
+}
+
+func (n *Node) readConn(conn *peerConn, addr string) {
+	defer conn.Close()
+
+	// Message processing loop
+	for {
+		line, err := conn.readFrame()
+		if err != nil {
+			reportReadError(addr, err)
+			select {
+			case n.closedLinks <- conn:
+			case <-n.quit:
+			}
+			return
+		}
+		msg, err := protocol.Decode(line, protocol.NetworkToNetwork)
+		if err != nil {
+			n.display_e("Rejected message from " + addr + " : " + err.Error())
+			continue
+		}
+		messagesReceived.Inc("peer", msg.Type())
+		switch msg.(type) {
+		case *protocol.AccessRequest, *protocol.ChallengeResponse:
+			// the framing of the link may change before its next frame is read
+			n.do(func() { n.handlePeerMessage(conn, addr, msg) })
+		default:
+			select {
+			case n.peerMessages <- peerMessage{conn, addr, msg}:
+			case <-n.quit:
+				return
+			}
+		}
+	}
+}
+
+// handlePeerMessage handles a message received from a peer
+func (n *Node) handlePeerMessage(conn *peerConn, addr string, msg protocol.Message) {
+	switch msg := msg.(type) {
+	case *protocol.AccessRequest:
+		n.handleAccessRequest(conn, addr, msg)
+	case *protocol.ChallengeResponse:
+		n.handleChallengeResponse(conn, addr, msg)
+	case *protocol.Heartbeat:
+		// nothing to do, the connection is known to be alive
+	case *protocol.Diffusion:
+		// the wave is answered on the link it arrived on, whatever the site id
+		// written in the message
+		if neighbor := n.neighborID(conn); neighbor != "" {
+			n.handleDiffusion(msg, neighbor)
+		} else {
+			n.display_e("Rejected diffusion message from " + addr + " : the site has not been admitted")
+		}
+	case *protocol.TreeChild:
+		if n.isAdmitted(conn) {
+			n.handleTreeChild(msg)
+		}
+	case *protocol.TreeStale:
+		if n.isAdmitted(conn) {
+			n.handleTreeStale(msg)
+		}
+	case *protocol.Unicast:
+		if neighbor := n.neighborID(conn); neighbor != "" {
+			n.handleUnicast(msg, neighbor)
+		} else {
+			n.display_e("Rejected unicast message from " + addr + " : the site has not been admitted")
+		}
+	}
+}
+
+// reportReadError logs why the connection to addr stopped being read
+func reportReadError(addr string, err error) {
+	if errors.Is(err, wire.ErrFrameTooLarge) {
+		display_e("Closing connection to " + addr + " : " + err.Error())
+	} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		display_e("Error reading from " + addr + " : " + err.Error())
+	}
+}
+
+func (n *Node) handleAccessRequest(conn *peerConn, addr string, msg *protocol.AccessRequest) {
+	senderId := msg.SiteID
+	n.display_d("Received access request from " + addr + " (sender ID: " + senderId + ")")
+	conn.listening = msg.Addr
+	if err := acceptPeer(conn, msg, n.config.capabilities); err != nil {
+		n.display_e("Refusing access to " + addr + " (sender ID: " + senderId + ") : " + err.Error())
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.denyAccess(conn, err)
+		return
+	}
+	if n.config.secretKey != nil { // the site must prove it knows the passphrase before being admitted
+		if msg.Nonce == "" {
+			n.display_e("Refusing access to " + addr + " (sender ID: " + senderId + ") : no passphrase")
+			_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+			n.denyAccess(conn, errPassphraseRequired)
+			return
+		}
+		conn.challenge = newNonce()
+		conn.pending = msg
+		writeToConn(conn, &protocol.Challenge{SiteID: n.id, Nonce: conn.challenge, Proof: proof(n.config.secretKey, acceptorProof, msg.Nonce, n.id)})
+		return
+	}
+	n.admitSite(conn, addr, msg)
+}
+
+func (n *Node) handleChallengeResponse(conn *peerConn, addr string, msg *protocol.ChallengeResponse) {
+	request := conn.pending
+	if request == nil || request.SiteID != msg.SiteID {
+		n.display_e("Rejected challenge response from " + addr + " : no challenge sent to " + msg.SiteID)
+		return
+	}
+	conn.pending = nil
+	if !validProof(n.config.secretKey, joinerProof, conn.challenge, msg.SiteID, msg.Proof) {
+		n.display_e("Refusing access to " + addr + " (sender ID: " + msg.SiteID + ") : " + errWrongPassphrase.Error())
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.denyAccess(conn, errWrongPassphrase)
+		return
+	}
+	n.admitSite(conn, addr, request)
+}
+
+// admitSite grants access to a site whose access request has been accepted
+func (n *Node) admitSite(conn *peerConn, addr string, msg *protocol.AccessRequest) {
+	senderId := msg.SiteID
+	// the requesting site waits for mag before sending anything else, so the
+	// negotiated framing is used to read right away
+	conn.reader.SetFraming(conn.framing())
+	merge, err := n.mergeNeeded(msg)
+	if err != nil {
+		n.display_w("Refusing access to " + addr + " (sender ID: " + senderId + ") : " + err.Error())
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.denyAccess(conn, err)
+		return
+	}
+	if merge { // the site is in another partition : both documents are merged before it is known again
+		n.display_d("Granting access to " + addr + " (sender ID: " + senderId + ") of another partition")
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.mergeLink(senderId, conn)
+		grantAccess(conn, &protocol.AccessGranted{SiteID: n.id, Merge: true})
+	} else if len(n.connectedSites) == 0 && !n.isKnownSite(senderId) { // case 1 : solo primary site (not a lost neighbor coming back)
+		// If no connected sites, automatically grant access
+		n.display_d("No connected sites. Automatically granting access to " + addr + " (sender ID: " + senderId + ") : waiting for application to send the shared text")
+		n.addWaitingSiteMap(senderId, conn, addr)
+		// hear we pass the senderId to the new site to get it again when obtaining the text
+		n.writeMessage(&protocol.SharedText{SiteID: senderId})
+
+	} else if n.isKnownSite(senderId) { // case 2 : known site : it is already in the network and have the shared text
+		// If the sender is a known site, grant access
+		n.display_d("Granting access to known site " + addr + " (sender ID: " + senderId + ")")
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.useLink(senderId, conn)
+		grantAccess(conn, &protocol.AccessGranted{SiteID: n.id})
+	} else { // case 3 : classic admission
+		// If the sender is not known and there are connected sites, add it to the waiting list in controller to wait for admission
+		// using the critical section protocol
+		n.display_d("Waiting for admission of " + addr + " by the network (sender ID: " + senderId + ")")
+		n.addWaitingSiteMap(senderId, conn, addr)
+		n.writeMessage(&protocol.AddSite{SiteID: senderId}) // send the message to the controleur to add the site in the critical section
+	}
+}
+
+// handleDiffusion handles a wave message received from the neighbor senderID
+func (n *Node) handleDiffusion(msg *protocol.Diffusion, senderID string) {
+	msg_diffusion_id := msg.ID
+	conn, ok := n.connectedSites[senderID]
+	if !ok {
+		n.display_e("Rejected diffusion message from " + senderID + " : not a neighbor")
+		return
+	}
+	current_diffusion_status := n.waves.get(msg_diffusion_id)
+
+	if current_diffusion_status == nil && n.waves.isCompleted(msg_diffusion_id) {
+		// late blue message of a wave already completed here : the sender waits for the answer
+		if msg.Color == BlueMsg {
+			payload, _, err := readWavePayload(msg)
+			if err == nil {
+				err = n.sendWaveMessage(conn, msg_diffusion_id, RedMsg, payload)
+			}
+			if err != nil {
+				n.display_e("Error sending message to " + senderID + ": " + err.Error())
+			}
+		}
+		return
+	}
+	if current_diffusion_status == nil {
+		// the content is only decoded the first time the wave is received
+		payload, content, err := readWavePayload(msg)
+		if err != nil {
+			n.display_e("Rejected diffusion content from " + senderID + " : " + err.Error())
+			return
+		}
+		switch content := content.(type) {
+		case *protocol.SiteFailed:
+			// failures are applied as soon as they are known, before counting the
+			// neighbors, and not at the end of the wave
+			n.handleSiteFailed(content)
+		case *protocol.Partition:
+			n.handlePartition(content)
+		}
+		current_diffusion_status = &DiffusionStatus{
+			message: content,
+			payload: payload,
+			parent:  "",
+		}
+		n.waves.add(msg_diffusion_id, current_diffusion_status)
+
+	}
+	content := current_diffusion_status.message
+	payload := current_diffusion_status.payload
+
+	if msg.Color == BlueMsg {
+		n.display_d("Received blue message from " + senderID + " with content: " + protocol.Marshal(content))
+		if current_diffusion_status.parent == "" {
+			// send message to the controleur + treat it if it is a MsgReleaseSc
+			if release, ok := content.(*protocol.ReleaseSc); ok {
+				n.rejoinSites(release) // sites of another partition, after a merge
+				// if there is sites added to the network, we need to add them to known sites and inform
+				// the controller
+				if len(release.SitesToAdd) > 0 { // we have sites to add to the network
+					for _, site := range release.SitesToAdd {
+						n.addKnownSite(site) // add the site to the known sites
+					}
+					// Send the new known sites to the controller to update his clock map
+					n.writeMessage(&protocol.KnownSites{KnownSites: n.knownSites, SiteID: n.id})
+					n.display_d("New sites added to the network by " + senderID + " : " + strings.Join(release.SitesToAdd, ", "))
+				}
+			}
+
+			// update diffusion status : only the neighbors reached now answer, a
+			// neighbor which joins later is not waited for
+			current_diffusion_status.parent = senderID
+			n.learnRoute(msg_diffusion_id, senderID)
+			current_diffusion_status.tree = msg.Tree
+			current_diffusion_status.reached = 1
+			neighbors := n.waveNeighbors(msg.Tree)
+			if build, ok := content.(*protocol.TreeBuild); ok && !n.joinTree(build, senderID) {
+				neighbors = nil // an older tree is not built further
+			}
+			current_diffusion_status.waiting = n.sendWaveMessages(neighbors, senderID, msg_diffusion_id, BlueMsg, payload, msg.Tree)
+
+			if len(current_diffusion_status.waiting) > 0 {
+				n.display_d("Forwarding blue message to neighbors, except the sender: " + senderID)
+			} else {
+				n.display_d("No more neighbors to forward the blue message, sending red message to parent: " + senderID)
+				n.endWave(msg_diffusion_id, current_diffusion_status)
+			}
+		} else {
+			// Has already received blue message for this diffusion : sites aren't related
+			err := n.sendWaveMessage(conn, msg_diffusion_id, RedMsg, payload)
+			if err != nil {
+				n.display_e("Error sending message to " + current_diffusion_status.parent + ": " + err.Error())
+				return
+			}
+			n.display_d("Already received blue message for this diffusion, sending red message to sender: " + senderID)
+		}
+
+	} else if msg.Color == RedMsg {
+		n.answerWave(msg_diffusion_id, current_diffusion_status, senderID, msg.Reached, msg.Sites)
+	} else {
+		n.display_e("Unknown diffusion color " + msg.Color + " from " + senderID)
+	}
+}
+
+// readController hands the messages of the controller read from in to the
+// event loop, until the controller closes the link
+func (n *Node) readController(in *wire.Reader) {
+	for {
+		line, err := in.ReadFrame()
+		if errors.Is(err, wire.ErrFrameTooLarge) {
+			n.display_e("Dropped message from controller : " + err.Error())
+			continue
+		} else if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				n.display_e("Error reading message from controller : " + err.Error())
+			}
+			return
+		}
+
+		msg, err := protocol.Decode(line, protocol.ControlerToNetwork)
+		if errors.Is(err, protocol.ErrNotAddressed) {
+			continue // message for the application
+		} else if err != nil {
+			n.display_e("Rejected message from controller " + line + " : " + err.Error())
+			continue
+		}
+		messagesReceived.Inc("controller", msg.Type())
+
+		select {
+		case n.controllerMessages <- msg:
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// handleControllerMessage handles a message received from the controller
+func (n *Node) handleControllerMessage(msg protocol.Message) {
+	switch msg := msg.(type) {
+	case *protocol.SharedText: // The demand for the current shared text has been received (case 1)
+		n.handleSharedText(msg)
+	default:
+		// Push the critical section message to the network (if any with more site than only the primary site)
+		// using the diffusion protocol
+		n.handleControllerBroadcast(msg)
+	}
+}
+
+func (n *Node) handleSharedText(msg *protocol.SharedText) {
+	for _, site := range msg.SitesToAdd {
+		n.addKnownSite(site)
+	}
+	// default send all the known site to be shure they are known by controleur to add it in his clock map
+	n.writeMessage(&protocol.KnownSites{KnownSites: n.knownSites, SiteID: n.id})
+
+	for _, site := range msg.SitesToAdd {
+		waiting, ok := n.waitingConnections[site]
+		if !ok {
+			n.display_e("No waiting connection for site " + site)
+			continue
+		}
+		addr := waiting.Addr
+		conn := waiting.Conn
+		delete(n.waitingConnections, site) // remove the waiting connection
+		_ = getAndRemoveConn(addr, &n.connectedSitesWaitingAdmission)
+		n.useLink(site, conn)
+		grantAccess(conn, &protocol.AccessGranted{
+			SiteID:     n.id,         // we send our id to the site which asked to join the network
+			KnownSites: n.knownSites, // Send all the known sites to the new sites of the network
+			Text:       msg.Text,
+			Released:   msg.Released,
+		})
+	}
+}
+
+func (n *Node) handleControllerBroadcast(msg protocol.Message) {
+	release, isRelease := msg.(*protocol.ReleaseSc)
+	if len(n.connectedSites) == 0 {
+		n.display_d("No connected sites to send the message: " + protocol.Marshal(msg))
+		// return the message to the controller
+		n.writeMessage(msg)
+
+		if isRelease && release.Close {
+			n.display_w("Application has been closed and site is alone in the network, closing connection")
+			n.close()
+		}
+		return
+	}
+	if isRelease {
+		n.rejoinSites(release)
+	}
+	if addressed, ok := msg.(protocol.Addressed); ok && n.sendUnicast(addressed) {
+		return // sent toward its destination only
+	}
+
+	if isRelease && release.Close {
+		n.display_w("Application has been closed, site needs to inform the network")
+
+		// Extract addresses from connected sites
+		addresses := make(map[string]string)
+		for idConn, conn := range n.connectedSites {
+			if conn != nil && idConn != n.id && conn.listening != "" {
+				addresses[idConn] = conn.listening // the port of RemoteAddr is the one it dialed from
+			}
+		}
+		release.CloseAddresses = addresses
+	}
+	n.startWave(msg)
+}
+
+// answerWave counts the red message of a neighbor, and ends the wave for this
+// site when no other neighbor is expected to answer
+func (n *Node) answerWave(diffusionID string, status *DiffusionStatus, siteID string, reached int, sites []string) {
+	if !status.waiting[siteID] {
+		return // not waited for, or already counted
+	}
+	delete(status.waiting, siteID)
+	status.reached += reached
+	status.sites = append(status.sites, sites...)
+	if len(status.waiting) == 0 {
+		n.endWave(diffusionID, status)
+	}
+}
+
+// endWave ends a wave for this site: the red message goes back to the parent,
+// if it is still connected, and the content is delivered to the controller
+func (n *Node) endWave(diffusionID string, status *DiffusionStatus) {
+	n.waves.complete(diffusionID)
+	_, census := status.message.(*protocol.Census)
+	if status.parent == n.id {
+		waveEnded(status)
+		if census {
+			n.censusDone(status.sites)
+			return
+		}
+		if status.tree != "" && status.reached < n.networkSize() {
+			// the tree changed during the wave : the sites it missed get the message by a flood
+			n.display_w(fmt.Sprintf("Wave %s reached %d sites of %d along spanning tree %s, flooding it", diffusionID, status.reached, n.networkSize(), status.tree))
+			n.startWaveAlong(status.message, "")
+			return
+		}
+		// send message to the controleur
+		n.deliverWaveContent(status.message)
+		n.display_d("END of diffusion for message ID " + diffusionID)
+		return
+	}
+	// forward the message to the wave initiator by passsing it to the parent
+	// send only to parent
+	if conn := n.connectedSites[status.parent]; conn != nil {
+		sndmsg, err := n.prepareWaveMessages(diffusionID, RedMsg, status.payload, conn)
+		if err == nil {
+			sndmsg.Reached = status.reached
+			if census {
+				sndmsg.Sites = append(status.sites, n.id)
+			}
+			err = writeToConn(conn, sndmsg)
+		}
+		if err != nil {
+			n.display_e("Error sending message to " + status.parent + ": " + err.Error())
+		}
+	}
+	n.deliverWaveContent(status.message) // transfer the message to the controller without the diffusion elements
+	n.display_d("No more neighbors from which to receive the red message, forwarding to parent: " + status.parent)
+}
+
+// startWave diffuses a message to every site of the network
+func (n *Node) startWave(msg protocol.Message) {
+	n.startWaveAlong(msg, n.broadcastTree())
+}
+
+// startWaveAlong diffuses a message along a spanning tree, or to every link
+// when treeID is ""
+func (n *Node) startWaveAlong(msg protocol.Message, treeID string) {
+	diffusionId := n.waves.newID(n.id)
+	diffusionStatus := &DiffusionStatus{
+		message: msg,
+		payload: newWavePayload(msg),
+		parent:  n.id,
+		tree:    treeID,
+		reached: 1,
+		started: time.Now(),
+	}
+	n.waves.add(diffusionId, diffusionStatus)
+	diffusionStatus.waiting = n.sendWaveMessages(n.waveNeighbors(diffusionStatus.tree), n.id, diffusionId, BlueMsg, diffusionStatus.payload, diffusionStatus.tree) // we send to all neighbors (sender id is current id by convention)
+	if len(diffusionStatus.waiting) == 0 {
+		n.endWave(diffusionId, diffusionStatus) // no neighbor could be reached
+		return
+	}
+	n.display_d("Starting wave diffusion")
+}
+
+// deliverWaveContent gives the content of a completed wave to the controller
+func (n *Node) deliverWaveContent(content protocol.Message) {
+	switch content := content.(type) {
+	case *protocol.SiteFailed, *protocol.Partition:
+		return // already delivered on reception
+	case *protocol.Census:
+		return // only counted by its initiator
+	case *protocol.TreeBuild:
+		n.treeBuilt(content) // not for the controller
+		return
+	}
+	if n.processRemovedSite(content) { // process the removed site if any
+		return // this site left, the node is closed
+	}
+	n.writeMessage(content)
+}
+
+// processRemovedSite handles the release of a site leaving the network. It
+// tells whether the site leaving is this one: its controller is then given
+// the release and the node closed
+func (n *Node) processRemovedSite(content protocol.Message) bool {
+	release, ok := content.(*protocol.ReleaseSc)
+	if !ok || release.CloseAddresses == nil {
+		return false
+	}
+	senderId := release.SiteID
+	if n.id == senderId { // if we are the sender, we need to close all connections
+		n.writeMessage(content) // transfer the message to the controller
+		// without the diffusion elements to inform it that it can close itself
+		n.display_w("Current site is closing, removing all connections")
+		n.close()
+		return true
+	} else {
+		n.display_w("Received close site message from " + senderId)
+		delete(n.lostSites, senderId)
+		delete(n.partitionedSites, senderId)
+		n.forgetRoutes(senderId)
+		n.delKnownSite(senderId)     // remove the site from the known sites
+		if n.isConnected(senderId) { // if the site is connected to the current site, we need
+			// to close the connection and recreate all the connections with his neighbors
+			conn := getAndRemoveConn(senderId, &n.connectedSites)
+			if conn != nil {
+				conn.Close()
+				n.display_w("Closed connection to " + senderId)
+			}
+			n.linkRemoved(senderId)
+
+			for siteId, addr := range release.CloseAddresses {
+				if siteId != n.id && addr != "" { // do not connect to itself
+					n.display_w("Reconnecting to " + siteId + " at address " + addr)
+					go n.connectToPeer(addr, linkRewire) // reconnect to the site at the given address
+				}
+			}
+		}
+	}
+	return false
+}
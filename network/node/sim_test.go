@@ -0,0 +1,252 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// simulated network of nodes in this process: the test delivers the frames
+// itself, one at a time, instead of the event loops of the nodes
+
+type simFrame struct {
+	from, to, frame string
+}
+
+// simConn is the end of a link, the frames written on it are queued
+type simConn struct {
+	net.Conn // unused, only Write, SetWriteDeadline and Close are called
+	network  *simNetwork
+	from, to string
+	pending  []byte
+}
+
+func (c *simConn) Write(p []byte) (int, error) {
+	c.pending = append(c.pending, p...)
+	for {
+		end := bytes.IndexByte(c.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		c.network.queue = append(c.network.queue, simFrame{c.from, c.to, string(c.pending[:end+1])})
+		c.pending = c.pending[end+1:]
+	}
+}
+
+func (c *simConn) Close() error { return nil }
+
+func (c *simConn) SetWriteDeadline(time.Time) error { return nil }
+
+type simSite struct {
+	*Node
+	ends      []*peerConn   // ends of the links opened by the site, their queued frames are sent after each message
+	delivered *frameCounter // messages given to the controller
+}
+
+type simNetwork struct {
+	sites  map[string]*simSite
+	ids    []string
+	links  int
+	queue  []simFrame
+	frames int // frames sent on the links
+}
+
+// newSimNetwork creates size sites, without links
+func newSimNetwork(tb testing.TB, size int) *simNetwork {
+	stderr.SetOutput(io.Discard)
+	n := &simNetwork{sites: make(map[string]*simSite)}
+	tb.Cleanup(func() {
+		for _, site := range n.sites {
+			close(site.quit) // the pending rebuilds are dropped
+		}
+		stderr.SetOutput(os.Stderr)
+	})
+
+	for i := range size {
+		siteID := fmt.Sprintf("site%03d", i)
+		delivered := &frameCounter{}
+		n.sites[siteID] = &simSite{Node: newNode(siteID, delivered), delivered: delivered}
+		n.ids = append(n.ids, siteID)
+	}
+	for _, site := range n.sites {
+		for _, other := range n.ids {
+			if other != site.id {
+				site.knownSites = append(site.knownSites, other)
+			}
+		}
+	}
+	return n
+}
+
+// setBroadcast sets how the sites broadcast, wave or tree
+func (n *simNetwork) setBroadcast(mode string) *simNetwork {
+	for _, site := range n.sites {
+		site.config.broadcast = mode
+	}
+	return n
+}
+
+// randomLinks links the sites like run.sh: each site joins between one and
+// maxTargets of the sites started before it
+func (n *simNetwork) randomLinks(maxTargets int, seed uint64) *simNetwork {
+	random := rand.New(rand.NewPCG(seed, 0))
+	for i := 1; i < len(n.ids); i++ {
+		targets := random.Perm(i)[:1+random.IntN(min(maxTargets, i))]
+		for _, target := range targets {
+			n.link(n.ids[i], n.ids[target])
+		}
+	}
+	return n
+}
+
+func (n *simNetwork) link(a, b string) {
+	for _, end := range [][2]string{{a, b}, {b, a}} {
+		site := n.sites[end[0]]
+		conn := makePeerConn(&simConn{network: n, from: end[0], to: end[1]}, site.config)
+		site.connectedSites[end[1]] = conn
+		site.ends = append(site.ends, conn)
+	}
+	n.links++
+}
+
+// as runs f as an event of the site, and sends the frames it queued
+func (n *simNetwork) as(site *simSite, f func()) {
+	f()
+	for _, conn := range site.ends {
+		for len(conn.queue) > 0 {
+			conn.writeFrame(<-conn.queue)
+		}
+	}
+}
+
+// deliver receives the queued frames until the network is quiet
+func (n *simNetwork) deliver() {
+	for len(n.queue) > 0 {
+		frame := n.queue[0]
+		n.queue = n.queue[1:]
+		n.frames++
+		site := n.sites[frame.to]
+		conn := site.connectedSites[frame.from]
+		if conn == nil {
+			continue // the link was closed
+		}
+		line, err := wire.NewReader(strings.NewReader(frame.frame)).ReadFrame()
+		if err != nil {
+			panic(err)
+		}
+		msg, err := protocol.Decode(line, protocol.NetworkToNetwork)
+		if err != nil {
+			panic(err)
+		}
+		n.as(site, func() { site.handlePeerMessage(conn, frame.from, msg) })
+	}
+}
+
+// run delivers the frames, and rebuilds the trees whose rebuild is pending
+// as their timers would, until the network is quiet
+func (n *simNetwork) run() {
+	for {
+		n.deliver()
+		rebuilt := false
+		for _, siteID := range n.ids {
+			if site := n.sites[siteID]; site.tree.rebuild != nil {
+				site.tree.rebuild.Stop()
+				site.tree.rebuild = nil
+				n.as(site, site.rebuildTree)
+				rebuilt = true
+			}
+		}
+		if !rebuilt {
+			return
+		}
+	}
+}
+
+// broadcast sends a message of the controller of siteID to the network, and
+// returns the number of frames sent on the links
+func (n *simNetwork) broadcast(siteID string) int {
+	frames := n.frames
+	site := n.sites[siteID]
+	n.as(site, func() { site.startWave(&protocol.RequestSc{SiteID: siteID}) })
+	n.deliver()
+	return n.frames - frames
+}
+
+// send gives a message of the controller of siteID to its network, and
+// returns the number of frames sent on the links
+func (n *simNetwork) send(siteID string, msg protocol.Message) int {
+	frames := n.frames
+	site := n.sites[siteID]
+	n.as(site, func() { site.handleControllerBroadcast(msg) })
+	n.deliver()
+	return n.frames - frames
+}
+
+// deliveries returns the number of messages given to its controller by each site
+func (n *simNetwork) deliveries() map[string]int {
+	counts := make(map[string]int)
+	for siteID, site := range n.sites {
+		counts[siteID] = site.delivered.frames
+	}
+	return counts
+}
+
+// unlink closes the link between a and b, and reports whether the network is
+// still connected
+func (n *simNetwork) unlink(a, b string) bool {
+	n.as(n.sites[a], func() { n.sites[a].loseLink(b) })
+	n.as(n.sites[b], func() { n.sites[b].loseLink(a) })
+	seen := map[string]bool{a: true}
+	next := []string{a}
+	for len(next) > 0 {
+		site := n.sites[next[0]]
+		next = next[1:]
+		for other := range site.connectedSites {
+			if !seen[other] {
+				seen[other] = true
+				next = append(next, other)
+			}
+		}
+	}
+	return len(seen) == len(n.sites)
+}
+
+// checkTree verifies that every site uses the same complete tree
+func (n *simNetwork) checkTree(t *testing.T) {
+	t.Helper()
+	treeID, edges := n.sites[n.ids[0]].tree.id(), 0
+	for _, siteID := range n.ids {
+		site := n.sites[siteID]
+		if !site.tree.stable || site.tree.id() != treeID {
+			t.Fatalf("site %s uses tree %s (stable: %v), want %s", siteID, site.tree.id(), site.tree.stable, treeID)
+		}
+		for child := range site.tree.children {
+			if n.sites[child].tree.parent != siteID {
+				t.Errorf("%s is a child of %s, but its parent is %q", child, siteID, n.sites[child].tree.parent)
+			}
+		}
+		edges += len(site.tree.children)
+	}
+	if edges != len(n.ids)-1 {
+		t.Errorf("tree %s has %d edges, want %d", treeID, edges, len(n.ids)-1)
+	}
+}
+
+// checkDelivered verifies that every site gave the broadcasts to its controller
+func (n *simNetwork) checkDelivered(t *testing.T, want int) {
+	t.Helper()
+	for _, siteID := range n.ids {
+		if got := n.sites[siteID].delivered.frames; got < want {
+			t.Errorf("site %s delivered %d broadcasts, want %d", siteID, got, want)
+		}
+	}
+}
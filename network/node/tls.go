@@ -0,0 +1,88 @@
+package node
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// loadTLSConfig returns the mutual TLS configuration of the peer links, or nil
+// when no certificate is given
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("-cert, -key and -ca must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+		// sites reconnect to each other with the addresses they see, which are
+		// not in the certificates: a peer only has to be signed by the CA. The
+		// certificate is not bound to the site id the peer announces either
+		InsecureSkipVerify: true,
+		VerifyConnection:   verifyPeer(pool),
+	}, nil
+}
+
+// verifyPeer checks that the certificate of a peer is signed by the CA
+func verifyPeer(pool *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: peer sent no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// secureConn runs the TLS handshake on a new peer connection when TLS is
+// configured, client is true for the site which dialed. A peer which does not
+// complete the handshake within timeout is dropped (no limit when 0)
+func secureConn(conn net.Conn, tlsConfig *tls.Config, client bool, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	var tlsConn *tls.Conn
+	if client {
+		tlsConn = tls.Client(conn, tlsConfig)
+	} else {
+		tlsConn = tls.Server(conn, tlsConfig)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,93 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The neighbors of a site are dumped on request (SIGUSR1) to the -topology
+// file, which graph_generator reads to draw the links as they are, after the
+// sites which left and the reconnections. The file is removed when the site
+// is closed
+
+// why a link was opened
+const (
+	linkTarget    = "target"    // dialed at startup (-targets or discovery)
+	linkAccepted  = "accepted"  // opened by the neighbor
+	linkReconnect = "reconnect" // dialed again after the link was lost
+	linkRewire    = "rewire"    // dialed when a common neighbor left the network
+)
+
+type topologyDump struct {
+	Site      string         `json:"site"`
+	Addr      string         `json:"addr,omitempty"`
+	Time      time.Time      `json:"time"`
+	Neighbors []neighborDump `json:"neighbors"`
+}
+
+type neighborDump struct {
+	Site   string    `json:"site"`
+	Addr   string    `json:"addr,omitempty"` // address it listens on
+	Origin string    `json:"origin"`
+	Since  time.Time `json:"since"`
+}
+
+// topology returns the current neighbors of the node
+func (n *Node) topology() topologyDump {
+	dump := topologyDump{Site: n.id, Addr: n.addr, Time: time.Now(), Neighbors: []neighborDump{}}
+	for siteID, conn := range n.connectedSites {
+		if conn == nil {
+			continue
+		}
+		dump.Neighbors = append(dump.Neighbors, neighborDump{Site: siteID, Addr: conn.listening, Origin: conn.origin, Since: conn.opened})
+	}
+	slices.SortFunc(dump.Neighbors, func(a, b neighborDump) int { return strings.Compare(a.Site, b.Site) })
+	return dump
+}
+
+// dumpTopology writes the neighbors of the node to path, or to the log when
+// path is "". Nothing is written once the node is closed
+func (n *Node) dumpTopology(path string) {
+	var dump topologyDump
+	closed := true
+	n.do(func() { dump, closed = n.topology(), false })
+	if closed {
+		return
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		n.display_e("Cannot dump the topology: " + err.Error())
+		return
+	}
+	if path == "" {
+		n.display_d("Topology: " + string(data))
+		return
+	}
+	// the file is replaced at once, graph_generator never reads half of it
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		n.display_e("Cannot dump the topology: " + err.Error())
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		n.display_e("Cannot dump the topology: " + err.Error())
+		return
+	}
+	n.display_d("Topology dumped to " + path)
+}
+
+// removeTopology removes the dump of a closed node, so that the site is no
+// longer drawn
+func (n *Node) removeTopology(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		n.display_e("Cannot remove the topology dump: " + err.Error())
+	}
+}
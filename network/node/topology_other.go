@@ -0,0 +1,6 @@
+//go:build !unix
+
+package node
+
+// dumpTopologyOnSignal does nothing: there is no SIGUSR1 on this system
+func (n *Node) dumpTopologyOnSignal(path string) {}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"protocol"
+)
+
+func TestTopologyDump(t *testing.T) {
+	outA, fromA := testController(t)
+	outB, fromB := testController(t)
+	a, b := newNode("a", outA), newNode("b", outB)
+	b.addr = "127.0.0.1:9124"
+	for _, site := range []*Node{a, b} {
+		go site.run()
+		t.Cleanup(site.stop)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go a.serve(ln)
+	go b.connectToPeer(ln.Addr().String(), linkReconnect)
+	expect[*protocol.SharedText](t, a.id, fromA)
+	a.controllerMessages <- &protocol.SharedText{SitesToAdd: []string{b.id}, Text: "shared"}
+	expect[*protocol.Initialization](t, b.id, fromB)
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		site             *Node
+		neighbor, origin string
+		addr             string
+	}{
+		{a, b.id, linkAccepted, b.addr},
+		{b, a.id, linkReconnect, ln.Addr().String()},
+	} {
+		path := filepath.Join(dir, tc.site.id+"_topology.json")
+		tc.site.dumpTopology(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dump topologyDump
+		if err := json.Unmarshal(data, &dump); err != nil {
+			t.Fatalf("site %s: %v", tc.site.id, err)
+		}
+		if dump.Site != tc.site.id || len(dump.Neighbors) != 1 {
+			t.Fatalf("site %s dumped %+v, want one neighbor", tc.site.id, dump)
+		}
+		if got := dump.Neighbors[0]; got.Site != tc.neighbor || got.Origin != tc.origin || got.Addr != tc.addr {
+			t.Errorf("site %s dumped the neighbor %+v, want %s %s on %s", tc.site.id, got, tc.neighbor, tc.origin, tc.addr)
+		}
+	}
+}
+
+// TestTopologyRemoved removes the dump of a closed node, and writes no other
+func TestTopologyRemoved(t *testing.T) {
+	out, _ := testController(t)
+	site := newNode("a", out)
+	go site.run()
+	path := filepath.Join(t.TempDir(), "a_topology.json")
+	site.dumpTopology(path)
+	site.stop()
+	site.removeTopology(path)
+	site.dumpTopology(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("dump of a closed node still there: %v", err)
+	}
+	site.removeTopology(path) // already removed
+}
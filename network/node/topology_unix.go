@@ -0,0 +1,19 @@
+//go:build unix
+
+package node
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpTopologyOnSignal dumps the neighbors of the node each time the process
+// receives SIGUSR1
+func (n *Node) dumpTopologyOnSignal(path string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		n.dumpTopology(path)
+	}
+}
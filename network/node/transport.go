@@ -0,0 +1,25 @@
+package node
+
+import (
+	"net"
+	"time"
+)
+
+// transport opens the links between sites: TCP, or memory links in the tests
+// (see memnet_test.go), so that a node never opens a port itself
+type transport interface {
+	listen(addr string) (net.Listener, error)
+	// dial opens a link to the site listening on addr, waiting at most timeout
+	// (no limit when 0)
+	dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
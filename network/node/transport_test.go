@@ -0,0 +1,433 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"protocol"
+	"wire"
+)
+
+// memSite is a node linked to the others by the memory transport
+type memSite struct {
+	*Node
+	messages <-chan protocol.Message // messages given to its controller
+}
+
+// newMemSite starts a node listening on addr of the memory network
+func newMemSite(t *testing.T, network *memNetwork, id, addr string, cfg config) *memSite {
+	out, messages := testController(t)
+	n := newNode(id, out)
+	n.config = cfg
+	n.addr = addr
+	n.transport = network.host(addr)
+	ln, err := n.transport.listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.run()
+	go n.serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+		n.stop()
+	})
+	return &memSite{n, messages}
+}
+
+// join admits the site in the network through the site listening on through.
+// The controller of through stands for the controllers of the network: alone,
+// it gives the shared text at once, otherwise it releases a section adding
+// the site first, like after an AddSite
+func (site *memSite) join(t *testing.T, through *memSite) {
+	t.Helper()
+	go site.connectToPeer(through.addr, linkTarget)
+	timeout := time.After(5 * time.Second)
+	asked := ""
+	for asked == "" {
+		select {
+		case msg := <-through.messages:
+			switch msg := msg.(type) {
+			case *protocol.AddSite:
+				asked = msg.SiteID
+				through.controllerMessages <- &protocol.ReleaseSc{SiteID: through.id, Clock: protocol.Clock{VectorialClock: map[string]int{}}, SitesToAdd: []string{msg.SiteID}}
+			case *protocol.SharedText:
+				asked = msg.SiteID
+			}
+		case <-timeout:
+			t.Fatalf("site %s never asked to admit %s", through.id, site.id)
+		}
+	}
+	if asked != site.id {
+		t.Fatalf("site %s admits %q, want %q", through.id, asked, site.id)
+	}
+	through.controllerMessages <- &protocol.SharedText{SitesToAdd: []string{site.id}, Text: "shared"}
+	if init := expect[*protocol.Initialization](t, site.id, site.messages); init.Text != "shared" {
+		t.Errorf("site %s joined with the text %q, want %q", site.id, init.Text, "shared")
+	}
+}
+
+// memLine starts size sites, each joining through the previous one, and
+// waits until every site knows the others
+func memLine(t *testing.T, network *memNetwork, size int, cfg config) []*memSite {
+	sites := make([]*memSite, size)
+	for i := range sites {
+		sites[i] = newMemSite(t, network, fmt.Sprint(i), fmt.Sprintf("site%d:9000", i), cfg)
+		if i > 0 {
+			sites[i].join(t, sites[i-1])
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, site := range sites {
+		for _, other := range sites {
+			for known := other == site; !known; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("site %s does not know site %s", site.id, other.id)
+				}
+				site.do(func() { known = site.isKnownSite(other.id) })
+			}
+		}
+	}
+	return sites
+}
+
+func request(siteID string, stamp int) *protocol.RequestSc {
+	return &protocol.RequestSc{SiteID: siteID, Clock: protocol.Clock{Stamp: stamp, VectorialClock: map[string]int{siteID: stamp}}}
+}
+
+// collectRequests reads the requests given to the controller of each site
+// until each has want of them, and for a little longer to catch the
+// duplicates. It returns the number of times each site got each request
+func collectRequests(t *testing.T, sites []*memSite, want int) []map[string]int {
+	t.Helper()
+	got := make([]map[string]int, len(sites))
+	for i, site := range sites {
+		got[i] = make(map[string]int)
+		total := 0
+		timeout := time.After(10 * time.Second)
+		var grace <-chan time.Time
+		for done := false; !done; {
+			select {
+			case msg := <-site.messages:
+				if req, ok := msg.(*protocol.RequestSc); ok {
+					got[i][fmt.Sprintf("%s@%d", req.SiteID, req.Clock.Stamp)]++
+					if total++; total == want {
+						grace = time.After(100 * time.Millisecond)
+					}
+				}
+			case <-grace:
+				done = true
+			case <-timeout:
+				t.Fatalf("site %s got %d requests, want %d: %v", site.id, total, want, got[i])
+			}
+		}
+	}
+	return got
+}
+
+// TestSiteLeaving closes the node of the site which leaves the network, and
+// only this one: the other nodes of the process go on without it
+func TestSiteLeaving(t *testing.T) {
+	network := newMemNetwork(1)
+	sites := memLine(t, network, 3, defaultConfig)
+	sites[1].controllerMessages <- &protocol.ReleaseSc{SiteID: "1", Clock: protocol.Clock{VectorialClock: map[string]int{"1": 1}}, Close: true}
+	select {
+	case <-sites[1].quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node still running after its site left")
+	}
+	for _, site := range []*memSite{sites[0], sites[2]} {
+		release := expect[*protocol.ReleaseSc](t, site.id, site.messages)
+		for !release.Close { // releases of the joins
+			release = expect[*protocol.ReleaseSc](t, site.id, site.messages)
+		}
+		if release.SiteID != "1" {
+			t.Errorf("site %s got the closing release of %q, want the one of the site leaving", site.id, release.SiteID)
+		}
+	}
+	// the neighbors of the site which left link to each other
+	for deadline := time.Now().Add(5 * time.Second); !network.linked(sites[0].addr, sites[2].addr); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("neighbors of the site which left not linked")
+		}
+	}
+	sites[0].do(func() {
+		if sites[0].isKnownSite("1") {
+			t.Error("site 1 still known after it left")
+		}
+	})
+}
+
+func TestAdmissionOverMemory(t *testing.T) {
+	network := newMemNetwork(1)
+	sites := memLine(t, network, 3, defaultConfig)
+	for i := 1; i < len(sites); i++ {
+		if !network.linked(sites[i-1].addr, sites[i].addr) {
+			t.Errorf("sites %s and %s not linked", sites[i-1].id, sites[i].id)
+		}
+	}
+
+	// a site which does not speak the protocol version is refused
+	conn, err := network.host("old:9000").dial(sites[2].addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wire.NewWriter(conn).WriteFrame(protocol.Marshal(&protocol.AccessRequest{SiteID: "old", Version: protocol.Version - 1}))
+	frame, err := wire.NewReader(conn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := protocol.Decode(frame, protocol.NetworkToNetwork); err != nil {
+		t.Fatal(err)
+	} else if _, denied := msg.(*protocol.AccessDenied); !denied {
+		t.Errorf("answer %T to an old site, want a denial", msg)
+	}
+}
+
+// TestWavesWithFaults broadcasts requests of every site while the links delay,
+// reorder and duplicate the frames: each site gives each request once to its
+// controller
+func TestWavesWithFaults(t *testing.T) {
+	for _, mode := range []string{"wave", "tree"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := defaultConfig
+			cfg.broadcast = mode
+			network := newMemNetwork(7)
+			sites := memLine(t, network, 4, cfg)
+			sites[3].connectToPeer(sites[0].addr, linkTarget) // a cycle, where the waves cross
+			if !network.linked(sites[3].addr, sites[0].addr) {
+				t.Fatal("sites 3 and 0 not linked")
+			}
+			network.setFaults(memFaults{latency: time.Millisecond, jitter: 5 * time.Millisecond, reorder: 0.2, duplicate: 0.2})
+
+			const perSite = 5
+			for i, site := range sites {
+				go func() {
+					for stamp := 1; stamp <= perSite; stamp++ {
+						site.controllerMessages <- request(site.id, stamp+10*i)
+					}
+				}()
+			}
+			for i, got := range collectRequests(t, sites, perSite*len(sites)) {
+				for key, count := range got {
+					if count != 1 {
+						t.Errorf("site %d got the request %s %d times", i, key, count)
+					}
+				}
+			}
+			if network.faultyFrames() == 0 {
+				t.Error("no faulty frame")
+			}
+		})
+	}
+}
+
+// TestLinkCut cuts a link of a line of sites: the site which dialed it dials
+// it again, and the broadcasts reach every site again once it is back
+func TestLinkCut(t *testing.T) {
+	network := newMemNetwork(3)
+	sites := memLine(t, network, 3, defaultConfig)
+	if n := network.cut(sites[1].addr, sites[2].addr); n != 1 {
+		t.Fatalf("cut %d links, want 1", n)
+	}
+	for lost := false; !lost; time.Sleep(10 * time.Millisecond) {
+		sites[2].do(func() { _, lost = sites[2].lostSites[sites[1].id] })
+	}
+	network.heal(sites[1].addr, sites[2].addr)
+	expect[*protocol.LinkRestored](t, sites[2].id, sites[2].messages)
+
+	var origin string
+	sites[2].do(func() {
+		if conn := sites[2].connectedSites[sites[1].id]; conn != nil {
+			origin = conn.origin
+		}
+	})
+	if origin != linkReconnect {
+		t.Errorf("link from 2 to 1 opened as %q, want %q", origin, linkReconnect)
+	}
+	sites[0].controllerMessages <- request(sites[0].id, 1)
+	collectRequests(t, sites, 1)
+}
+
+// countReleases counts the releases of siteID given to the controller of site
+// until it stays quiet
+func countReleases(site *memSite, siteID string) int {
+	count := 0
+	for {
+		select {
+		case msg := <-site.messages:
+			if release, ok := msg.(*protocol.ReleaseSc); ok && release.SiteID == siteID {
+				count++
+			}
+		case <-time.After(200 * time.Millisecond):
+			return count
+		}
+	}
+}
+
+// TestResyncAfterCut cuts a link of a line of sites while the first one
+// releases the critical section: the site behind the cut gets the release once
+// its controller asks for the releases missed, and only then
+func TestResyncAfterCut(t *testing.T) {
+	network := newMemNetwork(5)
+	sites := memLine(t, network, 3, defaultConfig)
+	network.cut(sites[1].addr, sites[2].addr)
+	for lost := false; !lost; time.Sleep(5 * time.Millisecond) {
+		sites[2].do(func() { _, lost = sites[2].lostSites[sites[1].id] })
+	}
+
+	release := &protocol.ReleaseSc{SiteID: sites[0].id, Clock: protocol.Clock{Stamp: 2, VectorialClock: map[string]int{sites[0].id: 1}}, Text: "[]"}
+	sites[0].controllerMessages <- release
+	if n := countReleases(sites[1], sites[0].id); n != 1 {
+		t.Errorf("site 1 got the release %d times, want 1", n)
+	}
+	if n := countReleases(sites[2], sites[0].id); n != 0 {
+		t.Errorf("site 2 got the release through a cut link")
+	}
+
+	network.heal(sites[1].addr, sites[2].addr)
+	expect[*protocol.LinkRestored](t, sites[2].id, sites[2].messages)
+	// the controllers of the sites behind the cut ask for the releases they
+	// missed, the one of the first site sends its release again
+	sites[2].controllerMessages <- &protocol.Resync{SiteID: sites[2].id, Released: map[string]int{}}
+	if resync := expect[*protocol.Resync](t, sites[0].id, sites[0].messages); resync.SiteID != sites[2].id {
+		t.Fatalf("resync of %q", resync.SiteID)
+	}
+	sites[0].controllerMessages <- release
+	if n := countReleases(sites[2], sites[0].id); n != 1 {
+		t.Errorf("site 2 got the release %d times after the resync, want 1", n)
+	}
+	// the others get it again, their controllers drop it
+	if n := countReleases(sites[1], sites[0].id); n != 1 {
+		t.Errorf("site 1 got the release sent again %d times, want 1", n)
+	}
+}
+
+// TestSiteFailure freezes the end of a line of sites: its neighbor closes the
+// silent link after -suspect, declares the site failed after -reconnect, and
+// the failure reaches every controller
+func TestSiteFailure(t *testing.T) {
+	cfg := defaultConfig
+	cfg.heartbeat, cfg.suspect, cfg.reconnect = 20*time.Millisecond, 200*time.Millisecond, 300*time.Millisecond
+	network := newMemNetwork(4)
+	sites := memLine(t, network, 3, cfg)
+	frozen := sites[2]
+	network.freeze(frozen.addr)
+	start := time.Now()
+
+	for lost := false; !lost; time.Sleep(5 * time.Millisecond) {
+		sites[1].do(func() { _, lost = sites[1].lostSites[frozen.id] })
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("silent neighbor never lost")
+		}
+	}
+	// the link of a frozen site stays open: only the suspicion closes it. The
+	// silence counts from the last heartbeat received, before the freeze
+	if elapsed := time.Since(start); elapsed < cfg.suspect-cfg.heartbeat {
+		t.Errorf("neighbor lost after %v, before -suspect", elapsed)
+	}
+	if network.linked(sites[1].addr, frozen.addr) {
+		t.Error("link to the silent neighbor still open")
+	}
+
+	for _, site := range sites[:2] {
+		if failure := expect[*protocol.SiteFailed](t, site.id, site.messages); failure.FailedID != frozen.id || failure.SiteID != sites[1].id {
+			t.Errorf("site %s told %+v, want %s failed, detected by %s", site.id, failure, frozen.id, sites[1].id)
+		}
+		site.do(func() {
+			if site.isKnownSite(frozen.id) || site.isConnected(frozen.id) {
+				t.Errorf("site %s still has the failed site", site.id)
+			}
+			if _, lost := site.lostSites[frozen.id]; lost {
+				t.Errorf("site %s still waits for the failed site to reconnect", site.id)
+			}
+		})
+	}
+	if elapsed := time.Since(start); elapsed < cfg.suspect+cfg.reconnect-cfg.heartbeat {
+		t.Errorf("site declared failed after %v, before -suspect and -reconnect", elapsed)
+	}
+
+	// the sites left go on without it
+	sites[0].controllerMessages <- request(sites[0].id, 1)
+	collectRequests(t, sites[:2], 1)
+}
+
+func TestMemFaults(t *testing.T) {
+	frames := func(faults memFaults, seed uint64) string {
+		network := newMemNetwork(seed)
+		ln, _ := network.host("b").listen("b")
+		defer ln.Close()
+		go func() {
+			conn, _ := network.host("a").dial("b", time.Second)
+			network.setFaults(faults)
+			w := wire.NewWriter(conn)
+			for i := range 10 {
+				w.WriteFrame(fmt.Sprint(i))
+			}
+			time.Sleep(2 * reorderDelay)
+			conn.Close()
+		}()
+		conn, _ := ln.Accept()
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, tc := range []struct {
+		faults memFaults
+		want   string
+	}{
+		{memFaults{}, "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n"},
+		{memFaults{latency: time.Millisecond, jitter: time.Millisecond}, "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n"},
+		{memFaults{drop: 1}, ""},
+		{memFaults{duplicate: 1}, "0\n0\n1\n1\n2\n2\n3\n3\n4\n4\n5\n5\n6\n6\n7\n7\n8\n8\n9\n9\n"},
+		{memFaults{reorder: 1}, "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n"}, // all held back alike
+	} {
+		if got := frames(tc.faults, 1); got != tc.want {
+			t.Errorf("%+v: read %q, want %q", tc.faults, got, tc.want)
+		}
+	}
+	// the same seed drops the same frames
+	lossy := memFaults{drop: 0.3, reorder: 0.3}
+	if a, b := frames(lossy, 5), frames(lossy, 5); a != b {
+		t.Errorf("seed 5 read %q then %q", a, b)
+	}
+}
+
+func TestMemCut(t *testing.T) {
+	network := newMemNetwork(1)
+	ln, _ := network.host("b").listen("b")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	conn, err := network.host("a").dial("b", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.cut("b", "a")
+	if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("read on a cut link: %v", err)
+	}
+	if _, err := network.host("a").dial("b", time.Second); err == nil {
+		t.Error("dialed through a cut")
+	}
+	network.heal("a", "b")
+	conn, err = network.host("a").dial("b", time.Second)
+	if err != nil {
+		t.Fatalf("dial after heal: %v", err)
+	}
+	conn.Close()
+}
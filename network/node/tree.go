@@ -0,0 +1,180 @@
+package node
+
+import (
+	"strconv"
+	"time"
+
+	"protocol"
+)
+
+const treeRebuildDelay = 100 * time.Millisecond // the changes of links within this delay are covered by a single rebuild
+
+// spanningTree is the part of a spanning tree of the overlay known by this
+// site. The tree is built by a wave of its root: each site takes as parent the
+// neighbor which sent it the first blue message, and tells it. Broadcasts of
+// the sites in tree mode follow the tree instead of every link, a site which
+// does not know the tree of a broadcast, or whose links changed, floods it. The
+// red messages count the sites reached, and a broadcast which missed some sites
+// is flooded again by its initiator
+type spanningTree struct {
+	epoch    int
+	root     string
+	parent   string          // "" at the root
+	children map[string]bool // neighbors which took this site as parent
+	latest   int             // highest epoch heard of, the next tree built here is above it
+	stable   bool            // the tree is complete below this site, and its links did not change since
+	spoiled  bool            // a site refused the tree for a newer one, it must be built again
+	rebuild  *time.Timer     // pending rebuild after a change of the links
+}
+
+func newSpanningTree() *spanningTree {
+	return &spanningTree{children: make(map[string]bool)}
+}
+
+func treeID(epoch int, root string) string {
+	return strconv.Itoa(epoch) + "@" + root
+}
+
+func (t *spanningTree) id() string {
+	return treeID(t.epoch, t.root)
+}
+
+// replacedBy reports whether the tree built by root with epoch replaces this one
+func (t *spanningTree) replacedBy(epoch int, root string) bool {
+	return epoch > t.epoch || epoch == t.epoch && root > t.root
+}
+
+// broadcastTree returns the tree that a broadcast started by this site
+// follows, "" when it is flooded
+func (n *Node) broadcastTree() string {
+	if n.config.broadcast != "tree" || !n.tree.stable {
+		return ""
+	}
+	return n.tree.id()
+}
+
+// networkSize returns the number of sites of the network, this one included
+func (n *Node) networkSize() int {
+	if n.isKnownSite(n.id) {
+		return len(n.knownSites)
+	}
+	return len(n.knownSites) + 1
+}
+
+// waveNeighbors returns the neighbors a wave following treeID is sent to: the
+// neighbors in the tree when this site knows it, every neighbor otherwise
+func (n *Node) waveNeighbors(treeID string) map[string]*peerConn {
+	if treeID == "" || !n.tree.stable || treeID != n.tree.id() {
+		return n.connectedSites
+	}
+	neighbors := make(map[string]*peerConn)
+	for siteID, conn := range n.connectedSites {
+		if siteID == n.tree.parent || n.tree.children[siteID] {
+			neighbors[siteID] = conn
+		}
+	}
+	return neighbors
+}
+
+// topologyChanged is called when a link is added or removed: broadcasts are
+// flooded by this site until a new tree is built, when the network uses one
+func (n *Node) topologyChanged() {
+	n.tree.stable = false
+	if n.config.broadcast == "tree" || n.tree.epoch > 0 {
+		n.scheduleRebuild()
+	}
+}
+
+func (n *Node) scheduleRebuild() {
+	if n.tree.rebuild != nil {
+		n.tree.rebuild.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(treeRebuildDelay, func() {
+		n.do(func() {
+			if n.tree.rebuild == timer { // not cancelled while waiting for the event loop
+				n.rebuildTree()
+			}
+		})
+	})
+	n.tree.rebuild = timer
+}
+
+// rebuildTree starts the build of a tree rooted at this site, which replaces
+// every tree heard of so far
+func (n *Node) rebuildTree() {
+	build := &protocol.TreeBuild{SiteID: n.id, Epoch: max(n.tree.epoch, n.tree.latest) + 1}
+	n.adoptTree(build, "")
+	n.display_d("Building spanning tree " + n.tree.id())
+	n.startWave(build)
+}
+
+// adoptTree makes this site a node of a new tree
+func (n *Node) adoptTree(build *protocol.TreeBuild, parent string) {
+	if n.tree.rebuild != nil {
+		n.tree.rebuild.Stop() // the new tree does not use the links changed before
+		n.tree.rebuild = nil
+	}
+	latest := max(n.tree.latest, build.Epoch)
+	n.tree = newSpanningTree()
+	n.tree.epoch, n.tree.root, n.tree.parent, n.tree.latest = build.Epoch, build.SiteID, parent, latest
+	if parent == "" {
+		return
+	}
+	if err := writeToConn(n.connectedSites[parent], &protocol.TreeChild{SiteID: n.id, Tree: n.tree.id()}); err != nil {
+		n.display_e("Error sending message to " + parent + ": " + err.Error())
+	}
+}
+
+// joinTree handles the first blue message of a tree build, and reports whether
+// the build goes on through this site: a newer tree is adopted with the sender
+// as parent, an older one is refused
+func (n *Node) joinTree(build *protocol.TreeBuild, senderID string) bool {
+	if n.tree.replacedBy(build.Epoch, build.SiteID) {
+		n.adoptTree(build, senderID)
+		return true
+	}
+	// sent before the red message, so that the sender does not take the tree as complete
+	stale := &protocol.TreeStale{SiteID: n.id, Tree: treeID(build.Epoch, build.SiteID), Epoch: n.tree.epoch}
+	if err := writeToConn(n.connectedSites[senderID], stale); err != nil {
+		n.display_e("Error sending message to " + senderID + ": " + err.Error())
+	}
+	return false
+}
+
+// treeBuilt is called when the build wave of a tree ends on this site
+func (n *Node) treeBuilt(build *protocol.TreeBuild) {
+	if treeID(build.Epoch, build.SiteID) != n.tree.id() || n.tree.spoiled {
+		return
+	}
+	n.tree.stable = true
+	n.display_d("Spanning tree " + n.tree.id() + " built, parent: " + n.tree.parent + ", children: " + strconv.Itoa(len(n.tree.children)))
+}
+
+func (n *Node) handleTreeChild(msg *protocol.TreeChild) {
+	if msg.Tree == n.tree.id() {
+		n.tree.children[msg.SiteID] = true
+	}
+}
+
+// handleTreeStale spoils the current tree when a site refused it: the refusal
+// goes up to the root, which builds a tree newer than both
+func (n *Node) handleTreeStale(msg *protocol.TreeStale) {
+	n.tree.latest = max(n.tree.latest, msg.Epoch)
+	if msg.Tree != n.tree.id() || n.tree.spoiled {
+		return
+	}
+	n.tree.spoiled = true
+	n.tree.stable = false
+	n.display_w("Spanning tree " + n.tree.id() + " refused by " + msg.SiteID + " for a newer one")
+	if n.tree.parent == "" {
+		n.scheduleRebuild()
+		return
+	}
+	if conn := n.connectedSites[n.tree.parent]; conn != nil {
+		stale := &protocol.TreeStale{SiteID: n.id, Tree: msg.Tree, Epoch: n.tree.latest}
+		if err := writeToConn(conn, stale); err != nil {
+			n.display_e("Error sending message to " + n.tree.parent + ": " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+
+	"protocol"
+)
+
+func TestTreeBroadcast(t *testing.T) {
+	n := newSimNetwork(t, 24).setBroadcast("tree").randomLinks(3, 1)
+	if n.links == len(n.ids)-1 {
+		t.Fatal("the random network is a tree, the test needs cycles")
+	}
+
+	// two sites start building a tree at the same time
+	n.as(n.sites[n.ids[3]], n.sites[n.ids[3]].rebuildTree)
+	n.as(n.sites[n.ids[17]], n.sites[n.ids[17]].rebuildTree)
+	n.run()
+	n.checkTree(t)
+	for i, siteID := range n.ids {
+		if frames := n.broadcast(siteID); frames != 2*(len(n.ids)-1) {
+			t.Errorf("broadcast of %s sent %d frames, want %d", siteID, frames, 2*(len(n.ids)-1))
+		}
+		n.checkDelivered(t, i+1)
+	}
+
+	// a link of the tree is lost: the broadcasts sent before the tree is
+	// rebuilt still reach every site
+	var a, b string
+	for _, siteID := range n.ids {
+		if parent := n.sites[siteID].tree.parent; parent != "" && len(n.sites[siteID].connectedSites) > 1 {
+			a, b = siteID, parent
+			if n.unlink(a, b) {
+				break
+			}
+			n.link(a, b) // the network would be split, try another link
+			a = ""
+		}
+	}
+	if a == "" {
+		t.Fatal("no link of the tree can be removed without splitting the network")
+	}
+	for _, siteID := range n.ids {
+		if siteID != a && siteID != b {
+			n.broadcast(siteID)
+			break
+		}
+	}
+	n.checkDelivered(t, len(n.ids)+1)
+
+	n.run()
+	n.checkTree(t)
+	if frames := n.broadcast(a); frames != 2*(len(n.ids)-1) {
+		t.Errorf("broadcast after the rebuild sent %d frames, want %d", frames, 2*(len(n.ids)-1))
+	}
+}
+
+// TestStaleTreeRebuilt starts the build of a tree older than the tree of the
+// network, as a site which joins does: the tree is refused, and its root
+// builds a newer one
+func TestStaleTreeRebuilt(t *testing.T) {
+	n := newSimNetwork(t, 16).setBroadcast("tree").randomLinks(3, 2)
+	n.as(n.sites[n.ids[9]], n.sites[n.ids[9]].rebuildTree)
+	n.run()
+	n.checkTree(t)
+
+	stale := n.sites[n.ids[4]]
+	n.as(stale, func() {
+		build := &protocol.TreeBuild{SiteID: stale.id, Epoch: 1} // 1@site004 is older than 1@site009
+		stale.adoptTree(build, "")
+		stale.startWave(build)
+	})
+	n.deliver()
+	if !stale.tree.spoiled || stale.tree.rebuild == nil {
+		t.Fatalf("the refused tree %s is not spoiled (rebuild pending: %v)", stale.tree.id(), stale.tree.rebuild != nil)
+	}
+	n.run()
+	n.checkTree(t)
+	if root := stale.tree.root; root != stale.id {
+		t.Errorf("the tree was rebuilt by %s, want %s", root, stale.id)
+	}
+	if epoch := stale.tree.epoch; epoch != 2 {
+		t.Errorf("the new tree has epoch %d, want 2", epoch)
+	}
+}
+
+// TestTreeBroadcastFlooded breaks a link of the tree of a ring: a broadcast
+// along the rest of the tree misses a site, so it is flooded again
+func TestTreeBroadcastFlooded(t *testing.T) {
+	n := newSimNetwork(t, 4).setBroadcast("tree")
+	for i, siteID := range n.ids {
+		n.link(siteID, n.ids[(i+1)%4])
+	}
+	n.as(n.sites[n.ids[0]], n.sites[n.ids[0]].rebuildTree)
+	n.run()
+	n.checkTree(t)
+
+	// site002 is a child of site001 or site003, its link to its parent is lost
+	far := n.sites[n.ids[2]]
+	parent, other := far.tree.parent, n.ids[1]
+	if parent == other {
+		other = n.ids[3]
+	}
+	n.unlink(far.id, parent)
+	if frames := n.broadcast(other); frames <= 2*3 {
+		t.Errorf("broadcast sent %d frames, it was not flooded again", frames)
+	}
+	n.checkDelivered(t, 1)
+}
+
+// BenchmarkBroadcast counts the frames sent on the links by a broadcast, in
+// wave and tree mode, on random networks built like run.sh does
+func BenchmarkBroadcast(b *testing.B) {
+	for _, size := range []int{10, 50, 200} {
+		for _, mode := range []string{"wave", "tree"} {
+			b.Run(fmt.Sprintf("sites=%d/%s", size, mode), func(b *testing.B) {
+				n := newSimNetwork(b, size).setBroadcast(mode).randomLinks(3, uint64(size))
+				if mode == "tree" {
+					n.as(n.sites[n.ids[0]], n.sites[n.ids[0]].rebuildTree)
+					n.run()
+				}
+				frames, broadcasts := 0, 0
+				for b.Loop() {
+					frames += n.broadcast(n.ids[broadcasts%size])
+					broadcasts++
+				}
+				b.ReportMetric(float64(frames)/float64(broadcasts), "msgs/op")
+				b.ReportMetric(float64(n.links), "links")
+			})
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"protocol"
+	"wire"
+)
+
+func (n *Node) addWaitingSiteMap(siteID string, conn *peerConn, addr string) {
+	n.waitingConnections[siteID] = &WaitingObject{
+		Conn: conn,
+		Addr: addr,
+	}
+}
+
+func registerConn(addr string, conn *peerConn, connectionsMap *map[string]*peerConn) {
+	if _, exists := (*connectionsMap)[addr]; !exists { // the adress is the time ID
+		(*connectionsMap)[addr] = conn
+	}
+}
+func getAndRemoveConn(addr string, connectionsMap *map[string]*peerConn) *peerConn {
+	if conn, exists := (*connectionsMap)[addr]; exists {
+		delete(*connectionsMap, addr)
+		return conn
+	}
+	return nil
+}
+
+func unregisterAllConns(connectionsMap *map[string]*peerConn) {
+	for addr, conn := range *connectionsMap {
+		conn.Close()
+		delete(*connectionsMap, addr)
+	}
+}
+func (n *Node) delKnownSite(id string) {
+	for i, site := range n.knownSites {
+		if site == id {
+			n.knownSites = append(n.knownSites[:i], n.knownSites[i+1:]...)
+			return
+		}
+	}
+}
+func (n *Node) addKnownSite(id string) {
+	if !n.isKnownSite(id) {
+		n.knownSites = append(n.knownSites, id)
+	}
+}
+
+func (n *Node) isKnownSite(id string) bool {
+	for _, site := range n.knownSites {
+		if site == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) isConnected(addr string) bool {
+	_, exists := n.connectedSites[addr]
+	return exists
+}
+
+// isAdmitted reports whether the connection belongs to a site of the network
+func (n *Node) isAdmitted(conn *peerConn) bool {
+	return n.neighborID(conn) != ""
+}
+
+// neighborID returns the id of the site at the other end of the connection,
+// "" when it has not been admitted
+func (n *Node) neighborID(conn *peerConn) string {
+	for siteID, c := range n.connectedSites {
+		if c == conn {
+			return siteID
+		}
+	}
+	return ""
+}
+
+func writeToConn(conn *peerConn, msg protocol.Message) error {
+	err := conn.queueFrame(outFrame{frame: protocol.Marshal(msg)})
+	if err == nil {
+		messagesSent.Inc("peer", msg.Type())
+	}
+	return err
+}
+
+// writeMessage sends a message to the controller
+func (n *Node) writeMessage(msg protocol.Message) {
+	if err := n.controller.WriteFrame(protocol.Marshal(msg)); err != nil {
+		n.display_e("Error sending message to the controller: " + err.Error())
+		return
+	}
+	messagesSent.Inc("controller", msg.Type())
+}
+
+func (n *Node) prepareWaveMessages(messageID string, color string, payload *wavePayload, conn *peerConn) (*protocol.Diffusion, error) {
+	content, compression, err := payload.encode(conn.capabilities.Get(protocol.CapCompression), conn.compressMin)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Diffusion{
+		ID:          messageID,
+		Color:       color,
+		Content:     content,
+		SiteID:      n.id,
+		Compression: compression,
+	}, nil
+}
+
+// sendWaveMessage sends the payload of a wave to a single neighbor
+func (n *Node) sendWaveMessage(conn *peerConn, messageID string, color string, payload *wavePayload) error {
+	sndmsg, err := n.prepareWaveMessages(messageID, color, payload, conn)
+	if err != nil {
+		return err
+	}
+	return writeToConn(conn, sndmsg)
+}
+
+// sendWaveMessages sends a wave message following tree to every neighbor but
+// the sender, and returns the neighbors which were reached
+func (n *Node) sendWaveMessages(neighborhoods map[string]*peerConn, senderID string, messageID string, color string, payload *wavePayload, tree string) map[string]bool {
+	reached := make(map[string]bool)
+	for timerID, conn := range neighborhoods {
+		if conn == nil {
+			n.display_e("Error sending message to " + timerID + " : connection is nil")
+			continue
+		}
+		if timerID != n.id && timerID != senderID {
+			sndmsg, err := n.prepareWaveMessages(messageID, color, payload, conn)
+			if err == nil {
+				sndmsg.Tree = tree
+				err = writeToConn(conn, sndmsg)
+			}
+			if err != nil {
+				n.display_e("Error sending message to " + timerID + ": " + err.Error())
+				continue
+			}
+			reached[timerID] = true
+		}
+	}
+	return reached
+}
+
+// processTargetFlags returns the valid addresses of the comma-separated
+// list, without duplicates. A target without port is on the default port
+func processTargetFlags(targetAddrs string) []string {
+
+	var finalAddrs []string
+	if targetAddrs == "" {
+		return nil
+	}
+
+	targetAddrsList := strings.Split(targetAddrs, ",")
+
+	uniqueTargets := make(map[string]struct{}) // To store "host:port" strings for deduplication
+
+	for _, target := range targetAddrsList {
+		addr, err := normalizeAddr(target, defaultPort)
+		if err == nil {
+			_, err = net.ResolveTCPAddr("tcp", addr)
+		}
+		if err != nil {
+			display_e(fmt.Sprintf("Resolving target address %s failed: %v. Skipping this target.", target, err))
+			continue
+		}
+		if _, seen := uniqueTargets[addr]; !seen {
+			uniqueTargets[addr] = struct{}{}
+			finalAddrs = append(finalAddrs, addr)
+		}
+	}
+
+	if len(finalAddrs) == 0 {
+		display_w("No valid target addresses provided. Using local IP as default.")
+		return nil
+	}
+
+	return finalAddrs
+}
+
+func (n *Node) printConnectedSites() {
+	n.display_e(fmt.Sprintf("Connected sites (%d total):", len(n.connectedSites)))
+	for addr, conn := range n.connectedSites {
+		if conn != nil {
+			n.display_e(fmt.Sprintf("  - %s (active)", addr))
+		} else {
+			n.display_e(fmt.Sprintf("  - %s (nil connection)", addr))
+		}
+	}
+}
+
+// msgToJSON converts a formatted message to JSON format
+func msgToJSON(msg string, verbose bool) (string, error) {
+	fields, err := wire.Parse(msg)
+	if err != nil {
+		if verbose {
+			display_e("Error parsing message: " + err.Error())
+		}
+		return "", err
+	}
+
+	keyValueMap := make(map[string]string)
+	for _, field := range fields {
+		keyValueMap[field.Key] = field.Value
+	}
+
+	jsonBytes, err := json.Marshal(keyValueMap)
+	if err != nil {
+		if verbose {
+			display_e("Error marshaling to JSON: " + err.Error())
+		}
+		return "", err
+	}
+
+	return string(jsonBytes), nil
+}
+
+// jsonToMsg converts JSON to the wire format used in the system
+func jsonToMsg(jsonStr string, verbose bool) (string, error) {
+	var keyValueMap map[string]string
+
+	err := json.Unmarshal([]byte(jsonStr), &keyValueMap)
+	if err != nil {
+		if verbose {
+			display_e("Error unmarshaling JSON: " + err.Error())
+		}
+		return "", err
+	}
+
+	var result string
+	for key, value := range keyValueMap {
+		result += wire.Format(key, value)
+	}
+
+	return result, nil
+}
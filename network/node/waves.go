@@ -0,0 +1,56 @@
+package node
+
+import "fmt"
+
+const completedWavesKept = 4096 // completed waves remembered to recognize their late messages
+
+// waveTable holds the state of the waves in progress on this site. A wave is
+// forgotten as soon as this site has completed it, only its id is kept for a
+// while so that a late blue message is answered without being delivered again
+type waveTable struct {
+	seq       uint64                      // sequence number of the last wave started by this site
+	active    map[string]*DiffusionStatus // waves in progress, by id
+	completed map[string]bool             // ids of the last completed waves
+	order     []string                    // ring of the ids in completed, to forget the oldest one
+	next      int                         // next slot of order
+}
+
+func newWaveTable() *waveTable {
+	return &waveTable{
+		active:    make(map[string]*DiffusionStatus),
+		completed: make(map[string]bool),
+		order:     make([]string, completedWavesKept),
+	}
+}
+
+// newID returns the id of a new wave started by siteID, never used before
+func (t *waveTable) newID(siteID string) string {
+	t.seq++
+	return fmt.Sprintf("%s:message_%d", siteID, t.seq)
+}
+
+func (t *waveTable) get(diffusionID string) *DiffusionStatus {
+	return t.active[diffusionID]
+}
+
+func (t *waveTable) add(diffusionID string, status *DiffusionStatus) {
+	t.active[diffusionID] = status
+}
+
+// complete forgets a wave which has ended for this site
+func (t *waveTable) complete(diffusionID string) {
+	if _, ok := t.active[diffusionID]; !ok {
+		return
+	}
+	delete(t.active, diffusionID)
+	if old := t.order[t.next]; old != "" {
+		delete(t.completed, old)
+	}
+	t.order[t.next] = diffusionID
+	t.next = (t.next + 1) % len(t.order)
+	t.completed[diffusionID] = true
+}
+
+func (t *waveTable) isCompleted(diffusionID string) bool {
+	return t.completed[diffusionID]
+}
@@ -0,0 +1,210 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+
+	"protocol"
+)
+
+// frameCounter counts the line framed messages written to the controller
+type frameCounter struct{ frames int }
+
+func (c *frameCounter) Write(p []byte) (int, error) {
+	c.frames += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// connectNeighbor links the site to a neighbor whose messages are discarded
+func connectNeighbor(site *Node, siteID string) {
+	link, neighbor := net.Pipe()
+	go io.Copy(io.Discard, neighbor)
+	registerConn(siteID, newPeerConn(link, site.config), &site.connectedSites)
+}
+
+// setupWaves returns a site without neighbors, and the counter of the
+// messages delivered to its controller
+func setupWaves(t *testing.T) (*Node, *frameCounter) {
+	controller := &frameCounter{}
+	site := newNode("0", controller)
+	t.Cleanup(func() { unregisterAllConns(&site.connectedSites) })
+	return site, controller
+}
+
+var waveContent = &protocol.RequestSc{Clock: protocol.Clock{Stamp: 1, VectorialClock: map[string]int{"1": 1, "2": 0}}, SiteID: "2"}
+
+func TestWavesStayBounded(t *testing.T) {
+	site, controller := setupWaves(t)
+	connectNeighbor(site, "2")
+
+	mct, _, _ := newWavePayload(waveContent).encode(protocol.NoCompression, 0)
+	ids := make(map[string]bool)
+	run := func(n int) {
+		for range n {
+			// wave started here, answered by the only neighbor
+			site.startWave(waveContent)
+			own := fmt.Sprintf("%s:message_%d", site.id, site.waves.seq)
+			if ids[own] {
+				t.Fatalf("wave id %s used twice", own)
+			}
+			ids[own] = true
+			site.handleDiffusion(&protocol.Diffusion{ID: own, Color: RedMsg, Content: mct, SiteID: "2"}, "2")
+			// wave started by the neighbor, this site is a leaf
+			site.handleDiffusion(&protocol.Diffusion{ID: fmt.Sprintf("2:message_%d", site.waves.seq), Color: BlueMsg, Content: mct, SiteID: "2"}, "2")
+		}
+	}
+
+	run(completedWavesKept)
+	before := heapInUse()
+	run(3 * completedWavesKept)
+	after := heapInUse()
+
+	if len(site.waves.active) != 0 {
+		t.Errorf("%d completed waves still active", len(site.waves.active))
+	}
+	if len(site.waves.completed) > completedWavesKept {
+		t.Errorf("%d completed waves remembered, want at most %d", len(site.waves.completed), completedWavesKept)
+	}
+	if after > before && after-before > 256<<10 {
+		t.Errorf("heap grew from %d to %d bytes", before, after)
+	}
+	if want := 2 * 4 * completedWavesKept; controller.frames != want {
+		t.Errorf("%d messages delivered to the controller, want %d", controller.frames, want)
+	}
+
+	// a late blue message of a completed wave is answered but not delivered again
+	site.handleDiffusion(&protocol.Diffusion{ID: fmt.Sprintf("2:message_%d", site.waves.seq), Color: BlueMsg, Content: mct, SiteID: "2"}, "2")
+	if want := 2 * 4 * completedWavesKept; controller.frames != want {
+		t.Errorf("late blue message delivered again")
+	}
+}
+
+// TestWavesWithChangingNeighbors runs waves while neighbors join and leave: a
+// wave must neither wait for a neighbor which left nor for one which joined
+// after the blue message was forwarded
+func TestWavesWithChangingNeighbors(t *testing.T) {
+	site, controller := setupWaves(t)
+	site.config.heartbeat = 0 // the neighbors never answer the heartbeats
+	mct, _, _ := newWavePayload(waveContent).encode(protocol.NoCompression, 0)
+	for i := range 3 {
+		connectNeighbor(site, "n"+strconv.Itoa(i))
+	}
+	go site.run()
+	t.Cleanup(site.stop)
+
+	const rounds = 2000
+	started := 0 // waves started here or received from a neighbor, in the event loop
+	var wg sync.WaitGroup
+	churn := func(seed uint64) {
+		defer wg.Done()
+		random := rand.New(rand.NewPCG(seed, 0))
+		for i := range rounds {
+			site.do(func() {
+				if random.IntN(2) == 0 || len(site.connectedSites) < 2 {
+					connectNeighbor(site, fmt.Sprintf("j%d-%d", seed, i))
+				} else {
+					for siteID := range site.connectedSites {
+						site.loseLink(siteID) // the link is closed, nothing is dialed again
+						break
+					}
+				}
+			})
+		}
+	}
+	diffuse := func(seed uint64) {
+		defer wg.Done()
+		random := rand.New(rand.NewPCG(seed, 1))
+		for i := range rounds {
+			site.do(func() {
+				switch random.IntN(3) {
+				case 0:
+					site.startWave(waveContent)
+					started++
+				case 1:
+					for siteID := range site.connectedSites {
+						site.handleDiffusion(&protocol.Diffusion{ID: fmt.Sprintf("%s:message_%d-%d", siteID, seed, i), Color: BlueMsg, Content: mct, SiteID: siteID}, siteID)
+						started++
+						break
+					}
+				default:
+					answerSomeWave(site, mct)
+				}
+			})
+		}
+	}
+	wg.Add(4)
+	go churn(1)
+	go churn(2)
+	go diffuse(3)
+	go diffuse(4)
+	wg.Wait()
+
+	// the neighbors still connected answer every wave
+	site.do(func() {
+		for answerSomeWave(site, mct) {
+		}
+		if len(site.waves.active) != 0 {
+			t.Errorf("%d waves never completed", len(site.waves.active))
+		}
+		if controller.frames != started {
+			t.Errorf("%d messages delivered to the controller, want %d", controller.frames, started)
+		}
+	})
+}
+
+// answerSomeWave receives the red message of a neighbor which is waited for,
+// and returns false when no wave waits for any neighbor
+func answerSomeWave(site *Node, mct string) bool {
+	for diffusionID, status := range site.waves.active {
+		for siteID := range status.waiting {
+			if site.connectedSites[siteID] == nil {
+				panic("wave " + diffusionID + " waits for " + siteID + " which is not a neighbor")
+			}
+			site.handleDiffusion(&protocol.Diffusion{ID: diffusionID, Color: RedMsg, Content: mct, SiteID: siteID}, siteID)
+			return true
+		}
+	}
+	return false
+}
+
+// TestDiffusionWithForeignSiteID receives blue messages whose site id is not
+// the one of the neighbor which sent them: the wave is answered on the link it
+// arrived on
+func TestDiffusionWithForeignSiteID(t *testing.T) {
+	site, controller := setupWaves(t)
+	connectNeighbor(site, "2")
+	mct, _, _ := newWavePayload(waveContent).encode(protocol.NoCompression, 0)
+
+	for i, siteID := range []string{"9", ""} {
+		id := fmt.Sprintf("2:message_%d", i)
+		site.handlePeerMessage(site.connectedSites["2"], "peer", &protocol.Diffusion{ID: id, Color: BlueMsg, Content: mct, SiteID: siteID})
+		// answered again by the neighbor, which is not related to this site
+		site.handlePeerMessage(site.connectedSites["2"], "peer", &protocol.Diffusion{ID: id, Color: BlueMsg, Content: mct, SiteID: siteID})
+	}
+	if controller.frames != 2 {
+		t.Errorf("%d messages delivered to the controller, want 2", controller.frames)
+	}
+	if len(site.waves.active) != 0 {
+		t.Errorf("%d waves still active", len(site.waves.active))
+	}
+
+	// a site which is not a neighbor is not answered
+	site.handleDiffusion(&protocol.Diffusion{ID: "9:message_1", Color: BlueMsg, Content: mct, SiteID: "9"}, "9")
+	if site.waves.get("9:message_1") != nil || controller.frames != 2 {
+		t.Error("diffusion of a site which is not a neighbor accepted")
+	}
+}
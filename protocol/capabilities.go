@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Version of the protocol spoken between network layers, sites with
+// different versions refuse to exchange messages
+const Version = 1
+
+var ErrIncompatible = errors.New("protocol: incompatible site")
+
+// capabilities negotiated during the access handshake
+const (
+	CapCompression string = "compression" // compression of large message fields
+	CapFraming     string = "framing"     // framing of the messages on the link (wire.Framing)
+	CapEncryption  string = "encryption"  // encryption of the link
+	CapEditing     string = "editing"     // model used to merge the edits of the text
+)
+
+// Capabilities lists, for each capability, the values supported by a site by
+// order of preference
+type Capabilities map[string][]string
+
+// Choices holds the value chosen for each capability of a link
+type Choices map[string]string
+
+// defaultCapabilities are assumed for the capabilities a site does not
+// advertise, they are what every site supported before the negotiation
+var defaultCapabilities = Choices{
+	CapCompression: NoCompression,
+	CapFraming:     "line",
+	CapEncryption:  "none",
+	CapEditing:     "diff",
+}
+
+// Negotiate chooses, for every capability of local, the first value offered
+// by remote that local supports. It fails with ErrIncompatible when there is
+// none.
+func Negotiate(local, remote Capabilities) (Choices, error) {
+	choices := make(Choices, len(local))
+	for name, supported := range local {
+		offered, ok := remote[name]
+		if !ok {
+			offered = []string{defaultCapabilities[name]}
+		}
+		for _, value := range offered {
+			if slices.Contains(supported, value) {
+				choices[name] = value
+				break
+			}
+		}
+		if _, ok := choices[name]; !ok {
+			return nil, fmt.Errorf("%w: no common %s (offered %v, supported %v)", ErrIncompatible, name, offered, supported)
+		}
+	}
+	return choices, nil
+}
+
+// CheckVersion returns an error explaining why a site speaking version v
+// cannot join
+func CheckVersion(v int) error {
+	if v != Version {
+		return fmt.Errorf("%w: protocol version %d, expected %d", ErrIncompatible, v, Version)
+	}
+	return nil
+}
+
+// Get returns the value chosen for a capability, or its default value when
+// it was not negotiated
+func (c Choices) Get(name string) string {
+	if value, ok := c[name]; ok {
+		return value
+	}
+	return defaultCapabilities[name]
+}
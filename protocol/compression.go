@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"wire"
+)
+
+// compression algorithms of large fields (upt, mct)
+const (
+	NoCompression   string = "none"
+	GzipCompression string = "gzip"
+)
+
+// Compress encodes s with algo. The result is in base64 so that it can be
+// written in any field.
+func Compress(algo, s string) (string, error) {
+	switch algo {
+	case "", NoCompression:
+		return s, nil
+	case GzipCompression:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	}
+	return "", fmt.Errorf("%w: unknown compression %q", ErrIncompatible, algo)
+}
+
+// Decompress returns the value compressed by Compress
+func Decompress(algo, s string) (string, error) {
+	switch algo {
+	case "", NoCompression:
+		return s, nil
+	case GzipCompression:
+		compressed, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrIllFormed, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrIllFormed, err)
+		}
+		// a small frame can hold a huge text once decompressed, it is
+		// limited like a frame
+		plain, err := io.ReadAll(io.LimitReader(zr, wire.DefaultMaxFrameSize+1))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrIllFormed, err)
+		}
+		if len(plain) > wire.DefaultMaxFrameSize {
+			return "", fmt.Errorf("%w: more than %d bytes once decompressed", wire.ErrFrameTooLarge, wire.DefaultMaxFrameSize)
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("%w: unknown compression %q", ErrIncompatible, algo)
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// InviteScheme is the scheme of the invitation links,
+// e.g. dte://192.168.1.10:9000/Team%20notes?token=secret
+const InviteScheme = "dte"
+
+var ErrBadInvite = errors.New("protocol: invalid invitation")
+
+// Invite holds what a site needs to join a document
+type Invite struct {
+	Target   string // address of a site of the network (host:port)
+	Document string // name of the document
+	Token    string // passphrase of the document, empty when the network is open
+}
+
+// ParseInvite parses an invitation link
+func ParseInvite(s string) (Invite, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Invite{}, fmt.Errorf("%w: %v", ErrBadInvite, err)
+	}
+	if u.Scheme != InviteScheme {
+		return Invite{}, fmt.Errorf("%w: scheme %q instead of %q", ErrBadInvite, u.Scheme, InviteScheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return Invite{}, fmt.Errorf("%w: %q is not a host:port address", ErrBadInvite, u.Host)
+	}
+	document := strings.TrimPrefix(u.Path, "/")
+	if document == "" {
+		return Invite{}, fmt.Errorf("%w: missing document name", ErrBadInvite)
+	}
+	return Invite{Target: u.Host, Document: document, Token: u.Query().Get("token")}, nil
+}
+
+// String returns the invitation link
+func (i Invite) String() string {
+	u := url.URL{Scheme: InviteScheme, Host: i.Target, Path: "/" + i.Document}
+	if i.Token != "" {
+		u.RawQuery = url.Values{"token": {i.Token}}.Encode()
+	}
+	return u.String()
+}
+
+// Redacted returns the invitation link with its token hidden, to be logged
+func (i Invite) Redacted() string {
+	if i.Token != "" {
+		i.Token = "xxxxx"
+	}
+	return i.String()
+}
@@ -0,0 +1,465 @@
+package protocol
+
+// message types
+const (
+	// between the network layers of two sites
+	MsgAccessRequest string = "maq" // request access to the network
+	MsgAccessGranted string = "mag" // access granted to the network
+	MsgAccessDenied  string = "mad" // access to the network refused
+	MsgChallenge     string = "chl" // proof that the site knows the passphrase, and challenge of the requesting site
+	MsgChallengeResp string = "chr" // answer of the requesting site to the challenge
+	DiffusionMessage string = "dif" // diffusion message type
+	MsgHeartbeat     string = "hbt" // the sender is alive
+	MsgAnnounce      string = "anc" // the sender edits a document and accepts sites on a port (UDP discovery)
+	MsgTreeBuild     string = "trb" // build a spanning tree of the network rooted at the sender (content of a wave)
+	MsgTreeChild     string = "trc" // the sender chose the receiver as its parent in a spanning tree
+	MsgTreeStale     string = "trs" // the sender already uses a newer spanning tree
+	MsgUnicast       string = "uni" // controler message for a single site, forwarded toward it
+	MsgCensus        string = "cns" // list the sites which can be reached (content of a wave)
+
+	// between the network and the controler
+	GetSharedText          string = "gst" // get the local shared text from the controler / return it to the network
+	KnownSiteListMessage   string = "mks" // list of sites to add to the vectorial clock of the controler
+	InitializationMessage  string = "ini" // set the initial state of the controler
+	AddSiteCriticalSection string = "asl" // add a site to the network at the next critical section
+	MsgSiteFailed          string = "sfl" // a site stopped answering, it is removed from the network
+	MsgLinkRestored        string = "lnr" // the link to a neighbor has been restored after a loss
+	MsgPartition           string = "ptn" // sites out of reach, removed until the partitions merge
+	MsgMerge               string = "mrg" // a link to a site of another partition is up, the documents must be merged
+
+	// between controlers, carried by the network
+	MsgRequestSc   string = "rqs" // request critical section
+	MsgReleaseSc   string = "rls" // release critical section
+	MsgReceiptSc   string = "rcs" // receipt of critical section
+	MsgJsonRequest string = "jqr" // request json data for cut
+	MsgReceiptCut  string = "rcp" // json data for cut completed, ready to save
+	MsgResync      string = "rsy" // ask for the releases missed while the network was split
+	MsgMergeState  string = "mst" // log and sites of a partition, for the site merging it with another one
+
+	// between the controler and the application
+	MsgAppRequest        string = "rqa"  // request critical section
+	MsgAppRelease        string = "rla"  // release critical section
+	MsgCut               string = "cut"  // save the vectorial clock value
+	MsgAppDied           string = "apd"  // the app has been closed / the controler allows it to exit
+	MsgAppStartSc        string = "ssa"  // start critical section
+	MsgAppUpdate         string = "upa"  // update critical section
+	MsgReturnInitialText string = "ret"  // give the initial common text content to the site
+	MsgReturnText        string = "ret2" // ask for / give the current text content
+	ContentRequest       string = "cqr"  // request content for cut
+	ContentResponse      string = "crp"  // response with content for cut
+	MsgMergeLogs         string = "mlg"  // merge the log of another partition with the local one
+	MsgMergedLog         string = "mgl"  // log merged from two partitions / replace the local log with it
+)
+
+// message fields
+const (
+	TypeField           string = "typ"  // type of message
+	SiteIdField         string = "sid"  // site id of sender
+	SiteIdDestField     string = "did"  // site id of destination
+	UptField            string = "upt"  // text content or update of the text (json format)
+	StampField          string = "stp"  // site stamp value
+	VectorialClockField string = "vcl"  // vectorial clock value (json format)
+	KnownSiteList       string = "ksl"  // list of sites known in the network (json format)
+	SitesToAdd          string = "sta"  // list of sites to add to the network (json format)
+	CloseSiteField      string = "cls"  // the sender site is closing
+	CloseSiteAddress    string = "csa"  // addresses of the neighbors of the closing site (json format)
+	JsonCutData         string = "jcd"  // json data to add into cut file
+	CutInitiator        string = "cti"  // initiator of the cut request
+	KeyCut              string = "kct"  // key of the cut in the json file
+	DiffusionStatusID   string = "dsid" // id of the diffusion status
+	ColorDiffusion      string = "clr"  // color of the diffusion message
+	MessageContent      string = "mct"  // content of the message (used for diffusion)
+	VersionField        string = "ver"  // protocol version of the sender
+	CapabilitiesField   string = "cap"  // capabilities supported by the sender / chosen for the link (json format)
+	ReasonField         string = "rsn"  // reason of a refusal
+	CompressionField    string = "cmp"  // compression of the upt or mct field of the message
+	NonceField          string = "non"  // random value to sign with the passphrase
+	ProofField          string = "prf"  // signature of a nonce with the passphrase
+	FailedSiteField     string = "fid"  // id of the site which failed
+	ReleaseClockField   string = "rcl"  // clock of the last release applied from each site (json format)
+	DocumentField       string = "doc"  // name of the document
+	PortField           string = "prt"  // port on which the sender accepts sites
+	TreeField           string = "tre"  // spanning tree followed by a broadcast (epoch@root)
+	EpochField          string = "epc"  // epoch of a spanning tree
+	ReachedField        string = "rch"  // number of sites reached by a wave below the sender
+	HopsField           string = "hop"  // number of links crossed by a unicast message
+	ReachedSitesField   string = "rsl"  // sites reached by a census below the sender (json format)
+	UnreachableField    string = "unr"  // sites out of reach of the sender (json format)
+	PartitionedField    string = "ptd"  // sites considered in another partition by the sender (json format)
+	MergeField          string = "mid"  // id of the merge of two partitions / the link merges two partitions
+	ConflictsField      string = "cfl"  // number of changes made on both sides of a merge
+	RejoinedField       string = "rjn"  // sites of both partitions, known again after a merge (json format)
+	InviteField         string = "inv"  // invitation link to join the document through the site
+)
+
+// Clock holds the logical clocks carried by the messages exchanged between controlers
+type Clock struct {
+	Stamp          int            `wire:"stp"`
+	VectorialClock map[string]int `wire:"vcl,omitempty"`
+}
+
+func (c *Clock) clock() *Clock { return c }
+
+type clocked interface{ clock() *Clock }
+
+// ClockOf returns the clocks carried by m, if any
+func ClockOf(m Message) (Clock, bool) {
+	if c, ok := m.(clocked); ok {
+		return *c.clock(), true
+	}
+	return Clock{}, false
+}
+
+// network <-> network
+
+type AccessRequest struct {
+	SiteID       string       `wire:"sid,required"`
+	Version      int          `wire:"ver"`
+	Capabilities Capabilities `wire:"cap,omitempty"`
+	Nonce        string       `wire:"non,omitempty"` // sent by the sites which have a passphrase
+	Partitioned  []string     `wire:"ptd,omitempty"` // the sites out of reach of the requesting site
+	Addr         string       `wire:"adr,omitempty"` // address the requesting site listens on
+}
+
+type AccessGranted struct {
+	SiteID       string         `wire:"sid,required"`
+	KnownSites   []string       `wire:"ksl,omitempty"` // empty when the requesting site was already in the network
+	Text         string         `wire:"upt,omitempty"`
+	Version      int            `wire:"ver"`
+	Capabilities Choices        `wire:"cap,omitempty"` // used on the link after this message
+	Compression  string         `wire:"cmp,omitempty"` // compression of Text
+	Released     map[string]int `wire:"rcl,omitempty"` // releases included in Text
+	Merge        bool           `wire:"mid,omitempty"` // the sites were in two partitions, their documents are merged
+}
+
+// Challenge is sent instead of mag by a site protected by a passphrase
+type Challenge struct {
+	SiteID string `wire:"sid,required"`
+	Nonce  string `wire:"non,required"`
+	Proof  string `wire:"prf,required"` // signature of the nonce of the access request
+}
+
+type ChallengeResponse struct {
+	SiteID string `wire:"sid,required"`
+	Proof  string `wire:"prf,required"` // signature of the nonce of the challenge
+}
+
+type AccessDenied struct {
+	SiteID  string `wire:"sid,required"`
+	Version int    `wire:"ver"`
+	Reason  string `wire:"rsn"`
+}
+
+type Diffusion struct {
+	ID          string   `wire:"dsid,required"`
+	Color       string   `wire:"clr,required"`
+	Content     string   `wire:"mct,required"`
+	SiteID      string   `wire:"sid,required"`
+	Compression string   `wire:"cmp,omitempty"` // compression of Content
+	Tree        string   `wire:"tre,omitempty"` // spanning tree the wave follows, empty when it is flooded
+	Reached     int      `wire:"rch,omitempty"` // red messages: sites which received the wave through the sender
+	Sites       []string `wire:"rsl,omitempty"` // red messages of a census: the sites counted in Reached
+}
+
+type Heartbeat struct {
+	SiteID string `wire:"sid,required"`
+}
+
+// Announce is sent periodically on the LAN by the sites which can be discovered
+type Announce struct {
+	SiteID   string `wire:"sid,required"`
+	Document string `wire:"doc"`
+	Port     int    `wire:"prt,required"`
+	Version  int    `wire:"ver"`
+	Addr     string `wire:"adr,omitempty"` // address to dial, when the site advertises one (host of the sender and Port otherwise)
+}
+
+// TreeBuild is diffused by the root of a new spanning tree. A tree replaces
+// the trees of lower epoch, and of the same epoch with a lower root
+type TreeBuild struct {
+	SiteID string `wire:"sid,required"`
+	Epoch  int    `wire:"epc,required"`
+}
+
+type TreeChild struct {
+	SiteID string `wire:"sid,required"`
+	Tree   string `wire:"tre,required"`
+}
+
+// TreeStale answers the blue message of a tree older than the one of the
+// sender, whose epoch is given so that the next tree replaces both
+type TreeStale struct {
+	SiteID string `wire:"sid,required"`
+	Tree   string `wire:"tre,required"`
+	Epoch  int    `wire:"epc,required"`
+}
+
+// Unicast carries a message of the controler of SiteID to DestID, each site
+// on the way sends it to its next hop toward DestID
+type Unicast struct {
+	SiteID      string `wire:"sid,required"`
+	DestID      string `wire:"did,required"`
+	Content     string `wire:"mct,required"`
+	Compression string `wire:"cmp,omitempty"` // compression of Content
+	Hops        int    `wire:"hop"`
+}
+
+// Census is diffused by a site after a failure: the red messages list the
+// sites reached, the known sites missing are in another partition
+type Census struct {
+	SiteID string `wire:"sid,required"`
+}
+
+// network <-> controler
+
+type Initialization struct {
+	KnownSites []string       `wire:"ksl,omitempty"` // empty for the primary site
+	SiteID     string         `wire:"sid"`           // empty for the primary site
+	Text       string         `wire:"upt,omitempty"`
+	Released   map[string]int `wire:"rcl,omitempty"` // releases included in Text
+	Invite     string         `wire:"inv,omitempty"` // link to join the document through this site
+}
+
+type KnownSites struct {
+	KnownSites []string `wire:"ksl"`
+	SiteID     string   `wire:"sid"`
+}
+
+// SharedText is sent by the network with the id of the joining site, and
+// returned by the controler with the text and the sites to admit
+type SharedText struct {
+	SiteID     string         `wire:"sid,omitempty"`
+	SitesToAdd []string       `wire:"sta,omitempty"`
+	Text       string         `wire:"upt,omitempty"`
+	Released   map[string]int `wire:"rcl,omitempty"` // releases included in Text
+}
+
+type AddSite struct {
+	SiteID string `wire:"sid,required"`
+}
+
+// SiteFailed is sent by the network of the site which detected the failure,
+// to its controler and to the other sites in a wave
+type SiteFailed struct {
+	SiteID   string `wire:"sid,required"`
+	FailedID string `wire:"fid,required"`
+}
+
+// LinkRestored is sent by the network when the link to a neighbor lost
+// earlier has been restored
+type LinkRestored struct {
+	SiteID string `wire:"sid,required"`
+}
+
+// Partition is diffused by the network of a site whose census missed known
+// sites, and given to the controlers and the applications
+type Partition struct {
+	SiteID      string   `wire:"sid,required"`
+	Unreachable []string `wire:"unr,required"`
+}
+
+// Merge is sent by the network when a link to a site of another partition is
+// up
+type Merge struct {
+	SiteID string `wire:"sid,required"` // site of the other partition
+}
+
+// controler <-> controler
+
+type RequestSc struct {
+	Clock
+	SiteID string `wire:"sid,required"`
+}
+
+type ReleaseSc struct {
+	Clock
+	SiteID         string            `wire:"sid,required"`
+	Text           string            `wire:"upt"`
+	SitesToAdd     []string          `wire:"sta"`
+	Close          bool              `wire:"cls"`
+	CloseAddresses map[string]string `wire:"csa,omitempty"` // added by the network of the closing site
+	Merge          string            `wire:"mid,omitempty"` // Text is the log merged from two partitions, not diffs
+	Conflicts      int               `wire:"cfl,omitempty"`
+	Rejoined       []string          `wire:"rjn,omitempty"` // sites of both partitions
+	Released       map[string]int    `wire:"rcl,omitempty"` // releases included in the merged log
+}
+
+type ReceiptSc struct {
+	Clock
+	SiteID string `wire:"sid,required"`
+	DestID string `wire:"did,required"`
+}
+
+// Resync is diffused by a controler after a link of its site was restored,
+// with the vector clock of the last release it applied from each site: the
+// controlers send again their releases which are not covered by it
+type Resync struct {
+	SiteID   string         `wire:"sid,required"`
+	Released map[string]int `wire:"rcl"`
+}
+
+type CutRequest struct {
+	SiteID       string `wire:"sid,required"`
+	CutInitiator string `wire:"cti,required"`
+}
+
+type CutReceipt struct {
+	SiteID      string `wire:"sid,required"`
+	KeyCut      string `wire:"kct,required"`
+	JsonCutData string `wire:"jcd,required"`
+	DestID      string `wire:"did,required"`
+}
+
+// MergeState is sent by each of the two sites at the ends of a link between
+// partitions to the other one, with the log and sites of its partition
+type MergeState struct {
+	SiteID     string         `wire:"sid,required"`
+	DestID     string         `wire:"did,required"`
+	Text       string         `wire:"upt"`
+	Released   map[string]int `wire:"rcl,omitempty"` // releases included in Text
+	KnownSites []string       `wire:"ksl"`
+}
+
+func (m ReceiptSc) Destination() string  { return m.DestID }
+func (m CutReceipt) Destination() string { return m.DestID }
+func (m MergeState) Destination() string { return m.DestID }
+
+// controler <-> application
+
+type AppRequest struct{}
+
+type AppRelease struct {
+	Text string `wire:"upt"`
+}
+
+type AppCut struct {
+	Text string `wire:"upt"`
+}
+
+type AppDied struct{}
+
+type AppStartSc struct{}
+
+type AppUpdate struct {
+	Text string `wire:"upt"`
+}
+
+type InitialText struct {
+	SiteID string `wire:"sid"`
+	Text   string `wire:"upt,omitempty"`
+	Invite string `wire:"inv,omitempty"` // link to join the document through this site, shown by the application
+}
+
+// CurrentText is sent by the controler to ask for the text, with the id of the
+// site to give it to ("-1" for every site added at the next release), and
+// returned by the application with the same id
+type CurrentText struct {
+	SiteID string `wire:"sid"`
+	Text   string `wire:"upt,omitempty"`
+}
+
+type CutContentRequest struct {
+	CutInitiator string `wire:"cti,required"`
+}
+
+type CutContentResponse struct {
+	CutInitiator string `wire:"cti,required"`
+	Text         string `wire:"upt"`
+}
+
+// MergeLogs is sent by the controler with the log of another partition and
+// the site it comes from
+type MergeLogs struct {
+	SiteID string `wire:"sid,required"`
+	Text   string `wire:"upt"`
+}
+
+type MergedLog struct {
+	Text      string `wire:"upt"`
+	Conflicts int    `wire:"cfl"`
+}
+
+func (AccessRequest) Type() string      { return MsgAccessRequest }
+func (AccessGranted) Type() string      { return MsgAccessGranted }
+func (AccessDenied) Type() string       { return MsgAccessDenied }
+func (Challenge) Type() string          { return MsgChallenge }
+func (ChallengeResponse) Type() string  { return MsgChallengeResp }
+func (Diffusion) Type() string          { return DiffusionMessage }
+func (Heartbeat) Type() string          { return MsgHeartbeat }
+func (Announce) Type() string           { return MsgAnnounce }
+func (TreeBuild) Type() string          { return MsgTreeBuild }
+func (TreeChild) Type() string          { return MsgTreeChild }
+func (TreeStale) Type() string          { return MsgTreeStale }
+func (Unicast) Type() string            { return MsgUnicast }
+func (Census) Type() string             { return MsgCensus }
+func (Initialization) Type() string     { return InitializationMessage }
+func (KnownSites) Type() string         { return KnownSiteListMessage }
+func (SharedText) Type() string         { return GetSharedText }
+func (AddSite) Type() string            { return AddSiteCriticalSection }
+func (SiteFailed) Type() string         { return MsgSiteFailed }
+func (LinkRestored) Type() string       { return MsgLinkRestored }
+func (Partition) Type() string          { return MsgPartition }
+func (Merge) Type() string              { return MsgMerge }
+func (RequestSc) Type() string          { return MsgRequestSc }
+func (ReleaseSc) Type() string          { return MsgReleaseSc }
+func (ReceiptSc) Type() string          { return MsgReceiptSc }
+func (Resync) Type() string             { return MsgResync }
+func (MergeState) Type() string         { return MsgMergeState }
+func (CutRequest) Type() string         { return MsgJsonRequest }
+func (CutReceipt) Type() string         { return MsgReceiptCut }
+func (AppRequest) Type() string         { return MsgAppRequest }
+func (AppRelease) Type() string         { return MsgAppRelease }
+func (AppCut) Type() string             { return MsgCut }
+func (AppDied) Type() string            { return MsgAppDied }
+func (AppStartSc) Type() string         { return MsgAppStartSc }
+func (AppUpdate) Type() string          { return MsgAppUpdate }
+func (InitialText) Type() string        { return MsgReturnInitialText }
+func (CurrentText) Type() string        { return MsgReturnText }
+func (CutContentRequest) Type() string  { return ContentRequest }
+func (CutContentResponse) Type() string { return ContentResponse }
+func (MergeLogs) Type() string          { return MsgMergeLogs }
+func (MergedLog) Type() string          { return MsgMergedLog }
+
+// messageTypes creates an empty message for each known type
+var messageTypes = map[string]func() Message{
+	MsgAccessRequest:       func() Message { return &AccessRequest{} },
+	MsgAccessGranted:       func() Message { return &AccessGranted{} },
+	MsgAccessDenied:        func() Message { return &AccessDenied{} },
+	MsgChallenge:           func() Message { return &Challenge{} },
+	MsgChallengeResp:       func() Message { return &ChallengeResponse{} },
+	DiffusionMessage:       func() Message { return &Diffusion{} },
+	MsgHeartbeat:           func() Message { return &Heartbeat{} },
+	MsgAnnounce:            func() Message { return &Announce{} },
+	MsgTreeBuild:           func() Message { return &TreeBuild{} },
+	MsgTreeChild:           func() Message { return &TreeChild{} },
+	MsgTreeStale:           func() Message { return &TreeStale{} },
+	MsgUnicast:             func() Message { return &Unicast{} },
+	MsgCensus:              func() Message { return &Census{} },
+	InitializationMessage:  func() Message { return &Initialization{} },
+	KnownSiteListMessage:   func() Message { return &KnownSites{} },
+	GetSharedText:          func() Message { return &SharedText{} },
+	AddSiteCriticalSection: func() Message { return &AddSite{} },
+	MsgSiteFailed:          func() Message { return &SiteFailed{} },
+	MsgLinkRestored:        func() Message { return &LinkRestored{} },
+	MsgPartition:           func() Message { return &Partition{} },
+	MsgMerge:               func() Message { return &Merge{} },
+	MsgRequestSc:           func() Message { return &RequestSc{} },
+	MsgReleaseSc:           func() Message { return &ReleaseSc{} },
+	MsgReceiptSc:           func() Message { return &ReceiptSc{} },
+	MsgResync:              func() Message { return &Resync{} },
+	MsgMergeState:          func() Message { return &MergeState{} },
+	MsgJsonRequest:         func() Message { return &CutRequest{} },
+	MsgReceiptCut:          func() Message { return &CutReceipt{} },
+	MsgAppRequest:          func() Message { return &AppRequest{} },
+	MsgAppRelease:          func() Message { return &AppRelease{} },
+	MsgCut:                 func() Message { return &AppCut{} },
+	MsgAppDied:             func() Message { return &AppDied{} },
+	MsgAppStartSc:          func() Message { return &AppStartSc{} },
+	MsgAppUpdate:           func() Message { return &AppUpdate{} },
+	MsgReturnInitialText:   func() Message { return &InitialText{} },
+	MsgReturnText:          func() Message { return &CurrentText{} },
+	ContentRequest:         func() Message { return &CutContentRequest{} },
+	ContentResponse:        func() Message { return &CutContentResponse{} },
+	MsgMergeLogs:           func() Message { return &MergeLogs{} },
+	MsgMergedLog:           func() Message { return &MergedLog{} },
+}
@@ -0,0 +1,207 @@
+// Package protocol defines every message exchanged between the app, the
+// controler and the network layers, and between network layers of different
+// sites.
+//
+// Each message is a Go struct whose fields are tagged with their wire key:
+//
+//	SiteID string `wire:"sid,required"`
+//
+// Strings, ints and bools are written as is, any other field type is written
+// in JSON. The "omitempty" option skips zero values and the "required" option
+// makes Unmarshal fail when the key is missing.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"wire"
+)
+
+var (
+	ErrUnknownType  = errors.New("protocol: unknown message type")
+	ErrIllFormed    = errors.New("protocol: ill-formed message")
+	ErrNotAddressed = errors.New("protocol: message not addressed to this layer")
+)
+
+// Message is implemented by every message struct of the protocol
+type Message interface {
+	Type() string
+}
+
+// Addressed is implemented by the messages for a single site, which the
+// network sends toward it instead of broadcasting them
+type Addressed interface {
+	Message
+	Destination() string
+}
+
+// Marshal encodes a message on a single line (without the trailing newline)
+func Marshal(m Message) string {
+	fields := wire.Message{{Key: TypeField, Value: m.Type()}}
+	v := reflect.Indirect(reflect.ValueOf(m))
+	fields = appendFields(fields, v)
+	return fields.String()
+}
+
+// Unmarshal decodes a line whatever its type, use Decode to also check
+// that the type is expected on a given link
+func Unmarshal(line string) (Message, error) {
+	return decode(line, nil)
+}
+
+func decode(line string, links []Link) (Message, error) {
+	fields, err := wire.Parse(line)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIllFormed, err)
+	}
+	typ, ok := fields.Get(TypeField)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s field", ErrIllFormed, TypeField)
+	}
+	newMessage, ok := messageTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, typ)
+	}
+	if links != nil && !Registered(typ, links...) {
+		return nil, fmt.Errorf("%w: %q on %v", ErrNotAddressed, typ, links)
+	}
+	m := newMessage()
+	if err := readFields(fields, reflect.ValueOf(m).Elem()); err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	return m, nil
+}
+
+// PeekType returns the type of an encoded message without decoding its fields
+func PeekType(line string) string {
+	typ, _ := wire.Lookup(line, TypeField)
+	return typ
+}
+
+type tagOptions struct {
+	key       string
+	omitempty bool
+	required  bool
+}
+
+func parseTag(tag string) tagOptions {
+	parts := strings.Split(tag, ",")
+	opts := tagOptions{key: parts[0]}
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "omitempty":
+			opts.omitempty = true
+		case "required":
+			opts.required = true
+		}
+	}
+	return opts
+}
+
+func appendFields(fields wire.Message, v reflect.Value) wire.Message {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fv := v.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fields = appendFields(fields, fv)
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("wire")
+		if !ok || !sf.IsExported() {
+			continue
+		}
+		opts := parseTag(tag)
+		if opts.omitempty && fv.IsZero() {
+			continue
+		}
+		fields = append(fields, wire.Field{Key: opts.key, Value: encodeValue(fv)})
+	}
+	return fields
+}
+
+func encodeValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	default:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			// only maps and slices of basic types are used in messages
+			panic("protocol: cannot encode field: " + err.Error())
+		}
+		return string(b)
+	}
+}
+
+func readFields(fields wire.Message, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fv := v.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if err := readFields(fields, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("wire")
+		if !ok || !sf.IsExported() {
+			continue
+		}
+		opts := parseTag(tag)
+		raw, present := fields.Get(opts.key)
+		if !present {
+			if opts.required {
+				return fmt.Errorf("%w: missing %s field", ErrIllFormed, opts.key)
+			}
+			continue
+		}
+		if err := decodeValue(raw, fv); err != nil {
+			return fmt.Errorf("%w: field %s: %v", ErrIllFormed, opts.key, err)
+		}
+	}
+	return nil
+}
+
+func decodeValue(raw string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		if raw == "" {
+			return nil
+		}
+		return json.Unmarshal([]byte(raw), v.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"wire"
+)
+
+func TestRoundTrip(t *testing.T) {
+	messages := []Message{
+		&AccessGranted{SiteID: "1", KnownSites: []string{"1", "2"}, Text: "a ~ b ` c\nd"},
+		&ReleaseSc{
+			Clock:          Clock{Stamp: 4, VectorialClock: map[string]int{"1": 3, "2": 1}},
+			SiteID:         "1",
+			Text:           `[{"Pos":0,"NbDeleted":0,"NewText":"~"}]`,
+			SitesToAdd:     []string{"3"},
+			Close:          true,
+			CloseAddresses: map[string]string{"2": "[::1]:9001"},
+		},
+		&ReceiptSc{Clock: Clock{Stamp: 2}, SiteID: "2", DestID: "1"},
+		&Resync{SiteID: "2", Released: map[string]int{"1": 7, "2": 0}},
+		&Diffusion{ID: "1:message_3", Color: "blu", Content: "{}", SiteID: "1", Tree: "4@2"},
+		&TreeStale{SiteID: "2", Tree: "3@1", Epoch: 4},
+		&Unicast{SiteID: "1", DestID: "3", Content: "{}", Hops: 2},
+		&Diffusion{ID: "1:message_4", Color: "red", Content: "{}", SiteID: "2", Reached: 2, Sites: []string{"2", "3"}},
+		&Partition{SiteID: "1", Unreachable: []string{"3", "4"}},
+		&ReleaseSc{SiteID: "2", Text: "{}\n", Merge: "1|2:af", Conflicts: 1, Rejoined: []string{"1", "2"}, Released: map[string]int{"1": 2}},
+		&Initialization{},
+		&InitialText{SiteID: "1", Invite: "dte://[::1]:9000/Team%20notes?token=a%26b"},
+		&AppRequest{},
+	}
+	for _, m := range messages {
+		got, err := Unmarshal(Marshal(m))
+		if err != nil {
+			t.Fatalf("Unmarshal(%q): %v", Marshal(m), err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("round trip of %#v gave %#v", m, got)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		line string
+		link Link
+		want error
+	}{
+		{"not a message", ControlerToApp, ErrIllFormed},
+		{wire.Format(SiteIdField, "1"), ControlerToApp, ErrIllFormed},
+		{wire.Format(TypeField, "jco"), ControlerToApp, ErrUnknownType},
+		{Marshal(&RequestSc{SiteID: "1"}), ControlerToApp, ErrNotAddressed},
+		{wire.Format(TypeField, MsgRequestSc), ControlerToNetwork, ErrIllFormed},
+		{wire.Format(TypeField, MsgRequestSc) + wire.Format(SiteIdField, "1") + wire.Format(StampField, "x"), ControlerToNetwork, ErrIllFormed},
+	}
+	for _, tt := range tests {
+		if _, err := Decode(tt.line, tt.link); !errors.Is(err, tt.want) {
+			t.Errorf("Decode(%q, %s) = %v, want %v", tt.line, tt.link, err, tt.want)
+		}
+	}
+}
+
+func TestEveryTypeIsRegistered(t *testing.T) {
+	links := []Link{AppToControler, ControlerToApp, ControlerToNetwork, NetworkToControler, NetworkToNetwork, Wave}
+	for typ, newMessage := range messageTypes {
+		if newMessage().Type() != typ {
+			t.Errorf("message registered as %q has type %q", typ, newMessage().Type())
+		}
+		if !Registered(typ, links...) {
+			t.Errorf("message type %q is not valid on any link", typ)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := Capabilities{CapFraming: {"len", "line"}, CapEditing: {"diff"}, CapCompression: {"none"}}
+
+	choices, err := Negotiate(local, Capabilities{CapFraming: {"line", "len"}, CapEditing: {"diff"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Choices{CapFraming: "line", CapEditing: "diff", CapCompression: "none"}
+	if !reflect.DeepEqual(choices, want) {
+		t.Errorf("Negotiate = %v, want %v", choices, want)
+	}
+
+	if choices, _ := Negotiate(local, nil); choices.Get(CapFraming) != "line" {
+		t.Errorf("a site without capabilities should get the line framing, got %v", choices)
+	}
+	if _, err := Negotiate(local, Capabilities{CapEditing: {"crdt"}}); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("Negotiate with another editing model = %v, want ErrIncompatible", err)
+	}
+	if err := CheckVersion(0); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("CheckVersion(0) = %v, want ErrIncompatible", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("a ~ b ` c\nd é ", 1000)
+	compressed, err := Compress(GzipCompression, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(text) {
+		t.Errorf("compressed %d bytes into %d bytes", len(text), len(compressed))
+	}
+	if got, err := Decompress(GzipCompression, compressed); err != nil || got != text {
+		t.Errorf("Decompress = %d bytes, %v", len(got), err)
+	}
+	if _, err := Decompress(GzipCompression, "not base64"); !errors.Is(err, ErrIllFormed) {
+		t.Errorf("Decompress of garbage = %v, want ErrIllFormed", err)
+	}
+}
+
+// TestDecompressLimit refuses a small frame which would expand beyond the
+// size of a frame
+func TestDecompressLimit(t *testing.T) {
+	bomb, err := Compress(GzipCompression, strings.Repeat("a", wire.DefaultMaxFrameSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bomb) >= wire.DefaultMaxFrameSize/100 {
+		t.Fatalf("compressed into %d bytes", len(bomb))
+	}
+	if _, err := Decompress(GzipCompression, bomb); !errors.Is(err, wire.ErrFrameTooLarge) {
+		t.Errorf("Decompress of %d bytes = %v, want ErrFrameTooLarge", len(bomb), err)
+	}
+}
+
+func TestInvite(t *testing.T) {
+	for _, invite := range []Invite{
+		{Target: "192.168.1.10:9000", Document: "Team notes"},
+		{Target: "[2001:db8::1]:9000", Document: "a/b ?#%", Token: "pass word&token=x"},
+	} {
+		link := invite.String()
+		if got, err := ParseInvite(link); err != nil || got != invite {
+			t.Errorf("ParseInvite(%q) = %+v, %v, want %+v", link, got, err, invite)
+		}
+		if redacted := invite.Redacted(); strings.Contains(redacted, "word") || (invite.Token == "") != (redacted == link) {
+			t.Errorf("%+v redacted to %q", invite, redacted)
+		}
+	}
+	for _, link := range []string{
+		"http://host:9000/doc",
+		"dte://host/doc",
+		"dte://host:9000/",
+		"dte://host:9000/doc%zz",
+	} {
+		if _, err := ParseInvite(link); !errors.Is(err, ErrBadInvite) {
+			t.Errorf("ParseInvite(%q) = %v, want ErrBadInvite", link, err)
+		}
+	}
+}
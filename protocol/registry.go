@@ -0,0 +1,62 @@
+package protocol
+
+// Link is a boundary between two layers, messages are only valid on the
+// links they are registered for
+type Link string
+
+const (
+	AppToControler     Link = "app->ctl"
+	ControlerToApp     Link = "ctl->app"
+	ControlerToNetwork Link = "ctl->net"
+	NetworkToControler Link = "net->ctl"
+	NetworkToNetwork   Link = "net->net"
+	Wave               Link = "wave" // content of the diffusion messages
+)
+
+// registry lists the message types valid on each link
+var registry = map[Link][]string{
+	AppToControler: {
+		MsgAppRequest, MsgAppRelease, MsgCut, MsgAppDied, MsgReturnText, ContentResponse, MsgMergedLog,
+	},
+	ControlerToApp: {
+		MsgAppStartSc, MsgAppUpdate, MsgReturnInitialText, MsgReturnText, ContentRequest, MsgAppDied,
+		MsgPartition, MsgMergeLogs, MsgMergedLog,
+	},
+	ControlerToNetwork: {
+		GetSharedText, MsgRequestSc, MsgReleaseSc, MsgReceiptSc, MsgJsonRequest, MsgReceiptCut, MsgResync,
+		MsgMergeState,
+	},
+	NetworkToControler: {
+		InitializationMessage, KnownSiteListMessage, GetSharedText, AddSiteCriticalSection, MsgSiteFailed,
+		MsgLinkRestored, MsgRequestSc, MsgReleaseSc, MsgReceiptSc, MsgJsonRequest, MsgReceiptCut, MsgResync,
+		MsgPartition, MsgMerge, MsgMergeState,
+	},
+	NetworkToNetwork: {
+		MsgAccessRequest, MsgAccessGranted, MsgAccessDenied, MsgChallenge, MsgChallengeResp, DiffusionMessage,
+		MsgHeartbeat, MsgAnnounce, MsgTreeChild, MsgTreeStale, MsgUnicast,
+	},
+	Wave: {
+		MsgRequestSc, MsgReleaseSc, MsgReceiptSc, MsgJsonRequest, MsgReceiptCut, MsgSiteFailed, MsgResync,
+		MsgTreeBuild, MsgCensus, MsgPartition, MsgMergeState,
+	},
+}
+
+// Registered reports whether typ is valid on at least one of links
+func Registered(typ string, links ...Link) bool {
+	for _, link := range links {
+		for _, t := range registry[link] {
+			if t == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Decode parses a line received on one of links. It returns ErrNotAddressed
+// for a valid type that belongs to another link (e.g. a controler message for
+// the network read by the application), which callers can silently ignore,
+// and ErrUnknownType or ErrIllFormed for anything that should be reported.
+func Decode(line string, links ...Link) (Message, error) {
+	return decode(line, links)
+}
@@ -10,6 +10,9 @@ OUTPUTS_DIR="$PWD/output"
 BASE_PORT=9000
 MAX_TARGETS=3
 CLEAN_OUTPUT=0
+FRAMING="line"
+BROADCAST="wave"
+IPC_FLAG="" # --fifo to link the layers of each site by FIFOs instead of sockets
 
 # Array to store site PIDs and timestamps
 declare -a SITE_PIDS
@@ -23,6 +26,10 @@ while [[ $# -gt 0 ]]; do
             NUM_SITES="$2"
             shift 2
             ;;
+        --fifo)
+            IPC_FLAG="--fifo"
+            shift
+            ;;
         --fifo-dir)
             FIFO_DIR="$2"
             shift 2
@@ -43,14 +50,25 @@ while [[ $# -gt 0 ]]; do
             CLEAN_OUTPUT=1
             shift
             ;;
+        --framing)
+            FRAMING="$2"
+            shift 2
+            ;;
+        --broadcast)
+            BROADCAST="$2"
+            shift 2
+            ;;
         -h|--help)
             echo "Usage: $0 [OPTIONS]"
             echo "  -n, --num-sites NUM     Number of sites to create"
+            echo "      --fifo              Link the layers of each site by FIFOs and tee instead of sockets (for debugging)"
             echo "      --fifo-dir DIR      Directory for FIFOs (default: /tmp)"
             echo "      --output-dir DIR    Directory for outputs (default: ./output)"
             echo "      --base-port PORT    Base port number (default: 9000)"
             echo "      --max-targets NUM   Maximum number of targets per site (default: 3)"
             echo "      --clean-output      Clean output directory before starting"
+            echo "      --framing MODE      Framing between app, controler and network: line or len (default: line)"
+            echo "      --broadcast MODE    Broadcast of the controler messages: wave or tree (default: wave)"
             echo "  -h, --help              Show this help"
             echo ""
             echo "Example:"
@@ -83,6 +101,7 @@ echo "  FIFO directory: $FIFO_DIR"
 echo "  Output directory: $OUTPUTS_DIR"
 echo "  Base port: $BASE_PORT"
 echo "  Max targets per site: $MAX_TARGETS"
+echo "  Broadcast: $BROADCAST"
 echo "  Clean output: $CLEAN_OUTPUT"
 echo ""
 
@@ -212,7 +231,7 @@ for ((i=0; i<NUM_SITES; i++)); do
     fi
     
     # Build and execute site.sh command
-    site_cmd="bash ./site.sh --id \"$site_id\" --document \"$site_id\" --port $port --fifo-dir \"$FIFO_DIR\" --output-dir \"$OUTPUTS_DIR\" --already-built"
+    site_cmd="bash ./site.sh --id \"$site_id\" --document \"$site_id\" --port $port --fifo-dir \"$FIFO_DIR\" --output-dir \"$OUTPUTS_DIR\" --framing $FRAMING --broadcast $BROADCAST $IPC_FLAG --already-built"
     
     if [ ! -z "$targets" ]; then
         site_cmd="$site_cmd --targets \"$targets\""
@@ -285,10 +304,24 @@ done
 export SITE_IDS_FOR_GRAPH="$site_ids_joined"
 echo "DEBUG: Exporting SITE_IDS_FOR_GRAPH: ${SITE_IDS_FOR_GRAPH}"
 
+# The matrix is the topology the targets were chosen for: the sites dump the
+# links they really have (SIGUSR1), which are drawn instead when they all answer
+sleep 1
+rm -f "$OUTPUTS_DIR"/*_topology.json
+for ((i=0; i<NUM_SITES; i++)); do
+    pkill -USR1 -f "build/network -id ${SITE_IDS[i]}" 2>/dev/null
+done
+sleep 1
+
 # Use the pre-built graph generator executable
-echo "$matrix_data" | SITE_IDS_FOR_GRAPH="${SITE_IDS_FOR_GRAPH}" "$PWD/build/graph_generator" "$OUTPUTS_DIR/network_topology.png"
+if ! "$PWD/build/graph_generator" -dumps "$OUTPUTS_DIR" "$OUTPUTS_DIR/network_topology.png"; then
+    echo "No topology dumps, drawing the chosen targets instead"
+    echo "$matrix_data" | SITE_IDS_FOR_GRAPH="${SITE_IDS_FOR_GRAPH}" "$PWD/build/graph_generator" "$OUTPUTS_DIR/network_topology.png"
+fi
 
 echo "Network topology graph created: $OUTPUTS_DIR/network_topology.png"
+echo "To draw it again after sites left or reconnected:"
+echo "  pkill -USR1 -f build/network && sleep 1 && build/graph_generator -dumps \"$OUTPUTS_DIR\" \"$OUTPUTS_DIR/network_topology.png\""
 
 echo ""
 echo "Press Ctrl+C to stop all sites and cleanup."
@@ -3,12 +3,28 @@
 # Default values
 TARGET_ADDRESSES=""
 FIFO_DIR="/tmp"
+SOCKET_DIR="" # default: a private directory created for the site
+IPC="socket" # or fifo, the layers linked by FIFOs, cat and tee
 PORT=9000
 OUTPUTS_DIR="$PWD/output"
 # nano timestamp for id 
 TIMESTAMP_ID=$(date +%s%N)
 ALREADY_BUILT=0
+APP="app" # or relay, without window
 DOCUMENT_NAME="New document - $TIMESTAMP_ID"
+DOCUMENT_SET=0
+INVITE=""
+SECRET_FILE="" # passphrase of the invitation link, given to the network
+SOCKET_DIR_MADE=0
+FRAMING="line"
+BROADCAST="wave"
+TLS_FLAGS=()
+SECRET_FLAGS=()
+DISCOVER_FLAGS=()
+ADDRESS_FLAGS=()
+METRICS_PORT=""
+NETWORK_METRICS_FLAGS=()
+CONTROLER_METRICS_FLAGS=()
 
 # Process IDs for the components
 NETWORK_PID=""
@@ -20,12 +36,17 @@ while [[ $# -gt 0 ]]; do
     case $1 in
         --document|-d)
             DOCUMENT_NAME="$2"
+            DOCUMENT_SET=1
             shift 2
             ;;
         --id)
             TIMESTAMP_ID="$2"
             shift 2
             ;;
+        --invite|-i)
+            INVITE="$2"
+            shift 2
+            ;;
         --targets|-t)
             TARGET_ADDRESSES="$2"
             shift 2
@@ -34,6 +55,14 @@ while [[ $# -gt 0 ]]; do
             FIFO_DIR="$2"
             shift 2
             ;;
+        --socket-dir)
+            SOCKET_DIR="$2"
+            shift 2
+            ;;
+        --fifo)
+            IPC="fifo"
+            shift
+            ;;
         --output-dir)
             OUTPUTS_DIR="$2"
             shift 2
@@ -42,6 +71,54 @@ while [[ $# -gt 0 ]]; do
             PORT="$2"
             shift 2
             ;;
+        --listen)
+            ADDRESS_FLAGS+=(-listen "$2")
+            shift 2
+            ;;
+        --advertise)
+            ADDRESS_FLAGS+=(-advertise "$2")
+            shift 2
+            ;;
+        --framing)
+            FRAMING="$2"
+            shift 2
+            ;;
+        --broadcast)
+            BROADCAST="$2"
+            shift 2
+            ;;
+        --cert)
+            TLS_FLAGS+=(-cert "$2")
+            shift 2
+            ;;
+        --key)
+            TLS_FLAGS+=(-key "$2")
+            shift 2
+            ;;
+        --ca)
+            TLS_FLAGS+=(-ca "$2")
+            shift 2
+            ;;
+        --secret)
+            SECRET_FLAGS=(-secret "$2")
+            shift 2
+            ;;
+        --secret-file)
+            SECRET_FLAGS=(-secret-file "$2")
+            shift 2
+            ;;
+        --discover)
+            DISCOVER_FLAGS=(-discover)
+            shift
+            ;;
+        --metrics)
+            METRICS_PORT="$2"
+            shift 2
+            ;;
+        --relay)
+            APP="relay"
+            shift
+            ;;
         --already-built)
             ALREADY_BUILT=1
             shift
@@ -50,14 +127,30 @@ while [[ $# -gt 0 ]]; do
             echo "Usage: $0 [OPTIONS]"
             echo "  -d, --document NAME     Document name"
             echo "  -t, --targets ADDRS     Target addresses (comma-separated host:port)"
+            echo "  -i, --invite LINK       Join with an invitation link dte://host:port/<document>?token=<passphrase> (Share button of the app)"
+            echo "      --socket-dir DIR    Directory for the Unix sockets of the layers, keep it private (default: a new directory only open to the user)"
+            echo "      --fifo              Link the layers by FIFOs and tee instead of sockets (for debugging)"
             echo "      --fifo-dir DIR      Directory for FIFOs (default: /tmp)"
             echo "      --output-dir DIR    Directory for outputs (default: ./output)"
             echo "      --port PORT         Port for site (default: 9000)"
+            echo "      --listen ADDR       Address to listen on instead of every interface, e.g. 192.168.1.10:9000 or [::]:9000"
+            echo "      --advertise ADDR    Address the other sites dial to reach this site (default: the host of --listen, or the IP of the machine)"
+            echo "      --framing MODE      Framing between app, controler and network: line or len (default: line)"
+            echo "      --broadcast MODE    Broadcast of the controler messages: wave or tree (default: wave)"
+            echo "      --cert FILE         Site certificate for mutual TLS with peers (with --key and --ca)"
+            echo "      --key FILE          Private key of the site certificate"
+            echo "      --ca FILE           Certificate authority of the network (see: build/network certs -h)"
+            echo "      --secret PASS       Passphrase of the document, needed by every site of the network"
+            echo "      --secret-file FILE  Read the passphrase from FILE instead"
+            echo "      --discover          Announce the site on the LAN, and without targets join a site of the same document found there"
+            echo "      --metrics PORT      Serve the metrics of the network on localhost:PORT and of the controler on PORT+1"
+            echo "      --relay             Run without window: the site keeps the document and serves it to the sites joining"
             echo "      --already-built     Skip build step (use if already built)"
             echo "  -h, --help              Show this help"
             echo ""
             echo "Example:"
             echo "  $0 --document mydoc --targets localhost:8080,192.168.1.10:9000"
+            echo "  $0 --invite \"dte://192.168.1.10:9000/mydoc\" --port 9001"
             exit 0
             ;;
         *)
@@ -68,19 +161,76 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
+# urldecode decodes a component of a link (+ and %XX)
+urldecode() {
+    local s="${1//+/ }"
+    printf '%b' "${s//%/\\x}"
+}
+
 FLAG_TARGET_ADDRESSES="-targets"
 if [ -z "$TARGET_ADDRESSES" ]; then
     FLAG_TARGET_ADDRESSES=""
 fi
+# the network names the document in its invitation links, and the app in its save file
+DOCUMENT_FLAGS=(-document "$DOCUMENT_NAME")
+APP_DOCUMENT_FLAGS=(-f "$DOCUMENT_NAME")
+if [ -n "$INVITE" ]; then
+    # the link gives the targets, the passphrase and the document unless --document is set
+    if [ "$DOCUMENT_SET" -eq 0 ]; then
+        DOCUMENT_FLAGS=()
+        APP_DOCUMENT_FLAGS=()
+        DOCUMENT_NAME="given by the invitation link"
+    fi
+    # the passphrase of the link goes to the network in a private file, not on
+    # the command lines shown by ps, and the app only needs the document
+    case "$INVITE" in
+        *\?*token=*)
+            TOKEN="${INVITE#*token=}"
+            TOKEN="${TOKEN%%&*}"
+            if [ ${#SECRET_FLAGS[@]} -eq 0 ]; then
+                SECRET_FILE=$(mktemp)
+                urldecode "$TOKEN" > "$SECRET_FILE"
+                SECRET_FLAGS=(-secret-file "$SECRET_FILE")
+            fi
+            ;;
+    esac
+    INVITE="${INVITE%%\?*}"
+    DOCUMENT_FLAGS+=(-invite "$INVITE")
+    APP_DOCUMENT_FLAGS+=(-invite "$INVITE")
+fi
+if [ -n "$METRICS_PORT" ]; then
+    NETWORK_METRICS_FLAGS=(-metrics "127.0.0.1:$METRICS_PORT")
+    CONTROLER_METRICS_FLAGS=(-metrics "127.0.0.1:$((METRICS_PORT + 1))")
+fi
+
+# the sockets carry the document: they are made in a directory only open to
+# the user, not in /tmp where any user can reach them
+if [ "$IPC" = "socket" ] && [ -z "$SOCKET_DIR" ]; then
+    SOCKET_DIR=$(mktemp -d)
+    SOCKET_DIR_MADE=1
+fi
 
 # Display configuration
 echo "Configuration:"
 echo "  Document: $DOCUMENT_NAME"
 echo "  Targets: $TARGET_ADDRESSES"
-echo "  FIFO directory: $FIFO_DIR"
+if [ "$IPC" = "fifo" ]; then
+    echo "  FIFO directory: $FIFO_DIR"
+else
+    echo "  Socket directory: $SOCKET_DIR"
+fi
 echo "  Output directory: $OUTPUTS_DIR"
 echo "  Port: $PORT"
+echo "  Framing: $FRAMING"
+echo "  Broadcast: $BROADCAST"
+if [ -n "$METRICS_PORT" ]; then
+    echo "  Metrics: http://127.0.0.1:$METRICS_PORT/metrics (network), http://127.0.0.1:$((METRICS_PORT + 1))/metrics (controler)"
+fi
 echo "  Timestamp ID: $TIMESTAMP_ID"
+echo "  Topology: pkill -USR1 -f \"build/network -id $TIMESTAMP_ID\" dumps the neighbors in $OUTPUTS_DIR/${TIMESTAMP_ID}_topology.json"
+if [ "$APP" = "relay" ]; then
+    echo "  Relay: document kept in $OUTPUTS_DIR, no window"
+fi
 echo ""
 
 
@@ -109,6 +259,15 @@ cleanup () {
  
   # Suppression des tubes nommés
   rm -f $FIFO_DIR/${TIMESTAMP_ID}_in_* $FIFO_DIR/${TIMESTAMP_ID}_out_*
+  if [ -n "$SOCKET_DIR" ]; then
+    rm -f $SOCKET_DIR/${TIMESTAMP_ID}_*.sock
+  fi
+  if [ "$SOCKET_DIR_MADE" -eq 1 ]; then
+    rmdir "$SOCKET_DIR" 2> /dev/null
+  fi
+  if [ -n "$SECRET_FILE" ]; then
+    rm -f "$SECRET_FILE"
+  fi
 
   exit 0
 }
@@ -119,34 +278,51 @@ if [ "$ALREADY_BUILT" -eq 0 ]; then
 
     # create outputs folder
     mkdir -p "$OUTPUTS_DIR"
-    # create fifo directory if it does not exist
+    # create the fifo directory if it does not exist
     mkdir -p "$FIFO_DIR"
     go work use
     go build -o $PWD/build/network ./network
     go build -o $PWD/build/controler ./controler
-    go build -o $PWD/build/app ./app
+    if [ "$APP" = "relay" ]; then
+        go build -o $PWD/build/relay ./app/relay
+    else
+        go build -o $PWD/build/app ./app
+    fi
 
 else
     echo "Skipping build step as --already-built is set."
 fi
 
-# create fifo for app, controler and network
-for i in $(seq 1 3); do
-    mkfifo "$FIFO_DIR/${TIMESTAMP_ID}_in_$i"
-    mkfifo "$FIFO_DIR/${TIMESTAMP_ID}_out_$i"
-done
+if [ "$IPC" = "socket" ]; then
+    # the application and the network listen on their sockets, the controler
+    # connects to both and sends each one only its messages
+    mkdir -p "$SOCKET_DIR"
+    "$PWD/build/network" -id "$TIMESTAMP_ID" -port $PORT -framing "$FRAMING" -broadcast "$BROADCAST" "${TLS_FLAGS[@]}" "${SECRET_FLAGS[@]}" "${ADDRESS_FLAGS[@]}" "${DISCOVER_FLAGS[@]}" "${DOCUMENT_FLAGS[@]}" "${NETWORK_METRICS_FLAGS[@]}" -socket "$SOCKET_DIR" -topology "$OUTPUTS_DIR/${TIMESTAMP_ID}_topology.json" "$FLAG_TARGET_ADDRESSES" "$TARGET_ADDRESSES" < /dev/null &
+    NETWORK_PID=$!
+    "$PWD/build/$APP" -id "$TIMESTAMP_ID" -framing "$FRAMING" -o "$OUTPUTS_DIR" "${APP_DOCUMENT_FLAGS[@]}" -socket "$SOCKET_DIR" < /dev/null &
+    APP_PID=$!
+    "$PWD/build/controler" -id "$TIMESTAMP_ID" -framing "$FRAMING" "${CONTROLER_METRICS_FLAGS[@]}" -socket "$SOCKET_DIR" < /dev/null &
+    CONTROLER_PID=$!
+else
+    # create fifo for app, controler and network
+    for i in $(seq 1 3); do
+        mkfifo "$FIFO_DIR/${TIMESTAMP_ID}_in_$i"
+        mkfifo "$FIFO_DIR/${TIMESTAMP_ID}_out_$i"
+    done
 
-# start local network between app, controler and network
-"$PWD/build/network" -id "$TIMESTAMP_ID" -port $PORT "$FLAG_TARGET_ADDRESSES" "$TARGET_ADDRESSES" < "$FIFO_DIR/${TIMESTAMP_ID}_in_1" > "$FIFO_DIR/${TIMESTAMP_ID}_out_1" &
-NETWORK_PID=$!
-"$PWD/build/controler" -id "$TIMESTAMP_ID" < "$FIFO_DIR/${TIMESTAMP_ID}_in_2" > "$FIFO_DIR/${TIMESTAMP_ID}_out_2" &
-CONTROLER_PID=$!
-"$PWD/build/app" -id "$TIMESTAMP_ID" -o "$OUTPUTS_DIR" -f "$DOCUMENT_NAME" < "$FIFO_DIR/${TIMESTAMP_ID}_in_3" > "$FIFO_DIR/${TIMESTAMP_ID}_out_3" &
-APP_PID=$!
+    # start local network between app, controler and network
+    "$PWD/build/network" -id "$TIMESTAMP_ID" -port $PORT -framing "$FRAMING" -broadcast "$BROADCAST" "${TLS_FLAGS[@]}" "${SECRET_FLAGS[@]}" "${ADDRESS_FLAGS[@]}" "${DISCOVER_FLAGS[@]}" "${DOCUMENT_FLAGS[@]}" "${NETWORK_METRICS_FLAGS[@]}" -topology "$OUTPUTS_DIR/${TIMESTAMP_ID}_topology.json" "$FLAG_TARGET_ADDRESSES" "$TARGET_ADDRESSES" < "$FIFO_DIR/${TIMESTAMP_ID}_in_1" > "$FIFO_DIR/${TIMESTAMP_ID}_out_1" &
+    NETWORK_PID=$!
+    "$PWD/build/controler" -id "$TIMESTAMP_ID" -framing "$FRAMING" "${CONTROLER_METRICS_FLAGS[@]}" -app-in "$FIFO_DIR/${TIMESTAMP_ID}_out_3" < "$FIFO_DIR/${TIMESTAMP_ID}_in_2" > "$FIFO_DIR/${TIMESTAMP_ID}_out_2" &
+    CONTROLER_PID=$!
+    "$PWD/build/$APP" -id "$TIMESTAMP_ID" -framing "$FRAMING" -o "$OUTPUTS_DIR" "${APP_DOCUMENT_FLAGS[@]}" < "$FIFO_DIR/${TIMESTAMP_ID}_in_3" > "$FIFO_DIR/${TIMESTAMP_ID}_out_3" &
+    APP_PID=$!
 
-# start tee and cat to redirect outputs
-cat "$FIFO_DIR/${TIMESTAMP_ID}_out_1" > "$FIFO_DIR/${TIMESTAMP_ID}_in_2" &
-cat "$FIFO_DIR/${TIMESTAMP_ID}_out_3" > "$FIFO_DIR/${TIMESTAMP_ID}_in_2" &
-cat "$FIFO_DIR/${TIMESTAMP_ID}_out_2" | tee "$FIFO_DIR/${TIMESTAMP_ID}_in_3" > "$FIFO_DIR/${TIMESTAMP_ID}_in_1" &
+    # start tee and cat to redirect outputs (the controler reads the app output itself
+    # so that each of its inputs has a single writer)
+    cat "$FIFO_DIR/${TIMESTAMP_ID}_out_1" > "$FIFO_DIR/${TIMESTAMP_ID}_in_2" &
+    cat "$FIFO_DIR/${TIMESTAMP_ID}_out_2" | tee "$FIFO_DIR/${TIMESTAMP_ID}_in_3" > "$FIFO_DIR/${TIMESTAMP_ID}_in_1" &
+fi
 
-wait
\ No newline at end of file
+wait
+cleanup
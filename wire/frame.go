@@ -0,0 +1,162 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Framing tells how messages are delimited on a stream
+type Framing string
+
+const (
+	LineFraming   Framing = "line" // one message per line, the historical format
+	LengthFraming Framing = "len"  // 4 bytes big endian length followed by the message
+)
+
+// DefaultMaxFrameSize is the largest message accepted by a Reader or a Writer
+// unless configured otherwise
+const DefaultMaxFrameSize = 64 << 20
+
+var ErrFrameTooLarge = errors.New("wire: frame too large")
+
+// ParseFraming returns the framing named s
+func ParseFraming(s string) (Framing, error) {
+	switch Framing(s) {
+	case LineFraming, LengthFraming:
+		return Framing(s), nil
+	}
+	return "", fmt.Errorf("wire: unknown framing %q (expected %q or %q)", s, LineFraming, LengthFraming)
+}
+
+// Reader reads framed messages from a stream. The framing can be changed
+// between two calls to ReadFrame, e.g. once it has been negotiated.
+type Reader struct {
+	r            *bufio.Reader
+	framing      Framing
+	MaxFrameSize int
+}
+
+// NewReader returns a Reader using line framing
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:            bufio.NewReader(r),
+		framing:      LineFraming,
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetFraming changes the framing of the next frames, it must not be called
+// concurrently with ReadFrame
+func (r *Reader) SetFraming(f Framing) { r.framing = f }
+
+// Framing returns the current framing
+func (r *Reader) Framing() Framing { return r.framing }
+
+// ReadFrame returns the next message without its delimiter. An oversized
+// frame is skipped and reported with ErrFrameTooLarge, the next call reads
+// the following frame.
+func (r *Reader) ReadFrame() (string, error) {
+	if r.framing == LengthFraming {
+		return r.readLengthFrame()
+	}
+	return r.readLine()
+}
+
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(line)+len(chunk) > r.MaxFrameSize+1 { // +1 for the line break
+			for err == bufio.ErrBufferFull { // skip the end of the line
+				_, err = r.r.ReadSlice('\n')
+			}
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrFrameTooLarge, r.MaxFrameSize)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return string(line), nil
+	}
+}
+
+func (r *Reader) readLengthFrame() (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(r.MaxFrameSize) {
+		io.CopyN(io.Discard, r.r, int64(size)) // skip the payload
+		return "", fmt.Errorf("%w: %d bytes announced, limit is %d", ErrFrameTooLarge, size, r.MaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// Writer writes framed messages to a stream, it is safe for concurrent use
+type Writer struct {
+	mu           sync.Mutex
+	w            io.Writer
+	framing      Framing
+	MaxFrameSize int
+}
+
+// NewWriter returns a Writer using line framing
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:            w,
+		framing:      LineFraming,
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetFraming changes the framing of the next frames
+func (w *Writer) SetFraming(f Framing) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.framing = f
+}
+
+// WriteFrame writes msg with its delimiter in a single call to the
+// underlying writer, so that frames from several writers sharing a pipe are
+// not interleaved
+func (w *Writer) WriteFrame(msg string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(msg) > w.MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrFrameTooLarge, len(msg), w.MaxFrameSize)
+	}
+	var buf []byte
+	if w.framing == LengthFraming {
+		buf = make([]byte, 4, 4+len(msg))
+		binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+		buf = append(buf, msg...)
+	} else {
+		buf = make([]byte, 0, len(msg)+1)
+		buf = append(buf, msg...)
+		buf = append(buf, '\n')
+	}
+	_, err := w.w.Write(buf)
+	return err
+}
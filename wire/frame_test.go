@@ -0,0 +1,99 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFramesLargerThanScannerLimit(t *testing.T) {
+	big := Format("typ", "mag") + Format("upt", strings.Repeat("é~", 100<<10))
+	for _, framing := range []Framing{LineFraming, LengthFraming} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetFraming(framing)
+		for _, msg := range []string{Format("typ", "maq"), big, Format("typ", "dif")} {
+			if err := w.WriteFrame(msg); err != nil {
+				t.Fatalf("%s: WriteFrame: %v", framing, err)
+			}
+		}
+		r := NewReader(&buf)
+		r.SetFraming(framing)
+		for _, want := range []string{Format("typ", "maq"), big, Format("typ", "dif")} {
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("%s: ReadFrame: %v", framing, err)
+			}
+			if got != want {
+				t.Fatalf("%s: got a %d bytes frame, want %d bytes", framing, len(got), len(want))
+			}
+		}
+		if _, err := r.ReadFrame(); err != io.EOF {
+			t.Errorf("%s: got %v at end of stream, want io.EOF", framing, err)
+		}
+	}
+}
+
+func TestSwitchFramingMidStream(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteFrame("~`typ`maq")
+	w.SetFraming(LengthFraming)
+	w.WriteFrame("~`typ`dif")
+
+	r := NewReader(&buf)
+	if got, _ := r.ReadFrame(); got != "~`typ`maq" {
+		t.Fatalf("got %q before the switch", got)
+	}
+	r.SetFraming(LengthFraming)
+	if got, _ := r.ReadFrame(); got != "~`typ`dif" {
+		t.Fatalf("got %q after the switch", got)
+	}
+}
+
+func TestOversizedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.MaxFrameSize = 10
+	if err := w.WriteFrame(strings.Repeat("x", 11)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame = %v, want ErrFrameTooLarge", err)
+	}
+
+	r := NewReader(strings.NewReader(strings.Repeat("x", 10000) + "\nnext\n"))
+	r.MaxFrameSize = 10
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("line ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+	if got, err := r.ReadFrame(); got != "next" {
+		t.Errorf("line ReadFrame after an oversized frame = %q, %v", got, err)
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetFraming(LengthFraming)
+	w.WriteFrame(strings.Repeat("x", 100))
+	w.WriteFrame("next")
+	r = NewReader(&buf)
+	r.SetFraming(LengthFraming)
+	r.MaxFrameSize = 10
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("length ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+	if got, err := r.ReadFrame(); got != "next" {
+		t.Errorf("length ReadFrame after an oversized frame = %q, %v", got, err)
+	}
+}
+
+func TestTruncatedFrames(t *testing.T) {
+	r := NewReader(strings.NewReader("~`typ`rls"))
+	if _, err := r.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("line ReadFrame = %v, want io.ErrUnexpectedEOF", err)
+	}
+	r = NewReader(bytes.NewReader([]byte{0, 0, 0, 9, '~'}))
+	r.SetFraming(LengthFraming)
+	if _, err := r.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("length ReadFrame = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,63 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Pipe links two layers of a site run in one process, in place of a FIFO:
+// each write is queued in a channel and read in order, so a frame written by
+// a Writer is never split between two writers. Like a FIFO, it holds a limited
+// number of writes and the writer waits when it is full. It is read by a
+// single goroutine
+type Pipe struct {
+	writes  chan []byte
+	pending []byte // rest of the write being read
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewPipe returns a pipe holding up to size writes not read yet
+func NewPipe(size int) *Pipe {
+	return &Pipe{writes: make(chan []byte, size), closed: make(chan struct{})}
+}
+
+// Write queues a copy of b, and fails once the pipe is closed
+func (p *Pipe) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case p.writes <- bytes.Clone(b):
+		return len(b), nil
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Read reads the writes in order, then io.EOF once the pipe is closed
+func (p *Pipe) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		select {
+		case p.pending = <-p.writes:
+		case <-p.closed:
+			select { // the writes queued before Close are still read
+			case p.pending = <-p.writes:
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// Close ends the pipe
+func (p *Pipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
@@ -0,0 +1,45 @@
+package wire
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestPipeKeepsFrames writes frames from two writers sharing a pipe, like
+// the controler and the network writing to the application: each frame is
+// read whole
+func TestPipeKeepsFrames(t *testing.T) {
+	p := NewPipe(4)
+	for _, writer := range []string{"ctl", "net"} {
+		go func() {
+			w := NewWriter(p)
+			for range 100 {
+				w.WriteFrame(Format("typ", writer) + Format("upt", strings.Repeat(writer, 100)))
+			}
+		}()
+	}
+	r := NewReader(p)
+	for i := range 200 {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		typ, _ := Lookup(frame, "typ")
+		if upt, _ := Lookup(frame, "upt"); upt != strings.Repeat(typ, 100) {
+			t.Fatalf("frame %d mixed: %q", i, frame)
+		}
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	p := NewPipe(4)
+	p.Write([]byte("queued\n"))
+	p.Close()
+	if _, err := p.Write([]byte("late\n")); err != io.ErrClosedPipe {
+		t.Errorf("write after close: %v", err)
+	}
+	if data, err := io.ReadAll(p); err != nil || string(data) != "queued\n" {
+		t.Errorf("read %q, %v after close, want the queued write", data, err)
+	}
+}
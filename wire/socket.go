@@ -0,0 +1,67 @@
+package wire
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// layers of a site which listen on a socket, the controler dials both
+const (
+	AppSocket     = "app"
+	NetworkSocket = "net"
+)
+
+// SocketPath returns the path of the Unix socket of a layer of site in dir
+func SocketPath(dir, site, layer string) string {
+	return filepath.Join(dir, site+"_"+layer+".sock")
+}
+
+// ErrForeignPeer tells that a socket link was opened by a process of another
+// user
+var ErrForeignPeer = errors.New("wire: socket opened by another user")
+
+// AcceptSocket listens on the Unix socket path and returns the first link
+// opened on it by a process of the same user: the socket is only writable by
+// the user, and the links of the other users are closed where the system
+// tells who opened them. The socket is removed once the link is up, like one
+// left by a site which did not exit cleanly
+func AcceptSocket(path string) (net.Conn, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close() // also removes the socket
+	if err := os.Chmod(path, 0o600); err != nil {
+		return nil, err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeer(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// DialSocket opens a link to the Unix socket path, waiting up to wait for a
+// layer started at the same time to create it
+func DialSocket(path string, wait time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
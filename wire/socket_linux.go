@@ -0,0 +1,36 @@
+//go:build linux
+
+package wire
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkPeer checks that the process at the other end of a Unix socket link
+// runs as the same user as this one
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return ErrForeignPeer
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package wire
+
+import "net"
+
+// checkPeer accepts every link: the system does not tell who opened it, only
+// the permissions of the socket and of its directory keep the other users out
+func checkPeer(conn net.Conn) error { return nil }
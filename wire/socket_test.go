@@ -0,0 +1,83 @@
+package wire
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSocketLink dials a socket before it exists, as the controler does when
+// the layers are started together, and exchanges frames both ways
+func TestSocketLink(t *testing.T) {
+	path := SocketPath(t.TempDir(), "1000", AppSocket)
+	os.WriteFile(path, nil, 0o600) // left by a previous run
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := DialSocket(path, 5*time.Second)
+		if err != nil {
+			dialed <- err
+			return
+		}
+		defer conn.Close()
+		NewWriter(conn).WriteFrame(Format("typ", "ssa"))
+		frame, err := NewReader(conn).ReadFrame()
+		if err == nil && frame != Format("typ", "rqa") {
+			t.Errorf("controler read %q", frame)
+		}
+		dialed <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := AcceptSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed once linked: %v", err)
+	}
+	if frame, err := NewReader(conn).ReadFrame(); err != nil || frame != Format("typ", "ssa") {
+		t.Fatalf("app read %q, %v", frame, err)
+	}
+	NewWriter(conn).WriteFrame(Format("typ", "rqa"))
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDialSocketTimeout gives up when no layer listens
+func TestDialSocketTimeout(t *testing.T) {
+	if _, err := DialSocket(SocketPath(t.TempDir(), "1000", NetworkSocket), 100*time.Millisecond); err == nil {
+		t.Fatal("dialed a socket nobody listens on")
+	}
+}
+
+// TestSocketPrivate checks that the socket is only open to the user while it
+// waits for the controler
+func TestSocketPrivate(t *testing.T) {
+	path := SocketPath(t.TempDir(), "1000", NetworkSocket)
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := AcceptSocket(path)
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().Perm() == 0o600 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socket not private: %v, %v", info, err)
+		}
+	}
+	conn, err := DialSocket(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("link of the same user refused: %v", err)
+	}
+}
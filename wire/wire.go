@@ -0,0 +1,169 @@
+// Package wire implements the line format shared by the app, controler and
+// network layers.
+//
+// A message is an ordered list of key/value fields rendered as
+//
+//	~`key1`value1~`key2`value2
+//
+// Keys and values are escaped so that they never contain the field separator,
+// the key/value separator or a line break: any text, including arbitrary
+// Unicode document content, survives a round trip through Format and Parse.
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	FieldSep  byte = '~'  // separates two fields
+	KeyValSep byte = '`'  // surrounds the key of a field
+	EscapeSep byte = '\\' // introduces an escape sequence
+)
+
+var (
+	ErrMalformed   = errors.New("wire: malformed message")
+	ErrKeyNotFound = errors.New("wire: key not found")
+)
+
+// escape sequences: the character after the backslash and what it stands for
+var unescapes = map[byte]byte{
+	's':  FieldSep,
+	'q':  KeyValSep,
+	'n':  '\n',
+	'r':  '\r',
+	'\\': EscapeSep,
+}
+
+var escaper = strings.NewReplacer(
+	string(EscapeSep), `\\`,
+	string(FieldSep), `\s`,
+	string(KeyValSep), `\q`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// Escape returns s with every special character replaced by its escape sequence
+func Escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// Unescape reverses Escape, it fails on unknown or truncated escape sequences
+func Unescape(s string) (string, error) {
+	if strings.IndexByte(s, EscapeSep) < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != EscapeSep {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("%w: truncated escape sequence at offset %d", ErrMalformed, i)
+		}
+		r, ok := unescapes[s[i+1]]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown escape sequence \\%c at offset %d", ErrMalformed, s[i+1], i)
+		}
+		b.WriteByte(r)
+		i++
+	}
+	return b.String(), nil
+}
+
+// Field is a single key/value pair of a message
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Message is an ordered list of fields, keys are expected to be unique
+type Message []Field
+
+// Set replaces the value of key, or appends the field if key is not present yet
+func (m Message) Set(key string, val string) Message {
+	for i := range m {
+		if m[i].Key == key {
+			m[i].Value = val
+			return m
+		}
+	}
+	return append(m, Field{Key: key, Value: val})
+}
+
+// Get returns the value of key and whether it was present
+func (m Message) Get(key string) (string, bool) {
+	for _, f := range m {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// String encodes the message on a single line (without the trailing newline)
+func (m Message) String() string {
+	var b strings.Builder
+	for _, f := range m {
+		b.WriteString(Format(f.Key, f.Value))
+	}
+	return b.String()
+}
+
+// Format encodes a single field, concatenating formatted fields builds a message
+func Format(key string, val string) string {
+	return string(FieldSep) + string(KeyValSep) + Escape(key) + string(KeyValSep) + Escape(val)
+}
+
+// Parse decodes a line produced by Format or Message.String
+func Parse(msg string) (Message, error) {
+	if msg == "" {
+		return nil, fmt.Errorf("%w: empty message", ErrMalformed)
+	}
+	if msg[0] != FieldSep {
+		return nil, fmt.Errorf("%w: message must start with %q", ErrMalformed, FieldSep)
+	}
+	if strings.ContainsAny(msg, "\r\n") {
+		return nil, fmt.Errorf("%w: message contains a raw line break", ErrMalformed)
+	}
+
+	rawFields := strings.Split(msg[1:], string(FieldSep))
+	m := make(Message, 0, len(rawFields))
+	for i, raw := range rawFields {
+		// a field is `key`value, the value may be empty but the key may not
+		if len(raw) < 2 || raw[0] != KeyValSep {
+			return nil, fmt.Errorf("%w: field %d is not of the form `key`value", ErrMalformed, i)
+		}
+		end := strings.IndexByte(raw[1:], KeyValSep)
+		if end <= 0 {
+			return nil, fmt.Errorf("%w: field %d has no key", ErrMalformed, i)
+		}
+		key, err := Unescape(raw[1 : end+1])
+		if err != nil {
+			return nil, err
+		}
+		val, err := Unescape(raw[end+2:])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		m = append(m, Field{Key: key, Value: val})
+	}
+	return m, nil
+}
+
+// Lookup parses msg and returns the value of key
+func Lookup(msg string, key string) (string, error) {
+	m, err := Parse(msg)
+	if err != nil {
+		return "", err
+	}
+	val, ok := m.Get(key)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return val, nil
+}
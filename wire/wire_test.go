@@ -0,0 +1,100 @@
+package wire
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain text",
+		"tilde ~ and backtick ` inside",
+		"~`upt`injected~`typ`rls",
+		"line one\nline two\r\nline three",
+		`backslash \ and fake escapes \s \q \n \\`,
+		"unicode: é ü ß 漢字 ↩ 🙂 ‍",
+		"\x00\x01 control characters",
+		strings.Repeat("~`\\\n", 1000),
+	}
+	for _, val := range values {
+		var m Message
+		m = m.Set("typ", "upa").Set("upt", val).Set("sid", "42")
+		got, err := Parse(m.String())
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", m.String(), err)
+		}
+		if v, _ := got.Get("upt"); v != val {
+			t.Errorf("round trip of %q gave %q", val, v)
+		}
+		if strings.ContainsAny(m.String(), "\n\r") {
+			t.Errorf("encoding of %q contains a line break", val)
+		}
+	}
+}
+
+func TestRoundTripQuick(t *testing.T) {
+	f := func(key, val string) bool {
+		if key == "" {
+			return true
+		}
+		got, err := Lookup(Format("typ", "x")+Format(key, val), key)
+		return err == nil && got == val
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("upt", "hello ~ world `")
+	f.Add("k", "\\\\s")
+	f.Add("漢字", "🙂\n")
+	f.Fuzz(func(t *testing.T, key, val string) {
+		if key == "" {
+			return
+		}
+		var m Message
+		m = m.Set(key, val)
+		got, err := Parse(m.String())
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", m.String(), err)
+		}
+		if len(got) != 1 || got[0].Key != key || got[0].Value != val {
+			t.Fatalf("round trip of %q=%q gave %v", key, val, got)
+		}
+	})
+}
+
+func TestFieldOrderAndSet(t *testing.T) {
+	var m Message
+	m = m.Set("a", "1").Set("b", "2").Set("a", "3")
+	if m.String() != "~`a`3~`b`2" {
+		t.Errorf("unexpected encoding %q", m.String())
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"typ`rls",
+		"~typ",
+		"~``value",
+		"~`typ`rls\n",
+		"~`upt`bad \\x escape",
+		"~`upt`truncated \\",
+	} {
+		if _, err := Parse(msg); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(%q) = %v, want ErrMalformed", msg, err)
+		}
+	}
+}
+
+func TestLookupMissingKey(t *testing.T) {
+	_, err := Lookup(Format("typ", "rls"), "upt")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, want ErrKeyNotFound", err)
+	}
+}